@@ -0,0 +1,535 @@
+package jarvice
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	logger "jarvice.io/jarvice-hpc/logger"
+)
+
+// Minimum time between checks of running tasks (task concurrency limit)
+const ArrayJobCheckInterval = 15 * time.Second
+
+// Task of an array job (qsub -t)
+type ArrayTask struct {
+	Task int `json:"task"`
+	// JARVICE job number once submitted
+	Number int    `json:"number,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// deleted before submission (qdel)
+	Deleted bool `json:"deleted,omitempty"`
+	// JARVICE job finished
+	Done bool `json:"done,omitempty"`
+	// waiting for task of array job dependency (qsub -hold_jid_ad)
+	Waiting bool `json:"waiting,omitempty"`
+}
+
+// Task is still held on the client
+func (task ArrayTask) Held() bool {
+	return task.Number == 0 && len(task.Error) == 0 && !task.Deleted
+}
+
+// Array job: one JARVICE job per task sharing the array job ID
+// Tasks over the concurrency limit (qsub -tc) are held on the client
+type ArrayJob struct {
+	// JARVICE job number of first submitted task or local job ID
+	Id      int    `json:"id"`
+	Cluster string `json:"cluster"`
+	// job request of tasks (credentials are read from config at submission)
+	Request    JarviceJobRequest `json:"request"`
+	First      int               `json:"first"`
+	Last       int               `json:"last"`
+	Step       int               `json:"step"`
+	Limit      int               `json:"limit,omitempty"`
+	Tasks      []ArrayTask       `json:"tasks"`
+	SubmitTime int64             `json:"submit_time"`
+	BeginTime  int64             `json:"begin_time,omitempty"`
+	LastCheck  int64             `json:"last_check,omitempty"`
+	// notifications of submitted tasks (qsub -m)
+	Events     []string `json:"events,omitempty"`
+	Recipients []string `json:"recipients,omitempty"`
+	// job IDs of dependencies not finished yet (qsub -hold_jid)
+	Hold []int `json:"hold,omitempty"`
+	// array job IDs of task dependencies (qsub -hold_jid_ad)
+	HoldArray []int `json:"hold_array,omitempty"`
+	// claimed for submission of tasks (submitted outside of the store lock)
+	ClaimedAt int64 `json:"claimed_at,omitempty"`
+	// failed submissions (transient errors are retried)
+	Attempts int   `json:"attempts,omitempty"`
+	RetryAt  int64 `json:"retry_at,omitempty"`
+}
+
+// Task can be submitted to JARVICE (concurrency limit aside)
+func (job ArrayJob) releasable(task ArrayTask) bool {
+	return task.Held() && !task.Waiting && len(job.Hold) == 0
+}
+
+// Number of submitted tasks not finished yet
+func (job ArrayJob) active() int {
+	active := 0
+	for _, task := range job.Tasks {
+		if task.Number > 0 && !task.Done {
+			active++
+		}
+	}
+	return active
+}
+
+// Array job has tasks that can be submitted to JARVICE
+func (job ArrayJob) ready(now time.Time) bool {
+	if job.BeginTime > now.Unix() || job.RetryAt > now.Unix() ||
+		claimed(job.ClaimedAt, now) {
+		return false
+	}
+	releasable := false
+	for _, task := range job.Tasks {
+		releasable = releasable || job.releasable(task)
+	}
+	if !releasable {
+		return false
+	}
+	return job.Limit == 0 || job.active() < job.Limit ||
+		now.Sub(time.Unix(job.LastCheck, 0)) >= ArrayJobCheckInterval
+}
+
+// Job request of array task (SGE_TASK_* and JOB_ID environment)
+func (job ArrayJob) TaskRequest(task int) JarviceJobRequest {
+	req := job.Request
+	envs := map[string]string{}
+	for name, value := range req.Hpc.Envs {
+		envs[name] = value
+	}
+	envs["SGE_TASK_ID"] = strconv.Itoa(task)
+	envs["SGE_TASK_FIRST"] = strconv.Itoa(job.First)
+	envs["SGE_TASK_LAST"] = strconv.Itoa(job.Last)
+	envs["SGE_TASK_STEPSIZE"] = strconv.Itoa(job.Step)
+	// tasks share the array job ID (job ID of first task is set by the job)
+	if job.Id > 0 {
+		envs["JOB_ID"] = strconv.Itoa(job.Id)
+	}
+	req.Hpc.Envs = envs
+	return req
+}
+
+// Parse task range n[-m[:s]] (qsub -t, qdel job.tasks)
+func ParseTaskRange(spec string) (first, last, step int, err error) {
+	invalid := errors.New("invalid task range: " + spec)
+	step = 1
+	bounds := spec
+	if index := strings.Index(spec, ":"); index >= 0 {
+		bounds = spec[:index]
+		if step, err = strconv.Atoi(spec[index+1:]); err != nil || step < 1 {
+			return 0, 0, 0, invalid
+		}
+	}
+	split := strings.SplitN(bounds, "-", 2)
+	if first, err = strconv.Atoi(split[0]); err != nil || first < 1 {
+		return 0, 0, 0, invalid
+	}
+	last = first
+	if len(split) == 2 {
+		if last, err = strconv.Atoi(split[1]); err != nil || last < first {
+			return 0, 0, 0, invalid
+		}
+	}
+	// last task is a multiple of step from first
+	last -= (last - first) % step
+	return first, last, step, nil
+}
+
+// Task IDs of task range
+func TaskRangeIds(first, last, step int) []int {
+	tasks := []int{}
+	for task := first; task <= last; task += step {
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
+
+// Compress task IDs into SGE task ranges (e.g. 1-9:2,12)
+func FormatTaskRanges(tasks []int) string {
+	if len(tasks) == 0 {
+		return ""
+	}
+	sorted := append([]int{}, tasks...)
+	sort.Ints(sorted)
+	ranges := []string{}
+	for start := 0; start < len(sorted); {
+		end := start
+		if start+1 < len(sorted) {
+			step := sorted[start+1] - sorted[start]
+			for end+1 < len(sorted) && sorted[end+1]-sorted[end] == step {
+				end++
+			}
+		}
+		if end == start {
+			ranges = append(ranges, strconv.Itoa(sorted[start]))
+		} else {
+			ranges = append(ranges, strconv.Itoa(sorted[start])+"-"+
+				strconv.Itoa(sorted[end])+":"+strconv.Itoa(sorted[start+1]-sorted[start]))
+		}
+		start = end + 1
+	}
+	return strings.Join(ranges, ",")
+}
+
+// Submit held tasks of array job up to the concurrency limit
+// Returns the number of submitted tasks
+func (job *ArrayJob) submitTasks(cluster JarviceCluster) (int, error) {
+	submitted := 0
+	for index := range job.Tasks {
+		task := &job.Tasks[index]
+		if !job.releasable(*task) {
+			continue
+		}
+		if job.Limit > 0 && job.active() >= job.Limit {
+			break
+		}
+		resp, err := ResubmitJob(cluster, job.TaskRequest(task.Task))
+		if err != nil {
+			return submitted, err
+		}
+		task.Number = resp.Number
+		submitted++
+		if job.Id == 0 {
+			job.Id = resp.Number
+		}
+	}
+	return submitted, nil
+}
+
+// Submit array job (qsub -t)
+// Tasks over limit, before begin time or waiting for dependencies (job IDs
+// in hold, array job IDs in holdArray) are held on the client
+// Returns array job ID
+func SubmitArrayJob(cluster JarviceCluster, req JarviceJobRequest,
+	first, last, step, limit int, begin time.Time, hold, holdArray []int,
+	events, recipients []string) (int, error) {
+
+	// credentials are read from config at submission
+	req.User.Apikey = ""
+	job := ArrayJob{
+		Cluster:    ReadJarviceConfigTarget(),
+		Request:    req,
+		First:      first,
+		Last:       last,
+		Step:       step,
+		Limit:      limit,
+		Tasks:      []ArrayTask{},
+		SubmitTime: time.Now().Unix(),
+		LastCheck:  time.Now().Unix(),
+		Events:     events,
+		Recipients: recipients,
+		Hold:       hold,
+		HoldArray:  holdArray,
+	}
+	if !begin.IsZero() {
+		job.BeginTime = begin.Unix()
+	}
+	for _, task := range TaskRangeIds(first, last, step) {
+		job.Tasks = append(job.Tasks, ArrayTask{Task: task, Waiting: len(holdArray) > 0})
+	}
+	submitted := 0
+	var submitErr error
+	if !begin.After(time.Now()) && len(hold) == 0 && len(holdArray) == 0 {
+		// first tasks are submitted with this command
+		submitted, submitErr = job.submitTasks(cluster)
+		if submitted == 0 && submitErr != nil {
+			return 0, submitErr
+		}
+		if submitErr != nil {
+			logger.WarningPrintf("array job %d: %v", job.Id, submitErr)
+		}
+	}
+	err := UpdateDeferredStore(func(store *DeferredStore) error {
+		if job.Id == 0 {
+			job.Id = store.NextId
+			store.NextId++
+		}
+		for _, task := range job.Tasks {
+			if task.Number > 0 && len(events) > 0 {
+				store.Watches = append(store.Watches, newNotifyWatch(task.Number,
+					req.JobLabel, events, recipients))
+			}
+		}
+		store.ArrayJobs = append(store.ArrayJobs, job)
+		return nil
+	})
+	return job.Id, err
+}
+
+// Array jobs for selected cluster
+func ReadArrayJobs() ([]ArrayJob, error) {
+	store, err := readDeferredStore()
+	if err != nil {
+		return nil, err
+	}
+	target := ReadJarviceConfigTarget()
+	jobs := []ArrayJob{}
+	for _, job := range store.ArrayJobs {
+		if job.Cluster == target {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+// Find array job by ID for selected cluster
+func FindArrayJob(id int) (ArrayJob, bool) {
+	jobs, err := ReadArrayJobs()
+	if err != nil {
+		return ArrayJob{}, false
+	}
+	for _, job := range jobs {
+		if job.Id == id {
+			return job, true
+		}
+	}
+	return ArrayJob{}, false
+}
+
+// Array task of JARVICE job
+type ArrayJobTask struct {
+	Id   int
+	Task int
+}
+
+// Array tasks by JARVICE job number (best effort)
+func ReadArrayJobTasks() map[int]ArrayJobTask {
+	tasks := map[int]ArrayJobTask{}
+	jobs, err := ReadArrayJobs()
+	if err != nil {
+		return tasks
+	}
+	for _, job := range jobs {
+		for _, task := range job.Tasks {
+			if task.Number > 0 {
+				tasks[task.Number] = ArrayJobTask{Id: job.Id, Task: task.Task}
+			}
+		}
+	}
+	return tasks
+}
+
+// Delete tasks of array job (all tasks if tasks is empty)
+// Held tasks are removed; submitted tasks are canceled
+func DeleteArrayTasks(cluster JarviceCluster, id int, tasks []int, force bool) error {
+	selected := map[int]bool{}
+	for _, task := range tasks {
+		selected[task] = true
+	}
+	numbers := []int{}
+	found := false
+	target := ReadJarviceConfigTarget()
+	err := UpdateDeferredStore(func(store *DeferredStore) error {
+		for index := range store.ArrayJobs {
+			job := &store.ArrayJobs[index]
+			if job.Id != id || job.Cluster != target {
+				continue
+			}
+			found = true
+			for index := range job.Tasks {
+				task := &job.Tasks[index]
+				if len(selected) > 0 && !selected[task.Task] {
+					continue
+				}
+				if task.Held() {
+					task.Deleted = true
+				} else if task.Number > 0 && !task.Done {
+					numbers = append(numbers, task.Number)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("job " + strconv.Itoa(id) + " is not an array job")
+	}
+	errs := []string{}
+	for _, result := range CancelJobs(cluster, numbers, force) {
+		if result.Err != nil {
+			errs = append(errs, strconv.Itoa(result.Id)+": "+result.Err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Result of submitting tasks of a claimed array job
+type arrayJobUpdate struct {
+	// running tasks were checked
+	Checked bool
+	Done    map[int]bool
+	// JARVICE job numbers of submitted tasks
+	Numbers map[int]int
+	Err     error
+}
+
+// Check running tasks and submit held tasks of array job copy
+func (job *ArrayJob) update(cluster JarviceCluster) arrayJobUpdate {
+	update := arrayJobUpdate{Done: map[int]bool{}, Numbers: map[int]int{}}
+	if job.Limit > 0 && job.active() >= job.Limit {
+		update.Checked = true
+		for index := range job.Tasks {
+			task := &job.Tasks[index]
+			if task.Number == 0 || task.Done {
+				continue
+			}
+			status, err := GetJobStatus(cluster, task.Number)
+			if err != nil {
+				logger.WarningPrintf("array job %d task %d: %v",
+					job.Id, task.Task, err)
+				continue
+			}
+			task.Done = status.State().Terminal
+			update.Done[task.Task] = task.Done
+		}
+	}
+	held := map[int]bool{}
+	for _, task := range job.Tasks {
+		held[task.Task] = task.Held()
+	}
+	_, update.Err = job.submitTasks(cluster)
+	for _, task := range job.Tasks {
+		if held[task.Task] && task.Number > 0 {
+			update.Numbers[task.Task] = task.Number
+		}
+	}
+	return update
+}
+
+// Submit held array tasks as running tasks finish (qsub -tc)
+// Array jobs are claimed under the store lock and tasks submitted without
+// holding it
+// Used by jarvice agent and every CLI invocation (best effort)
+func ProcessArrayJobs() error {
+	if !fileExist(deferredStorePath()) {
+		return nil
+	}
+	// avoid locking store if no task can be submitted
+	now := time.Now()
+	if store, err := readDeferredStore(); err == nil {
+		ready := false
+		for _, job := range store.ArrayJobs {
+			ready = ready || job.ready(now)
+		}
+		if !ready {
+			return nil
+		}
+	}
+	config, err := ReadJarviceConfig()
+	if err != nil {
+		return err
+	}
+	claimedJobs := []ArrayJob{}
+	err = UpdateDeferredStore(func(store *DeferredStore) error {
+		for index := range store.ArrayJobs {
+			job := &store.ArrayJobs[index]
+			if !job.ready(now) {
+				continue
+			}
+			if _, ok := config[job.Cluster]; !ok {
+				continue
+			}
+			job.ClaimedAt = now.Unix()
+			claim := *job
+			claim.Tasks = append([]ArrayTask{}, job.Tasks...)
+			claimedJobs = append(claimedJobs, claim)
+		}
+		return nil
+	})
+	if err != nil || len(claimedJobs) == 0 {
+		return err
+	}
+	type arrayJobKey struct {
+		Cluster string
+		Id      int
+	}
+	updates := map[arrayJobKey]arrayJobUpdate{}
+	for index := range claimedJobs {
+		job := &claimedJobs[index]
+		update := job.update(config[job.Cluster])
+		if update.Err != nil {
+			logger.WarningPrintf("array job %d: %v", job.Id, update.Err)
+		}
+		updates[arrayJobKey{job.Cluster, job.Id}] = update
+	}
+	// tasks deleted while submitted (qdel) are canceled
+	canceled := map[arrayJobKey][]int{}
+	for key, update := range updates {
+		for _, number := range update.Numbers {
+			canceled[key] = append(canceled[key], number)
+		}
+	}
+	err = UpdateDeferredStore(func(store *DeferredStore) error {
+		now := time.Now()
+		for index := range store.ArrayJobs {
+			job := &store.ArrayJobs[index]
+			key := arrayJobKey{job.Cluster, job.Id}
+			update, ok := updates[key]
+			if !ok {
+				continue
+			}
+			canceled[key] = nil
+			job.ClaimedAt = 0
+			if update.Checked {
+				job.LastCheck = now.Unix()
+			}
+			for index := range job.Tasks {
+				task := &job.Tasks[index]
+				task.Done = task.Done || update.Done[task.Task]
+				number, ok := update.Numbers[task.Task]
+				if !ok {
+					continue
+				}
+				if task.Deleted {
+					canceled[key] = append(canceled[key], number)
+					continue
+				}
+				task.Number = number
+				if len(job.Events) > 0 {
+					watch := newNotifyWatch(number, job.Request.JobLabel,
+						job.Events, job.Recipients)
+					watch.Cluster = job.Cluster
+					store.Watches = append(store.Watches, watch)
+				}
+			}
+			switch {
+			case update.Err == nil:
+				job.Attempts, job.RetryAt = 0, 0
+			case IsTransientError(update.Err):
+				job.Attempts++
+				job.RetryAt = retryTime(job.Attempts, now)
+			default:
+				// task is shown in error state
+				for index := range job.Tasks {
+					if job.Tasks[index].Held() {
+						job.Tasks[index].Error = update.Err.Error()
+						break
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for key, numbers := range canceled {
+		for _, number := range numbers {
+			logger.InfoPrintf("canceling deleted task of array job %d", key.Id)
+			if err := CancelJob(config[key.Cluster], number, false); err != nil {
+				logger.WarningPrintf("array job %d: %v", key.Id, err)
+			}
+		}
+	}
+	return nil
+}
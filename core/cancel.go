@@ -0,0 +1,76 @@
+package jarvice
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// Maximum number of concurrent cancel requests
+const CancelConcurrency = 8
+
+// Result of a job cancel request
+type CancelResult struct {
+	Id  int
+	Err error
+}
+
+// Remove job held on the client
+// Returns JARVICE job number if job was already submitted
+func cancelDeferredJob(id int) (number int, err error) {
+	err = UpdateDeferredStore(func(store *DeferredStore) error {
+		target := ReadJarviceConfigTarget()
+		for index, job := range store.Jobs {
+			if job.Id != id || job.Cluster != target {
+				continue
+			}
+			if !job.Local() {
+				number = job.Number
+				return nil
+			}
+			store.Jobs = append(store.Jobs[:index], store.Jobs[index+1:]...)
+			return nil
+		}
+		return errors.New("Invalid job id specified")
+	})
+	return
+}
+
+// Cancel JARVICE job (shutdown) or job held on the client
+// force terminates the job
+func CancelJob(cluster JarviceCluster, id int, force bool) error {
+	number := id
+	if id >= DeferredJobIdBase {
+		var err error
+		if number, err = cancelDeferredJob(id); err != nil || number == 0 {
+			return err
+		}
+	}
+	urlValues := cluster.GetUrlCreds()
+	urlValues.Add("number", strconv.Itoa(number))
+	api := "shutdown"
+	if force {
+		api = "terminate"
+	}
+	_, err := ApiReq(cluster.Endpoint, api, cluster.Insecure, urlValues)
+	return err
+}
+
+// Cancel jobs in parallel (at most CancelConcurrency requests at once)
+// Results are in the order of ids
+func CancelJobs(cluster JarviceCluster, ids []int, force bool) []CancelResult {
+	results := make([]CancelResult, len(ids))
+	sem := make(chan struct{}, CancelConcurrency)
+	var wg sync.WaitGroup
+	for index, id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(index, id int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[index] = CancelResult{Id: id, Err: CancelJob(cluster, id, force)}
+		}(index, id)
+	}
+	wg.Wait()
+	return results
+}
@@ -8,7 +8,6 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"math"
 	"net"
 	"net/http"
@@ -17,7 +16,6 @@ import (
 	"path"
 	"path/filepath"
 	"reflect"
-	"strconv"
 	"strings"
 	"text/tabwriter"
 
@@ -45,6 +43,59 @@ const (
 
 const JarviceHpcConfigEnv = "JARVICE_HPC_CONFIG"
 
+// Remote shell snippet setting ${jobid} to the JARVICE job number
+// (JARVICE job pods are named jarvice-job-<number>-<suffix>)
+const JobIdEnvConfig = `jobid="${JARVICE_JOB_NUMBER:-$(hostname | sed -n 's/^jarvice-job-\([0-9]*\).*/\1/p')}";` +
+	`jobid="${jobid:-0}";`
+
+// Environment variable marking commands running in a JARVICE-HPC job
+const JobEnvMarker = "JARVICE_HPC_JOB"
+
+// Directory of in-job commands linked to the JARVICE-HPC binary
+const JobShimDir = "/tmp/jarvice-hpc/bin"
+
+// JARVICE job node list (one host per line)
+const JobNodesFile = "/etc/JARVICE/nodes"
+
+// Remote shell snippet exporting JobEnvMarker and linking commands in JobShimDir
+// to the JARVICE-HPC binary (jarvice) when installed in the application container
+// Without the binary, commands missing in the container fail with an explicit
+// error (instead of "command not found")
+func JobShimEnvConfig(commands ...string) string {
+	return JobEnvMarker + `=1; export ` + JobEnvMarker + `;` +
+		`hpcbin="$(command -v jarvice || true)";` +
+		`if mkdir -p ` + JobShimDir + `; then ` +
+		`for com in ` + strings.Join(commands, " ") + `; do ` +
+		`if [ -n "$hpcbin" ]; then ln -sf "$hpcbin" ` + JobShimDir + `/$com; ` +
+		`elif ! command -v $com >/dev/null 2>&1; then ` +
+		`printf '#!/bin/sh\necho "%s: error: JARVICE-HPC client (jarvice) is not installed in the application container" >&2\nexit 127\n' $com > ` +
+		JobShimDir + `/$com && chmod +x ` + JobShimDir + `/$com; fi; done;` +
+		`PATH="` + JobShimDir + `:$PATH"; export PATH; fi;`
+}
+
+// Command is running in a JARVICE-HPC job
+func InJob() bool {
+	return len(os.Getenv(JobEnvMarker)) > 0
+}
+
+// Read JARVICE job nodes (first node runs the job script)
+func ReadJobNodes() ([]string, error) {
+	data, err := ioutil.ReadFile(JobNodesFile)
+	if err != nil {
+		return nil, err
+	}
+	nodes := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if node := strings.TrimSpace(line); len(node) > 0 {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, errors.New("no nodes in " + JobNodesFile)
+	}
+	return nodes, nil
+}
+
 type SgeError struct {
 	Command string
 	Err error
@@ -53,6 +104,48 @@ func (err *SgeError) Error() string {
 	return fmt.Sprintf("%s: %s", err.Command, err.Err.Error())
 }
 
+// Slurm command error, printed to stderr (e.g. "sbatch: error: ...")
+type SlurmError struct {
+	Command string
+	Err     error
+}
+
+func (err *SlurmError) Error() string {
+	return fmt.Sprintf("%s: error: %s", err.Command, err.Err.Error())
+}
+
+// Exit status of command (e.g. exit code of job waited for)
+// Messages are printed by the command
+type ExitError struct {
+	Code int
+}
+
+func (err *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", err.Code)
+}
+
+// Failed JARVICE API request
+// Status is the HTTP status (0 if the request did not complete)
+type ApiError struct {
+	Status int
+	Msg    string
+}
+
+func (err *ApiError) Error() string {
+	return err.Msg
+}
+
+// Request failed on network, server error or throttling and can be retried
+func IsTransientError(err error) bool {
+	var apiErr *ApiError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Status == 0 || apiErr.Status >= 500 ||
+		apiErr.Status == http.StatusRequestTimeout ||
+		apiErr.Status == http.StatusTooManyRequests
+}
+
 // XXX
 // Data for HPC job script
 /*
@@ -66,6 +159,8 @@ type JobScript struct {
 	// Args parsed from SBATCH directive
 	Args   []string `json:"hpc_args"`
 	Script []byte   `json:"hpc_script"`
+	// Args of following heterogeneous job components (#SBATCH hetjob)
+	Hetjob [][]string `json:"hpc_hetjob_args,omitempty"`
 }
 
 type JobSpec struct {
@@ -143,6 +238,7 @@ type HpcReq struct {
 	JobEnvConfig string            `json:"hpc_job_env_config"`
 	JobScript    string            `json:"hpc_job_script"`
 	JobShell     string            `json:"hpc_job_shell"`
+	JobArgs      []string          `json:"hpc_job_args,omitempty"`
 	Queue        string            `json:"hpc_queue"`
 	Umask        int               `json:"hpc_umask"`
 	Envs         map[string]string `json:"hpc_envs,omitempty"`
@@ -170,8 +266,9 @@ type JarviceJobResponse struct {
 }
 
 type JarviceApiSubmission struct {
-	Machine JarviceMachine `json:"machine"`
-	Queue   string         `json:"queue"`
+	Machine     JarviceMachine     `json:"machine"`
+	Queue       string             `json:"queue"`
+	Application JarviceApplication `json:"application"`
 }
 
 type JarviceJob struct {
@@ -192,6 +289,10 @@ type JarviceQueue struct {
 	App            string `json:"app"`
 	DefaultMachine string `json:"machine"`
 	MachineScale   int    `json:"size"`
+	// machine types allowed for queue (info=true)
+	Machines []string `json:"machines,omitempty"`
+	// maximum job walltime (info=true)
+	Walltime string `json:"walltime,omitempty"`
 }
 
 type JarviceQueues = map[string]JarviceQueue
@@ -241,7 +342,7 @@ func JarviceSubmitJob(endpoint string, insecure bool, jobReq JarviceJobRequest)
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return JarviceJobResponse{}, errors.New(submitErrMsg + "http client")
+		return JarviceJobResponse{}, &ApiError{Msg: submitErrMsg + "http client"}
 	}
 	defer resp.Body.Close()
 
@@ -256,7 +357,10 @@ func JarviceSubmitJob(endpoint string, insecure bool, jobReq JarviceJobRequest)
 				errMsg = ": " + msg
 			}
 		}
-		return JarviceJobResponse{}, errors.New(submitErrMsg + http.StatusText(resp.StatusCode) + errMsg)
+		return JarviceJobResponse{}, &ApiError{
+			Status: resp.StatusCode,
+			Msg:    submitErrMsg + http.StatusText(resp.StatusCode) + errMsg,
+		}
 	}
 
 	var jarviceResponse JarviceJobResponse
@@ -344,11 +448,11 @@ func ApiReq(endpoint, api string, insecure bool,
 	logger.DebugObj("HTTP raw request", sanitizeApikey(u))
 	setSecurePolicy(insecure)
 	if resp, err := http.Get(u.String()); err != nil {
-		return nil, err
+		return nil, &ApiError{Msg: err.Error()}
 	} else {
 		defer resp.Body.Close()
 		if body, err := ioutil.ReadAll(resp.Body); err != nil {
-			return nil, errors.New("HTTP IO error")
+			return nil, &ApiError{Msg: "HTTP IO error"}
 		} else {
 			if resp.StatusCode != http.StatusOK {
 				logger.WarningPrintf("HTTP requests failed: %v", resp.Status)
@@ -359,7 +463,10 @@ func ApiReq(endpoint, api string, insecure bool,
 				if msg, ok := respMap["error"]; ok {
 					errMsg = msg
 				}
-				return nil, errors.New("API req /jarvice/" + api + ": " + errMsg)
+				return nil, &ApiError{
+					Status: resp.StatusCode,
+					Msg:    "API req /jarvice/" + api + ": " + errMsg,
+				}
 			} else {
 				return body, nil
 			}
@@ -514,7 +621,6 @@ func ParseJobScript(directive, filename string) (JobScript, error) {
 	} else {
 		file, err := os.Open(filename)
 		if err != nil {
-			log.Fatal(err)
 			return JobScript{}, err
 		}
 		defer file.Close()
@@ -525,6 +631,7 @@ func ParseJobScript(directive, filename string) (JobScript, error) {
 	var args []string
 	script := []byte{}
 
+	var hetjob [][]string
 	shelled := false
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -544,6 +651,13 @@ func ParseJobScript(directive, filename string) (JobScript, error) {
 					if line[:len(directive)+1] == "#"+directive {
 						// strip off comments
 						flagLine := strings.TrimLeft(strings.Split(line[len(directive)+1:], "#")[0], " ")
+						// heterogeneous job component separator
+						if val := strings.TrimSpace(flagLine); directive == "SBATCH" &&
+							(val == "hetjob" || val == "packjob") {
+							hetjob = append(hetjob, args)
+							args = nil
+							continue
+						}
 						elements := strings.Split(strings.TrimRight(flagLine, " "), " ")
 						// go through elements in line to build args
 						appendArg := false
@@ -580,13 +694,40 @@ func ParseJobScript(directive, filename string) (JobScript, error) {
 		logger.DebugPrintf("HPC job shell: %v", shell)
 		logger.DebugPrintf("HPC job args: %v", args)
 	}
+	if err := scanner.Err(); err != nil {
+		return JobScript{}, err
+	}
+	if len(hetjob) > 0 {
+		hetjob = append(hetjob, args)
+		args = hetjob[0]
+		hetjob = hetjob[1:]
+	}
 	return JobScript{
 		Shell:  shell,
 		Args:   args,
 		Script: script,
+		Hetjob: hetjob,
 	}, nil
 }
 
+// Quote string for use as a single shell word
+func ShellQuote(str string) string {
+	return "'" + strings.ReplaceAll(str, "'", `'\''`) + "'"
+}
+
+// Shell command used to run job script with script arguments
+// The job script path is appended by JARVICE ($0 of the wrapper)
+func JobShellCommand(shell string, args []string) string {
+	if len(args) == 0 {
+		return shell
+	}
+	command := shell + ` "$0"`
+	for _, arg := range args {
+		command += " " + ShellQuote(arg)
+	}
+	return "/bin/sh -c " + ShellQuote(command)
+}
+
 func GetOutboundIP() string {
 	conn, err := net.Dial("udp", "8.8.8.8:80")
 	// best effort
@@ -627,47 +768,35 @@ func PreprocessArgs(args []string) ([]string, error) {
 	// strip path for arg 0
 	pArgs[0] = filepath.Base(args[0])
 	for index, val := range pArgs {
-		if strings.HasPrefix(val, "-") && len(val[1:]) > 1 && val[1] != '-' {
+		// arguments after -- belong to the command (srun, salloc)
+		if val == "--" {
+			break
+		}
+		// short option with attached number (e.g. srun -n1) is kept
+		if strings.HasPrefix(val, "-") && len(val[1:]) > 1 && val[1] != '-' &&
+			(val[2] < '0' || val[2] > '9') {
 			pArgs[index] = "-" + val
 		}
 	}
 	switch pArgs[0] {
 	case "qsub", JobScriptArg:
-		fail := false
-		// preprocess -pe <pe-name> <pe-int>
-		// remove <pe-name>
-		for index, val := range pArgs {
-			if val == "-pe" || val == "--pe" {
-				if len(pArgs) > index+1 {
-					if test := strings.Split(pArgs[index+1], " "); len(test) == 2 {
-						if _, check := strconv.ParseInt(test[1], 10, 64); check != nil {
-							if len(pArgs) > index+2 {
-								// -pe <pe-name> <pe-int>
-								pArgs = append(pArgs[:index+1], pArgs[index+2:]...)
-							} else {
-								// missing <pe-int>
-								fail = true
-							}
-						} else {
-							// index+1 contains a string with int (e.g. "hpc 2")
-							pArgs = append(pArgs[:index+1],
-								append([]string{test[1]},
-									pArgs[index+2:]...)...)
-						}
-					} else if len(pArgs) > index+2 {
-						// -pe <pe-name> <pe-int>
-						pArgs = append(pArgs[:index+1], pArgs[index+2:]...)
-					} else {
-						fail = true
-					}
-				} else {
-					fail = true
-				}
-				if fail {
-					return nil, errors.New("unable to preprocess qsub parallel environment\n" +
-						"-pe <pe-name> <int>")
-				}
+		// preprocess -pe <pe-name> <slots>
+		// into a single value "<pe-name> <slots>"
+		for index := 0; index < len(pArgs); index++ {
+			if pArgs[index] != "-pe" && pArgs[index] != "--pe" {
+				continue
+			}
+			if len(pArgs) > index+1 && len(strings.Fields(pArgs[index+1])) == 2 {
+				// index+1 contains both values (e.g. "hpc 2")
+				continue
+			}
+			if len(pArgs) <= index+2 {
+				return nil, errors.New("unable to preprocess qsub parallel environment\n" +
+					"-pe <pe-name> <slots>")
 			}
+			pArgs = append(pArgs[:index+1],
+				append([]string{pArgs[index+1] + " " + pArgs[index+2]},
+					pArgs[index+3:]...)...)
 		}
 	default:
 		// do nothing
@@ -731,7 +860,7 @@ func ParseJobFlags(data interface{}, parser *flags.Parser,
 						case reflect.Slice:
 							switch o := optionValue.(type) {
 							case []string:
-								reflect.Copy(f, reflect.ValueOf(o))
+								f.Set(reflect.ValueOf(append([]string{}, o...)))
 							}
 						default:
 						}
@@ -0,0 +1,437 @@
+package jarvice
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	logger "jarvice.io/jarvice-hpc/logger"
+)
+
+const (
+	JarviceHpcDeferredFilename = "deferred.json"
+	// Local job IDs are kept apart from JARVICE job numbers
+	DeferredJobIdBase = 1000000000
+	// Submitted jobs are kept to resolve local job IDs
+	DeferredJobRetention = 7 * 24 * time.Hour
+	// Locks not refreshed by their owner are stale
+	DeferredLockTimeout = time.Minute
+	// Jobs claimed for submission by a command that did not record the
+	// result are submitted again
+	DeferredClaimTimeout = 10 * time.Minute
+	// Maximum delay between retries of failed submissions
+	DeferredRetryMax = time.Hour
+)
+
+// Job request held on the client until it can be submitted to JARVICE
+type DeferredJob struct {
+	Id         int               `json:"id"`
+	Cluster    string            `json:"cluster"`
+	Request    JarviceJobRequest `json:"request"`
+	SubmitTime int64             `json:"submit_time"`
+	BeginTime  int64             `json:"begin_time,omitempty"`
+	// held by user (scontrol hold)
+	Held bool `json:"held,omitempty"`
+	// job IDs of dependencies not finished yet (qsub -hold_jid)
+	Hold []int `json:"hold,omitempty"`
+	// JARVICE job number once submitted
+	Number     int    `json:"number,omitempty"`
+	Error      string `json:"error,omitempty"`
+	ReleasedAt int64  `json:"released_at,omitempty"`
+	// claimed for submission (submitted outside of the store lock)
+	ClaimedAt int64 `json:"claimed_at,omitempty"`
+	// failed submissions (transient errors are retried)
+	Attempts int   `json:"attempts,omitempty"`
+	RetryAt  int64 `json:"retry_at,omitempty"`
+}
+
+type DeferredStore struct {
+	NextId int           `json:"next_id"`
+	Jobs   []DeferredJob `json:"jobs"`
+	// heterogeneous jobs submitted to JARVICE
+	HetJobs []HetJob `json:"het_jobs,omitempty"`
+	// submitted jobs watched for notifications
+	Watches []NotifyWatch `json:"watches,omitempty"`
+	// array jobs (tasks held on the client and submitted tasks)
+	ArrayJobs []ArrayJob `json:"array_jobs,omitempty"`
+	// last check of job dependencies
+	HoldCheck int64 `json:"hold_check,omitempty"`
+}
+
+// Job is still held on the client
+func (job DeferredJob) Pending() bool {
+	return job.Number == 0 && len(job.Error) == 0
+}
+
+// Job was not submitted to JARVICE yet (pending or failed)
+func (job DeferredJob) Local() bool {
+	return job.Number == 0
+}
+
+// Pending reason shown by job status commands
+func (job DeferredJob) Reason() string {
+	if len(job.Error) > 0 {
+		return "SubmitFailed"
+	}
+	if job.Held {
+		return "JobHeldUser"
+	}
+	if len(job.Hold) > 0 {
+		return "Dependency"
+	}
+	if job.BeginTime > time.Now().Unix() {
+		return "BeginTime"
+	}
+	return "None"
+}
+
+// Job can be submitted to JARVICE
+func (job DeferredJob) Ready(now time.Time) bool {
+	return job.Pending() && !job.Held && len(job.Hold) == 0 &&
+		job.BeginTime <= now.Unix() && job.RetryAt <= now.Unix() &&
+		!claimed(job.ClaimedAt, now)
+}
+
+// Claim of another command is still valid
+func claimed(claimedAt int64, now time.Time) bool {
+	return claimedAt > 0 && now.Sub(time.Unix(claimedAt, 0)) < DeferredClaimTimeout
+}
+
+// Time of next submission after failed attempts (exponential backoff)
+func retryTime(attempts int, now time.Time) int64 {
+	delay := DeferredRetryMax
+	if attempts < 8 {
+		delay = time.Duration(1<<uint(attempts)) * 30 * time.Second
+	}
+	if delay > DeferredRetryMax {
+		delay = DeferredRetryMax
+	}
+	return now.Add(delay).Unix()
+}
+
+func deferredStorePath() string {
+	return path.Dir(getJarviceConfigPath()) + "/" + JarviceHpcDeferredFilename
+}
+
+// Lock owner (hostname pid) of deferred store lock file
+func lockOwner() string {
+	hostname, _ := os.Hostname()
+	return hostname + " " + strconv.Itoa(os.Getpid())
+}
+
+// Lock is stale if its owner process on this host is gone, or if it was not
+// refreshed (owner on another host or hung)
+func staleLock(lockFile string) bool {
+	info, err := os.Stat(lockFile)
+	if err != nil {
+		return false
+	}
+	hostname, _ := os.Hostname()
+	if data, err := ioutil.ReadFile(lockFile); err == nil {
+		owner := strings.Fields(string(data))
+		if len(owner) == 2 && owner[0] == hostname {
+			if pid, err := strconv.Atoi(owner[1]); err == nil {
+				return syscall.Kill(pid, 0) == syscall.ESRCH
+			}
+		}
+	}
+	return time.Since(info.ModTime()) > DeferredLockTimeout
+}
+
+func lockDeferredStore() (unlock func(), err error) {
+	lockFile := deferredStorePath() + ".lock"
+	for retry := 0; retry < 100; retry++ {
+		if f, lerr := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY,
+			JarviceHpcConfigFilePerms); lerr == nil {
+			f.WriteString(lockOwner())
+			f.Close()
+			// refresh lock while held
+			done := make(chan struct{})
+			go func() {
+				ticker := time.NewTicker(DeferredLockTimeout / 4)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-done:
+						return
+					case now := <-ticker.C:
+						os.Chtimes(lockFile, now, now)
+					}
+				}
+			}()
+			return func() {
+				close(done)
+				os.Remove(lockFile)
+			}, nil
+		}
+		// remove stale lock left by interrupted command
+		if staleLock(lockFile) {
+			logger.WarningPrintf("removing stale lock %s", lockFile)
+			os.Remove(lockFile)
+			continue
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil, errors.New("deferred store is locked")
+}
+
+func readDeferredStore() (DeferredStore, error) {
+	store := DeferredStore{NextId: DeferredJobIdBase}
+	filename := deferredStorePath()
+	if !fileExist(filename) {
+		return store, nil
+	}
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return store, err
+	}
+	if err := json.Unmarshal(bytes, &store); err != nil {
+		return store, errors.New("invalid deferred store")
+	}
+	if store.NextId < DeferredJobIdBase {
+		store.NextId = DeferredJobIdBase
+	}
+	return store, nil
+}
+
+func writeDeferredStore(store DeferredStore) error {
+	// drop submitted jobs past retention
+	now := time.Now()
+	jobs := []DeferredJob{}
+	for _, job := range store.Jobs {
+		if !job.Pending() && job.ReleasedAt > 0 &&
+			now.Sub(time.Unix(job.ReleasedAt, 0)) > DeferredJobRetention {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	store.Jobs = jobs
+	hetJobs := []HetJob{}
+	for _, hetJob := range store.HetJobs {
+		if now.Sub(time.Unix(hetJob.SubmitTime, 0)) <= DeferredJobRetention {
+			hetJobs = append(hetJobs, hetJob)
+		}
+	}
+	store.HetJobs = hetJobs
+	watches := []NotifyWatch{}
+	for _, watch := range store.Watches {
+		if now.Sub(time.Unix(watch.SubmitTime, 0)) <= DeferredJobRetention {
+			watches = append(watches, watch)
+		}
+	}
+	store.Watches = watches
+	arrayJobs := []ArrayJob{}
+	for _, job := range store.ArrayJobs {
+		held := false
+		for _, task := range job.Tasks {
+			held = held || task.Held()
+		}
+		if held || now.Sub(time.Unix(job.SubmitTime, 0)) <= DeferredJobRetention {
+			arrayJobs = append(arrayJobs, job)
+		}
+	}
+	store.ArrayJobs = arrayJobs
+	file, err := json.MarshalIndent(store, "", "	")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(deferredStorePath(), file, JarviceHpcConfigFilePerms)
+}
+
+// Locked read-modify-write of the deferred store
+func UpdateDeferredStore(update func(store *DeferredStore) error) error {
+	unlock, err := lockDeferredStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	store, err := readDeferredStore()
+	if err != nil {
+		return err
+	}
+	if err := update(&store); err != nil {
+		return err
+	}
+	return writeDeferredStore(store)
+}
+
+// Hold job request on the client until begin time and until dependencies
+// (job IDs) finish
+// Returns local job ID
+func DeferJob(req JarviceJobRequest, begin time.Time, hold ...int) (id int, err error) {
+	// credentials are read from config at submission
+	req.User.Apikey = ""
+	if begin.IsZero() {
+		begin = time.Now()
+	}
+	err = UpdateDeferredStore(func(store *DeferredStore) error {
+		id = store.NextId
+		store.NextId++
+		store.Jobs = append(store.Jobs, DeferredJob{
+			Id:         id,
+			Cluster:    ReadJarviceConfigTarget(),
+			Request:    req,
+			SubmitTime: time.Now().Unix(),
+			BeginTime:  begin.Unix(),
+			Hold:       hold,
+		})
+		return nil
+	})
+	return
+}
+
+// Locked update of a deferred job for selected cluster
+func UpdateDeferredJob(id int, update func(job *DeferredJob) error) error {
+	target := ReadJarviceConfigTarget()
+	return UpdateDeferredStore(func(store *DeferredStore) error {
+		for index := range store.Jobs {
+			if store.Jobs[index].Id == id && store.Jobs[index].Cluster == target {
+				return update(&store.Jobs[index])
+			}
+		}
+		return errors.New("Invalid job id specified")
+	})
+}
+
+// Deferred jobs for selected cluster (including submitted jobs)
+func ReadDeferredJobs() ([]DeferredJob, error) {
+	store, err := readDeferredStore()
+	if err != nil {
+		return nil, err
+	}
+	target := ReadJarviceConfigTarget()
+	jobs := []DeferredJob{}
+	for _, job := range store.Jobs {
+		if job.Cluster == target {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+// JARVICE job number of job ID
+// Local job IDs of jobs submitted to JARVICE resolve to their job number
+func ResolveJobId(id int) int {
+	if id < DeferredJobIdBase {
+		return id
+	}
+	jobs, err := ReadDeferredJobs()
+	if err != nil {
+		return id
+	}
+	for _, job := range jobs {
+		if job.Id == id && !job.Local() {
+			return job.Number
+		}
+	}
+	return id
+}
+
+// Submit deferred jobs that are ready to JARVICE
+// Jobs are claimed under the store lock and submitted without holding it
+// Transient errors are retried with backoff, jobs rejected by JARVICE are
+// left in error state
+// Used by jarvice agent and every CLI invocation (best effort)
+func ProcessDeferredJobs() error {
+	if !fileExist(deferredStorePath()) {
+		return nil
+	}
+	if err := processHolds(); err != nil {
+		logger.WarningPrintf("job dependencies: %v", err)
+	}
+	// avoid locking store if no job is ready
+	if store, err := readDeferredStore(); err == nil {
+		ready := false
+		for _, job := range store.Jobs {
+			ready = ready || job.Ready(time.Now())
+		}
+		if !ready {
+			return nil
+		}
+	}
+	config, err := ReadJarviceConfig()
+	if err != nil {
+		return err
+	}
+	claimedJobs := []DeferredJob{}
+	err = UpdateDeferredStore(func(store *DeferredStore) error {
+		now := time.Now()
+		for index := range store.Jobs {
+			job := &store.Jobs[index]
+			if !job.Ready(now) {
+				continue
+			}
+			if _, ok := config[job.Cluster]; !ok {
+				job.Error = "cluster " + job.Cluster + " not found"
+				job.ReleasedAt = now.Unix()
+				continue
+			}
+			job.ClaimedAt = now.Unix()
+			claimedJobs = append(claimedJobs, *job)
+		}
+		return nil
+	})
+	if err != nil || len(claimedJobs) == 0 {
+		return err
+	}
+	numbers := map[int]int{}
+	errs := map[int]error{}
+	for _, job := range claimedJobs {
+		cluster := config[job.Cluster]
+		req := job.Request
+		req.User = cluster.Creds
+		logger.InfoPrintf("submitting deferred job %d", job.Id)
+		resp, err := JarviceSubmitJob(cluster.Endpoint, cluster.Insecure, req)
+		if err != nil {
+			logger.WarningPrintf("deferred job %d: %v", job.Id, err)
+			errs[job.Id] = err
+			continue
+		}
+		numbers[job.Id] = resp.Number
+	}
+	recorded := map[int]bool{}
+	err = UpdateDeferredStore(func(store *DeferredStore) error {
+		now := time.Now()
+		for index := range store.Jobs {
+			job := &store.Jobs[index]
+			number, submitted := numbers[job.Id]
+			err, failed := errs[job.Id]
+			if !submitted && !failed {
+				continue
+			}
+			recorded[job.Id] = true
+			job.ClaimedAt = 0
+			switch {
+			case submitted:
+				job.Number = number
+				job.ReleasedAt = now.Unix()
+			case IsTransientError(err):
+				job.Attempts++
+				job.RetryAt = retryTime(job.Attempts, now)
+			default:
+				job.Error = err.Error()
+				job.ReleasedAt = now.Unix()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// jobs removed while submitted (scancel, qdel) are canceled
+	for _, job := range claimedJobs {
+		if number := numbers[job.Id]; number > 0 && !recorded[job.Id] {
+			logger.InfoPrintf("canceling deleted deferred job %d", job.Id)
+			if err := CancelJob(config[job.Cluster], number, false); err != nil {
+				logger.WarningPrintf("deferred job %d: %v", job.Id, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package jarvice
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResolveJobId(t *testing.T) {
+	config := filepath.Join(t.TempDir(), JarviceHpcConfigFilename)
+	if err := ioutil.WriteFile(config, []byte(`{}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(JarviceHpcConfigEnv, config)
+	t.Setenv("JXE_CLUSTER", "")
+	pending, err := DeferJob(JarviceJobRequest{}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	submitted, err := DeferJob(JarviceJobRequest{}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateDeferredJob(submitted, func(job *DeferredJob) error {
+		job.Number = 42
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[int]int{
+		7:                      7,
+		pending:                pending,
+		submitted:              42,
+		DeferredJobIdBase + 99: DeferredJobIdBase + 99,
+	} {
+		if got := ResolveJobId(id); got != want {
+			t.Errorf("%d: got %d, want %d", id, got, want)
+		}
+	}
+}
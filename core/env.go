@@ -0,0 +1,74 @@
+package jarvice
+
+import (
+	"strings"
+)
+
+// Environment variables of the submit host never exported to a job
+// (site filter)
+var JarviceHpcEnvBlacklist = map[string]struct{}{
+	"PATH":                 struct{}{},
+	"USER":                 struct{}{},
+	"HOME":                 struct{}{},
+	"EDITOR":               struct{}{},
+	"UID":                  struct{}{},
+	"TERM":                 struct{}{},
+	"SHELL":                struct{}{},
+	"HOSTNAME":             struct{}{},
+	"GLAD":                 struct{}{},
+	"JARVICE_HEALTH_PORT":  struct{}{},
+	"JARVICE_HPC_LOGLEVEL": struct{}{},
+	"JARVICE_ID_GID":       struct{}{},
+	"JARVICE_ID_GROUP":     struct{}{},
+	"JARVICE_ID_UID":       struct{}{},
+	"JARVICE_ID_USER":      struct{}{},
+	"JARVICE_INGRESSPATH":  struct{}{},
+	"JARVICE_JOBTOKEN":     struct{}{},
+	"JARVICE_MPI_CMA":      struct{}{},
+	"JARVICE_MPI_PROVIDER": struct{}{},
+	"JARVICE_TOOLS":        struct{}{},
+	"JARVICE_TOOLS_BIN":    struct{}{},
+	"JARVICE_VAULT_NAME":   struct{}{},
+	"JOB_LABEL":            struct{}{},
+	"JOB_NAME":             struct{}{},
+	"JOB_PRIVATEIP":        struct{}{},
+	"JOB_PUBLICIP":         struct{}{},
+	"MODULEPATH":           struct{}{},
+	"MODULESHOME":          struct{}{},
+}
+
+// Check if environment variable passes the site filter
+func ExportableEnv(name string) bool {
+	if _, ok := JarviceHpcEnvBlacklist[name]; ok {
+		return false
+	}
+	return !strings.Contains(name, "BASH_FUNC") &&
+		!strings.Contains(name, "KUBERNETES_")
+}
+
+// Split NAME=value environment entry
+func SplitEnv(env string) (name, value string, ok bool) {
+	parts := strings.SplitN(env, "=", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// Environment allowed by the site filter
+// Variables listed in allow bypass the blacklist
+func FilterEnvironment(environ []string, allow ...string) map[string]string {
+	allowed := map[string]struct{}{}
+	for _, name := range allow {
+		allowed[name] = struct{}{}
+	}
+	envs := map[string]string{}
+	for _, env := range environ {
+		if name, value, ok := SplitEnv(env); ok {
+			if _, ok := allowed[name]; ok || ExportableEnv(name) {
+				envs[name] = value
+			}
+		}
+	}
+	return envs
+}
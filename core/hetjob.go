@@ -0,0 +1,88 @@
+package jarvice
+
+import (
+	"strconv"
+	"time"
+)
+
+// Heterogeneous job: JARVICE jobs submitted together as one job
+// Components are shown as <leader>+<offset> (e.g. 1234+1)
+type HetJob struct {
+	Cluster string `json:"cluster"`
+	// JARVICE job numbers in component order (component 0 is the leader)
+	Numbers    []int `json:"numbers"`
+	SubmitTime int64 `json:"submit_time"`
+}
+
+// Component of a heterogeneous job
+type HetJobComponent struct {
+	Leader int
+	Offset int
+	Size   int
+}
+
+// Job ID of component (<leader>+<offset>)
+func (component HetJobComponent) Id() string {
+	return strconv.Itoa(component.Leader) + "+" + strconv.Itoa(component.Offset)
+}
+
+// Record JARVICE jobs of a heterogeneous job (numbers in component order)
+func AddHetJob(numbers []int) error {
+	return UpdateDeferredStore(func(store *DeferredStore) error {
+		store.HetJobs = append(store.HetJobs, HetJob{
+			Cluster:    ReadJarviceConfigTarget(),
+			Numbers:    numbers,
+			SubmitTime: time.Now().Unix(),
+		})
+		return nil
+	})
+}
+
+// Heterogeneous jobs for selected cluster
+func ReadHetJobs() ([]HetJob, error) {
+	store, err := readDeferredStore()
+	if err != nil {
+		return nil, err
+	}
+	target := ReadJarviceConfigTarget()
+	hetJobs := []HetJob{}
+	for _, hetJob := range store.HetJobs {
+		if hetJob.Cluster == target && len(hetJob.Numbers) > 0 {
+			hetJobs = append(hetJobs, hetJob)
+		}
+	}
+	return hetJobs, nil
+}
+
+// Heterogeneous job components by JARVICE job number (best effort)
+func ReadHetJobComponents() map[int]HetJobComponent {
+	components := map[int]HetJobComponent{}
+	hetJobs, err := ReadHetJobs()
+	if err != nil {
+		return components
+	}
+	for _, hetJob := range hetJobs {
+		for offset, number := range hetJob.Numbers {
+			components[number] = HetJobComponent{
+				Leader: hetJob.Numbers[0],
+				Offset: offset,
+				Size:   len(hetJob.Numbers),
+			}
+		}
+	}
+	return components
+}
+
+// JARVICE job numbers of heterogeneous job with leader number
+func FindHetJob(leader int) ([]int, bool) {
+	hetJobs, err := ReadHetJobs()
+	if err != nil {
+		return nil, false
+	}
+	for _, hetJob := range hetJobs {
+		if hetJob.Numbers[0] == leader {
+			return hetJob.Numbers, true
+		}
+	}
+	return nil, false
+}
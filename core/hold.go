@@ -0,0 +1,344 @@
+package jarvice
+
+import (
+	"errors"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	logger "jarvice.io/jarvice-hpc/logger"
+)
+
+// Minimum time between checks of job dependencies (qsub -hold_jid)
+const HoldCheckInterval = 15 * time.Second
+
+// Resolve job dependency list (qsub -hold_jid) to job IDs
+// Entries are job IDs, job names or job name patterns (wildcards), matched
+// against jobs not finished at submission (finished jobs are ignored)
+// Array tasks resolve to their array job ID
+func ResolveHoldJobs(cluster JarviceCluster, lists []string) ([]int, error) {
+	entries := []string{}
+	for _, list := range lists {
+		for _, entry := range strings.Split(list, ",") {
+			if entry = strings.TrimSpace(entry); len(entry) > 0 {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	jobs, _, err := ReadJarviceJobs(cluster, false)
+	if err != nil {
+		return nil, err
+	}
+	store, err := readDeferredStore()
+	if err != nil {
+		return nil, err
+	}
+	target := ReadJarviceConfigTarget()
+	arrayTasks := ReadArrayJobTasks()
+	// job IDs by job name
+	names := map[int]string{}
+	for number, job := range jobs {
+		if job.State().Terminal {
+			continue
+		}
+		if task, ok := arrayTasks[number]; ok {
+			number = task.Id
+		}
+		names[number] = job.Label
+	}
+	for _, job := range store.Jobs {
+		if job.Cluster == target && job.Pending() {
+			names[job.Id] = job.Request.JobLabel
+		}
+	}
+	for _, job := range store.ArrayJobs {
+		if job.Cluster == target {
+			names[job.Id] = job.Request.JobLabel
+		}
+	}
+	ids := []int{}
+	seen := map[int]bool{}
+	add := func(id int) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, entry := range entries {
+		if id, err := strconv.Atoi(entry); err == nil {
+			if task, ok := arrayTasks[id]; ok {
+				id = task.Id
+			}
+			if _, ok := names[id]; ok {
+				add(id)
+			}
+			continue
+		}
+		if _, err := path.Match(entry, ""); err != nil {
+			return nil, errors.New("invalid job name pattern: " + entry)
+		}
+		for id, name := range names {
+			if ok, _ := path.Match(entry, name); ok {
+				add(id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// Resolve array job dependency list (qsub -hold_jid_ad) to array job IDs
+// Array jobs must have the same number of tasks as the dependent job
+func ResolveHoldArrayJobs(cluster JarviceCluster, lists []string, tasks int) ([]int, error) {
+	ids, err := ResolveHoldJobs(cluster, lists)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		job, ok := FindArrayJob(id)
+		if !ok {
+			return nil, errors.New("job " + strconv.Itoa(id) + " is not an array job")
+		}
+		if len(job.Tasks) != tasks {
+			return nil, errors.New("array job " + strconv.Itoa(id) +
+				" has a different number of tasks")
+		}
+	}
+	return ids, nil
+}
+
+// Dependency state of a job or array task
+type holdState int
+
+const (
+	holdWaiting holdState = iota
+	holdDone
+	holdDeleted
+)
+
+// Job states used to release held jobs
+type holdJobs struct {
+	jobs  JarviceJobs
+	store *DeferredStore
+}
+
+// State of JARVICE job (finished jobs no longer listed are done)
+// Jobs submitted after the jobs were read are not finished
+func (holds holdJobs) numberState(number int) holdState {
+	job, ok := holds.jobs[number]
+	if !ok {
+		for latest := range holds.jobs {
+			if latest >= number {
+				return holdDone
+			}
+		}
+		return holdWaiting
+	}
+	if job.Status == JobStatusCanceled || job.Status == JobStatusTerminated {
+		return holdDeleted
+	}
+	if job.State().Terminal {
+		return holdDone
+	}
+	return holdWaiting
+}
+
+// State of array task
+func (holds holdJobs) taskState(task ArrayTask) holdState {
+	if task.Deleted || (task.Number == 0 && len(task.Error) > 0) {
+		return holdDeleted
+	}
+	if task.Number == 0 {
+		return holdWaiting
+	}
+	return holds.numberState(task.Number)
+}
+
+// State of job ID (JARVICE job, job held on the client or array job)
+func (holds holdJobs) jobState(cluster string, id int) holdState {
+	for _, job := range holds.store.ArrayJobs {
+		if job.Id != id || job.Cluster != cluster {
+			continue
+		}
+		state := holdDone
+		for _, task := range job.Tasks {
+			switch holds.taskState(task) {
+			case holdDeleted:
+				return holdDeleted
+			case holdWaiting:
+				state = holdWaiting
+			}
+		}
+		return state
+	}
+	if id >= DeferredJobIdBase {
+		for _, job := range holds.store.Jobs {
+			if job.Id != id || job.Cluster != cluster {
+				continue
+			}
+			if len(job.Error) > 0 {
+				return holdDeleted
+			}
+			if job.Number == 0 {
+				return holdWaiting
+			}
+			return holds.numberState(job.Number)
+		}
+		// removed before submission
+		return holdDeleted
+	}
+	return holds.numberState(id)
+}
+
+// State of task of array job with same index (qsub -hold_jid_ad)
+func (holds holdJobs) arrayTaskState(cluster string, id, index int) holdState {
+	for _, job := range holds.store.ArrayJobs {
+		if job.Id == id && job.Cluster == cluster {
+			if index >= len(job.Tasks) {
+				return holdDone
+			}
+			return holds.taskState(job.Tasks[index])
+		}
+	}
+	return holdDeleted
+}
+
+// Jobs or array tasks waiting for dependencies
+func holdPending(store DeferredStore) bool {
+	for _, job := range store.Jobs {
+		if job.Pending() && len(job.Hold) > 0 {
+			return true
+		}
+	}
+	for _, job := range store.ArrayJobs {
+		if len(job.Hold) > 0 {
+			return true
+		}
+		for _, task := range job.Tasks {
+			if task.Held() && task.Waiting {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Release jobs and array tasks whose dependencies finished
+// Jobs are left in error state if a dependency was deleted
+func processHolds() error {
+	store, err := readDeferredStore()
+	if err != nil || !holdPending(store) ||
+		time.Since(time.Unix(store.HoldCheck, 0)) < HoldCheckInterval {
+		return err
+	}
+	config, err := ReadJarviceConfig()
+	if err != nil {
+		return err
+	}
+	// JARVICE jobs of each cluster with held jobs (read without holding the
+	// store lock)
+	clusters := map[string]bool{}
+	for _, job := range store.Jobs {
+		clusters[job.Cluster] = clusters[job.Cluster] || (job.Pending() && len(job.Hold) > 0)
+	}
+	for _, job := range store.ArrayJobs {
+		clusters[job.Cluster] = true
+	}
+	clusterJobs := map[string]JarviceJobs{}
+	for name, held := range clusters {
+		if !held {
+			continue
+		}
+		cluster, ok := config[name]
+		if !ok {
+			logger.WarningPrintf("job dependencies: cluster %s not found", name)
+			continue
+		}
+		jobs, _, err := ReadAllJarviceJobs(cluster)
+		if err != nil {
+			logger.WarningPrintf("job dependencies: %v", err)
+			continue
+		}
+		clusterJobs[name] = jobs
+	}
+	readJobs := func(name string) (JarviceJobs, error) {
+		if jobs, ok := clusterJobs[name]; ok {
+			return jobs, nil
+		}
+		return nil, errors.New("jobs of cluster " + name + " not read")
+	}
+	return UpdateDeferredStore(func(store *DeferredStore) error {
+		store.HoldCheck = time.Now().Unix()
+		// release held job if all dependencies are done
+		release := func(cluster string, hold []int) ([]int, string) {
+			jobs, err := readJobs(cluster)
+			if err != nil {
+				logger.WarningPrintf("job dependencies: %v", err)
+				return hold, ""
+			}
+			holds := holdJobs{jobs: jobs, store: store}
+			waiting := []int{}
+			for _, id := range hold {
+				switch holds.jobState(cluster, id) {
+				case holdDeleted:
+					return hold, "dependency " + strconv.Itoa(id) + " was deleted"
+				case holdWaiting:
+					waiting = append(waiting, id)
+				}
+			}
+			return waiting, ""
+		}
+		for index := range store.Jobs {
+			job := &store.Jobs[index]
+			if !job.Pending() || len(job.Hold) == 0 {
+				continue
+			}
+			hold, reason := release(job.Cluster, job.Hold)
+			job.Hold = hold
+			if len(reason) > 0 {
+				job.Error = reason
+				job.ReleasedAt = time.Now().Unix()
+			}
+		}
+		for index := range store.ArrayJobs {
+			job := &store.ArrayJobs[index]
+			if len(job.Hold) > 0 {
+				hold, reason := release(job.Cluster, job.Hold)
+				job.Hold = hold
+				if len(reason) > 0 {
+					for index := range job.Tasks {
+						if job.Tasks[index].Held() {
+							job.Tasks[index].Error = reason
+						}
+					}
+					job.Hold = nil
+				}
+			}
+			jobs, err := readJobs(job.Cluster)
+			if err != nil {
+				continue
+			}
+			holds := holdJobs{jobs: jobs, store: store}
+			for index := range job.Tasks {
+				task := &job.Tasks[index]
+				if !task.Held() || !task.Waiting {
+					continue
+				}
+				waiting := false
+				for _, id := range job.HoldArray {
+					switch holds.arrayTaskState(job.Cluster, id, index) {
+					case holdDeleted:
+						task.Error = "dependency " + strconv.Itoa(id) + " was deleted"
+					case holdWaiting:
+						waiting = true
+					}
+				}
+				task.Waiting = waiting && len(task.Error) == 0
+			}
+		}
+		return nil
+	})
+}
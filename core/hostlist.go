@@ -0,0 +1,194 @@
+package jarvice
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Split hostlist at commas outside of brackets
+func splitHostlist(list string) ([]string, error) {
+	items := []string{}
+	depth := 0
+	start := 0
+	for index, char := range list {
+		switch char {
+		case '[':
+			depth++
+			if depth > 1 {
+				return nil, errors.New("invalid hostlist: " + list)
+			}
+		case ']':
+			depth--
+			if depth < 0 {
+				return nil, errors.New("invalid hostlist: " + list)
+			}
+		case ',':
+			if depth == 0 {
+				items = append(items, list[start:index])
+				start = index + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, errors.New("invalid hostlist: " + list)
+	}
+	return append(items, list[start:]), nil
+}
+
+// Expand bracket range list (e.g. "1-3,07-09")
+// Zero padding of range bounds is kept
+func expandHostRanges(ranges string) ([]string, error) {
+	values := []string{}
+	for _, val := range strings.Split(ranges, ",") {
+		bounds := strings.SplitN(val, "-", 2)
+		lo, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, errors.New("invalid host range: " + val)
+		}
+		hi := lo
+		if len(bounds) == 2 {
+			if hi, err = strconv.Atoi(bounds[1]); err != nil || hi < lo {
+				return nil, errors.New("invalid host range: " + val)
+			}
+		}
+		width := 0
+		if strings.HasPrefix(bounds[0], "0") {
+			width = len(bounds[0])
+		}
+		for num := lo; num <= hi; num++ {
+			str := strconv.Itoa(num)
+			if len(str) < width {
+				str = strings.Repeat("0", width-len(str)) + str
+			}
+			values = append(values, str)
+		}
+	}
+	return values, nil
+}
+
+// Expand Slurm hostlist (e.g. "node[1-3,5],login")
+func ExpandHostlist(list string) ([]string, error) {
+	items, err := splitHostlist(strings.TrimSpace(list))
+	if err != nil {
+		return nil, err
+	}
+	hosts := []string{}
+	for _, item := range items {
+		if len(item) == 0 {
+			continue
+		}
+		// expand bracket groups from left to right (e.g. "rack[1-2]n[1-3]")
+		names := []string{""}
+		for len(item) > 0 {
+			open := strings.Index(item, "[")
+			if open < 0 {
+				for index := range names {
+					names[index] += item
+				}
+				break
+			}
+			end := strings.Index(item, "]")
+			values, err := expandHostRanges(item[open+1 : end])
+			if err != nil {
+				return nil, err
+			}
+			expanded := []string{}
+			for _, name := range names {
+				for _, val := range values {
+					expanded = append(expanded, name+item[:open]+val)
+				}
+			}
+			names = expanded
+			item = item[end+1:]
+		}
+		hosts = append(hosts, names...)
+	}
+	return hosts, nil
+}
+
+// Host name split into prefix and numeric suffix
+type hostName struct {
+	Prefix string
+	Digits string
+	Num    int
+}
+
+func parseHostName(host string) hostName {
+	index := len(host)
+	for index > 0 && host[index-1] >= '0' && host[index-1] <= '9' {
+		index--
+	}
+	name := hostName{Prefix: host[:index], Digits: host[index:], Num: -1}
+	if len(name.Digits) > 0 {
+		if num, err := strconv.Atoi(name.Digits); err == nil {
+			name.Num = num
+		} else {
+			name.Prefix, name.Digits = host, ""
+		}
+	}
+	return name
+}
+
+// Numeric suffixes can form a range: same width if zero padded
+func hostNameNext(prev, next hostName) bool {
+	if next.Num != prev.Num+1 {
+		return false
+	}
+	padded := strings.HasPrefix(prev.Digits, "0") || strings.HasPrefix(next.Digits, "0")
+	return !padded || len(prev.Digits) == len(next.Digits)
+}
+
+// Compress host names into a Slurm hostlist (e.g. "node[1-3,5],login")
+// Hosts are sorted and duplicates removed
+func CompressHostlist(hosts []string) string {
+	names := []hostName{}
+	seen := map[string]struct{}{}
+	for _, host := range hosts {
+		host = strings.TrimSpace(host)
+		if _, ok := seen[host]; ok || len(host) == 0 {
+			continue
+		}
+		seen[host] = struct{}{}
+		names = append(names, parseHostName(host))
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		if names[i].Prefix != names[j].Prefix {
+			return names[i].Prefix < names[j].Prefix
+		}
+		return names[i].Num < names[j].Num
+	})
+	items := []string{}
+	for index := 0; index < len(names); {
+		name := names[index]
+		if name.Num < 0 {
+			items = append(items, name.Prefix)
+			index++
+			continue
+		}
+		// ranges of hosts with the same prefix
+		ranges := []string{}
+		end := index
+		for end < len(names) && names[end].Prefix == name.Prefix && names[end].Num >= 0 {
+			lo := end
+			for end+1 < len(names) && names[end+1].Prefix == name.Prefix &&
+				hostNameNext(names[end], names[end+1]) {
+				end++
+			}
+			if lo == end {
+				ranges = append(ranges, names[lo].Digits)
+			} else {
+				ranges = append(ranges, names[lo].Digits+"-"+names[end].Digits)
+			}
+			end++
+		}
+		if end-index == 1 {
+			items = append(items, name.Prefix+name.Digits)
+		} else {
+			items = append(items, name.Prefix+"["+strings.Join(ranges, ",")+"]")
+		}
+		index = end
+	}
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,68 @@
+package jarvice
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandHostlist(t *testing.T) {
+	for list, want := range map[string][]string{
+		"node1":                {"node1"},
+		"node[1-3]":            {"node1", "node2", "node3"},
+		"node[1-3,5]":          {"node1", "node2", "node3", "node5"},
+		"node[1,3],login":      {"node1", "node3", "login"},
+		"node[08-11]":          {"node08", "node09", "node10", "node11"},
+		"node[001-002,010]":    {"node001", "node002", "node010"},
+		"rack[1-2]n[1-2]":      {"rack1n1", "rack1n2", "rack2n1", "rack2n2"},
+		"a[1-2],b[3,5],c":      {"a1", "a2", "b3", "b5", "c"},
+		"node[1-2]-ib":         {"node1-ib", "node2-ib"},
+		" node1,,node2 ":       {"node1", "node2"},
+		"jarvice-job-42-[0-1]": {"jarvice-job-42-0", "jarvice-job-42-1"},
+	} {
+		hosts, err := ExpandHostlist(list)
+		if err != nil || !reflect.DeepEqual(hosts, want) {
+			t.Errorf("%q: got %v, %v; want %v", list, hosts, err, want)
+		}
+	}
+	for _, list := range []string{"node[1-3", "node1-3]", "node[[1]]", "node[a-b]",
+		"node[3-1]", "node[]"} {
+		if hosts, err := ExpandHostlist(list); err == nil {
+			t.Errorf("%q: expected error, got %v", list, hosts)
+		}
+	}
+}
+
+func TestCompressHostlist(t *testing.T) {
+	for _, test := range []struct {
+		hosts []string
+		want  string
+	}{
+		{[]string{"node1"}, "node1"},
+		{[]string{"node1", "node2", "node3"}, "node[1-3]"},
+		{[]string{"node3", "node1", "node2", "node5"}, "node[1-3,5]"},
+		{[]string{"node1", "node1", "node2"}, "node[1-2]"},
+		{[]string{"node08", "node09", "node10", "node11"}, "node[08-11]"},
+		{[]string{"node9", "node10"}, "node[9-10]"},
+		{[]string{"node09", "node010"}, "node[09,010]"},
+		{[]string{"login", "node2", "node1"}, "login,node[1-2]"},
+		{[]string{"a1", "b1", "b2"}, "a1,b[1-2]"},
+		{[]string{"node", "node1"}, "node,node1"},
+		{[]string{}, ""},
+	} {
+		if got := CompressHostlist(test.hosts); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.hosts, got, test.want)
+		}
+	}
+}
+
+func TestHostlistRoundTrip(t *testing.T) {
+	for _, list := range []string{"node[1-3,5]", "node[08-11]", "a[1-2],b[3,5],c"} {
+		hosts, err := ExpandHostlist(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := CompressHostlist(hosts); got != list {
+			t.Errorf("%q: got %q", list, got)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package jarvice
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// Read JARVICE jobs (jarvice/jobs) with original job requests
+// (job_api_submission)
+func ReadJarviceJobs(cluster JarviceCluster, completed bool) (JarviceJobs,
+	map[int]JarviceJobRequest, error) {
+
+	urlValues := cluster.GetUrlCreds()
+	if completed {
+		urlValues.Add("completed", "true")
+	}
+	resp, err := ApiReq(cluster.Endpoint, "jobs", cluster.Insecure, urlValues)
+	if err != nil {
+		return nil, nil, err
+	}
+	jobs := JarviceJobs{}
+	if err := json.Unmarshal(resp, &jobs); err != nil {
+		return nil, nil, errors.New("cannot read jobs")
+	}
+	submissions := map[int]struct {
+		Request JarviceJobRequest `json:"job_api_submission"`
+	}{}
+	if err := json.Unmarshal(resp, &submissions); err != nil {
+		return nil, nil, errors.New("cannot read jobs")
+	}
+	requests := map[int]JarviceJobRequest{}
+	for number, submission := range submissions {
+		requests[number] = submission.Request
+	}
+	return jobs, requests, nil
+}
+
+// Read active and completed JARVICE jobs
+func ReadAllJarviceJobs(cluster JarviceCluster) (JarviceJobs,
+	map[int]JarviceJobRequest, error) {
+
+	jobs, requests, err := ReadJarviceJobs(cluster, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	doneJobs, doneRequests, err := ReadJarviceJobs(cluster, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	for number, job := range doneJobs {
+		jobs[number] = job
+		requests[number] = doneRequests[number]
+	}
+	return jobs, requests, nil
+}
+
+// Submit copy of a JARVICE job request with cluster credentials
+func ResubmitJob(cluster JarviceCluster, req JarviceJobRequest) (JarviceJobResponse, error) {
+	req.User = cluster.Creds
+	return JarviceSubmitJob(cluster.Endpoint, cluster.Insecure, req)
+}
+
+// JARVICE job connection information (jarvice/connect)
+type JarviceConnect struct {
+	Address  string `json:"address"`
+	Password string `json:"password"`
+}
+
+// Read JARVICE job status (jarvice/status)
+func GetJobStatus(cluster JarviceCluster, number int) (JarviceJob, error) {
+	urlValues := cluster.GetUrlCreds()
+	urlValues.Add("number", strconv.Itoa(number))
+	resp, err := ApiReq(cluster.Endpoint, "status", cluster.Insecure, urlValues)
+	if err != nil {
+		return JarviceJob{}, err
+	}
+	jobs := JarviceJobs{}
+	if err := json.Unmarshal(resp, &jobs); err != nil {
+		return JarviceJob{}, errors.New("cannot read job status")
+	}
+	job, ok := jobs[number]
+	if !ok {
+		return JarviceJob{}, errors.New("job " + strconv.Itoa(number) + " not found")
+	}
+	return job, nil
+}
+
+// Read JARVICE job connection information (jarvice/connect)
+func GetJobConnect(cluster JarviceCluster, number int) (JarviceConnect, error) {
+	urlValues := cluster.GetUrlCreds()
+	urlValues.Add("number", strconv.Itoa(number))
+	resp, err := ApiReq(cluster.Endpoint, "connect", cluster.Insecure, urlValues)
+	if err != nil {
+		return JarviceConnect{}, err
+	}
+	connect := JarviceConnect{}
+	if err := json.Unmarshal(resp, &connect); err != nil {
+		return JarviceConnect{}, errors.New("cannot read job connection")
+	}
+	return connect, nil
+}
+
+// Read last lines of JARVICE job output (jarvice/tail)
+func TailJob(cluster JarviceCluster, number, lines int) ([]byte, error) {
+	urlValues := cluster.GetUrlCreds()
+	urlValues.Add("number", strconv.Itoa(number))
+	urlValues.Add("lines", strconv.Itoa(lines))
+	return ApiReq(cluster.Endpoint, "tail", cluster.Insecure, urlValues)
+}
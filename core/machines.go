@@ -0,0 +1,175 @@
+package jarvice
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+)
+
+// JARVICE machine definition (jarvice/machines)
+type JarviceMachineInfo struct {
+	Name        string `json:"mc_name"`
+	Description string `json:"mc_description"`
+	Cores       int    `json:"mc_cores"`
+	SlaveCores  int    `json:"mc_slave_cores"`
+	Gpus        int    `json:"mc_gpus"`
+	SlaveGpus   int    `json:"mc_slave_gpus"`
+	Ram         int    `json:"mc_ram"`
+	SlaveRam    int    `json:"mc_slave_ram"`
+	ScaleMin    int    `json:"mc_scale_min"`
+	ScaleMax    int    `json:"mc_scale_max"`
+}
+
+type JarviceMachines = map[string]JarviceMachineInfo
+
+// Resource request used to select a machine type and scale for a queue
+// Memory units are megabytes
+type MachineRequest struct {
+	Nodes        int
+	Tasks        int
+	TasksPerNode int
+	CpusPerTask  int
+	MemPerCpu    int
+	MemPerGpu    int
+	Gpus         int
+}
+
+// Machine type and scale resolved from a MachineRequest
+type MachineSelection struct {
+	Machine      string
+	Nodes        int
+	Tasks        int
+	TasksPerNode int
+	CpusPerTask  int
+	CoresPerNode int
+}
+
+func GetJarviceMachines(cluster JarviceCluster) (JarviceMachines, error) {
+	resp, err := ApiReq(cluster.Endpoint, "machines", cluster.Insecure,
+		cluster.GetUrlCreds())
+	if err != nil {
+		return nil, err
+	}
+	machines := JarviceMachines{}
+	if err := json.Unmarshal(resp, &machines); err != nil {
+		return nil, errors.New("cannot read machines")
+	}
+	return machines, nil
+}
+
+// Machine types available to queue (smallest first)
+// Queue default machine is used if queue does not list machine types
+func QueueMachines(queue JarviceQueue, machines JarviceMachines) []JarviceMachineInfo {
+	names := queue.Machines
+	if len(names) == 0 {
+		names = []string{queue.DefaultMachine}
+	}
+	ret := []JarviceMachineInfo{}
+	for _, name := range names {
+		if machine, ok := machines[name]; ok {
+			ret = append(ret, machine)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].Cores != ret[j].Cores {
+			return ret[i].Cores < ret[j].Cores
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+func ceilDiv(a, b int) int {
+	return int(math.Ceil(float64(a) / float64(b)))
+}
+
+// Select queue machine type and scale that satisfy task geometry
+// Policy: fewest nodes first, then the smallest machine type (e.g. 64 tasks
+// run on one 64 core node rather than on 64 single core nodes)
+func SelectMachine(req MachineRequest, queue JarviceQueue,
+	machines JarviceMachines) (MachineSelection, error) {
+
+	cpusPerTask := 1
+	if req.CpusPerTask > 0 {
+		cpusPerTask = req.CpusPerTask
+	}
+	candidates := QueueMachines(queue, machines)
+	if len(candidates) == 0 {
+		return MachineSelection{}, errors.New("no machine types found for " + queue.Name)
+	}
+	var best MachineSelection
+	found := false
+	for _, machine := range candidates {
+		capacity := machine.Cores / cpusPerTask
+		if capacity < 1 {
+			continue
+		}
+		nodes := req.Nodes
+		tasks := req.Tasks
+		tasksPerNode := req.TasksPerNode
+		if tasksPerNode < 1 {
+			switch {
+			case tasks > 0 && nodes > 0:
+				tasksPerNode = ceilDiv(tasks, nodes)
+			case tasks > 0:
+				tasksPerNode = tasks
+				if tasksPerNode > capacity {
+					tasksPerNode = capacity
+				}
+			default:
+				tasksPerNode = 1
+			}
+		}
+		if tasksPerNode > capacity {
+			continue
+		}
+		if nodes < 1 {
+			nodes = 1
+			if tasks > 0 {
+				nodes = ceilDiv(tasks, tasksPerNode)
+			}
+		}
+		if tasks < 1 {
+			tasks = tasksPerNode * nodes
+		}
+		if tasks > tasksPerNode*nodes {
+			continue
+		}
+		if queue.MachineScale > 0 && nodes > queue.MachineScale {
+			continue
+		}
+		if machine.ScaleMax > 0 && nodes > machine.ScaleMax {
+			continue
+		}
+		gpusPerNode := 0
+		if req.Gpus > 0 {
+			gpusPerNode = ceilDiv(req.Gpus, nodes)
+			if gpusPerNode > machine.Gpus {
+				continue
+			}
+		}
+		memPerNode := tasksPerNode * cpusPerTask * req.MemPerCpu
+		memPerNode += gpusPerNode * req.MemPerGpu
+		if machine.Ram > 0 && memPerNode > machine.Ram*1024 {
+			continue
+		}
+		// candidates are sorted smallest first: a larger machine type
+		// is only selected if it needs fewer nodes
+		if !found || nodes < best.Nodes {
+			best = MachineSelection{
+				Machine:      machine.Name,
+				Nodes:        nodes,
+				Tasks:        tasks,
+				TasksPerNode: tasksPerNode,
+				CpusPerTask:  cpusPerTask,
+				CoresPerNode: tasksPerNode * cpusPerTask,
+			}
+			found = true
+		}
+	}
+	if !found {
+		return MachineSelection{}, errors.New("requested node configuration is not available")
+	}
+	return best, nil
+}
@@ -0,0 +1,295 @@
+package jarvice
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JARVICE does not send job notifications: they are sent by the client
+// through the sinks configured in notify.json (next to config.json)
+const JarviceHpcNotifyFilename = "notify.json"
+
+// Default sendmail binary (used if no sink is configured)
+const NotifySendmailPath = "/usr/sbin/sendmail"
+
+// Job events
+const (
+	NotifyBegin   = "BEGIN"
+	NotifyEnd     = "END"
+	NotifyFail    = "FAIL"
+	NotifyRequeue = "REQUEUE"
+)
+
+// Job notification
+type Notification struct {
+	Event      string   `json:"event"`
+	Cluster    string   `json:"cluster"`
+	Number     int      `json:"number"`
+	Name       string   `json:"name"`
+	Status     string   `json:"status"`
+	ExitCode   int      `json:"exit_code"`
+	Recipients []string `json:"recipients"`
+	// job ID of requeued job (REQUEUE)
+	RequeuedAs int `json:"requeued_as,omitempty"`
+}
+
+func (notification Notification) Subject() string {
+	verb := map[string]string{
+		NotifyBegin:   "Began",
+		NotifyEnd:     "Ended",
+		NotifyFail:    "Failed",
+		NotifyRequeue: "Requeued",
+	}[notification.Event]
+	return fmt.Sprintf("JARVICE Job_id=%d Name=%s %s, Status %s",
+		notification.Number, notification.Name, verb, notification.Status)
+}
+
+func (notification Notification) Body() string {
+	body := fmt.Sprintf("Cluster: %s\nJob ID: %d\nJob name: %s\nEvent: %s\nStatus: %s\n",
+		notification.Cluster, notification.Number, notification.Name,
+		notification.Event, notification.Status)
+	if notification.Event == NotifyEnd || notification.Event == NotifyFail {
+		body += "Exit code: " + strconv.Itoa(notification.ExitCode) + "\n"
+	}
+	if notification.RequeuedAs > 0 {
+		body += "Requeued as job: " + strconv.Itoa(notification.RequeuedAs) + "\n"
+	}
+	return body
+}
+
+// Mail message (RFC 822) of notification
+func (notification Notification) mailMessage(from string) []byte {
+	var b bytes.Buffer
+	if len(from) > 0 {
+		fmt.Fprintf(&b, "From: %s\r\n", from)
+	}
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(notification.Recipients, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", notification.Subject())
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(notification.Body(), "\n", "\r\n"))
+	return b.Bytes()
+}
+
+// Destination of job notifications
+type NotifySink interface {
+	Send(notification Notification) error
+}
+
+// Mail through SMTP server
+type SmtpSink struct {
+	Address  string
+	From     string
+	Username string
+	Password string
+}
+
+func (sink SmtpSink) Send(notification Notification) error {
+	var auth smtp.Auth
+	if len(sink.Username) > 0 {
+		host := strings.Split(sink.Address, ":")[0]
+		auth = smtp.PlainAuth("", sink.Username, sink.Password, host)
+	}
+	return smtp.SendMail(sink.Address, auth, sink.From, notification.Recipients,
+		notification.mailMessage(sink.From))
+}
+
+// Mail through sendmail binary
+type SendmailSink struct {
+	Path string
+	From string
+}
+
+func (sink SendmailSink) Send(notification Notification) error {
+	args := []string{"-t", "-i"}
+	if len(sink.From) > 0 {
+		args = append(args, "-f", sink.From)
+	}
+	cmd := exec.Command(sink.Path, args...)
+	cmd.Stdin = bytes.NewReader(notification.mailMessage(sink.From))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v %s", sink.Path, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// HTTP POST of notification (JSON)
+type WebhookSink struct {
+	Url      string
+	Insecure bool
+}
+
+func (sink WebhookSink) Send(notification Notification) error {
+	payload, err := json.Marshal(struct {
+		Notification
+		Subject string `json:"subject"`
+		Body    string `json:"body"`
+	}{notification, notification.Subject(), notification.Body()})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: sink.Insecure},
+		},
+	}
+	resp, err := client.Post(sink.Url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("webhook: " + resp.Status)
+	}
+	return nil
+}
+
+// Local command (sh -c) with notification in environment and body on stdin
+type CommandSink struct {
+	Command string
+}
+
+func (sink CommandSink) Send(notification Notification) error {
+	cmd := exec.Command("/bin/sh", "-c", sink.Command)
+	cmd.Env = append(os.Environ(),
+		"JARVICE_NOTIFY_EVENT="+notification.Event,
+		"JARVICE_NOTIFY_CLUSTER="+notification.Cluster,
+		"JARVICE_NOTIFY_JOB_ID="+strconv.Itoa(notification.Number),
+		"JARVICE_NOTIFY_JOB_NAME="+notification.Name,
+		"JARVICE_NOTIFY_STATUS="+notification.Status,
+		"JARVICE_NOTIFY_EXIT_CODE="+strconv.Itoa(notification.ExitCode),
+		"JARVICE_NOTIFY_RECIPIENTS="+strings.Join(notification.Recipients, ","),
+		"JARVICE_NOTIFY_SUBJECT="+notification.Subject())
+	cmd.Stdin = strings.NewReader(notification.Body())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v %s", sink.Command, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Sink configuration (notify.json)
+type NotifySinkConfig struct {
+	// smtp | sendmail | webhook | command
+	Type string `json:"type"`
+	// SMTP server (host:port)
+	Address  string `json:"address,omitempty"`
+	From     string `json:"from,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// sendmail binary
+	Path     string `json:"path,omitempty"`
+	Url      string `json:"url,omitempty"`
+	Insecure bool   `json:"insecure,omitempty"`
+	Command  string `json:"command,omitempty"`
+}
+
+type NotifyConfig struct {
+	Sinks []NotifySinkConfig `json:"sinks"`
+}
+
+func (config NotifySinkConfig) Sink() (NotifySink, error) {
+	switch config.Type {
+	case "smtp":
+		if len(config.Address) == 0 {
+			return nil, errors.New("smtp sink: missing address")
+		}
+		return SmtpSink{
+			Address:  config.Address,
+			From:     config.From,
+			Username: config.Username,
+			Password: config.Password,
+		}, nil
+	case "sendmail":
+		sendmail := config.Path
+		if len(sendmail) == 0 {
+			sendmail = NotifySendmailPath
+		}
+		return SendmailSink{Path: sendmail, From: config.From}, nil
+	case "webhook":
+		if len(config.Url) == 0 {
+			return nil, errors.New("webhook sink: missing url")
+		}
+		return WebhookSink{Url: config.Url, Insecure: config.Insecure}, nil
+	case "command":
+		if len(config.Command) == 0 {
+			return nil, errors.New("command sink: missing command")
+		}
+		return CommandSink{Command: config.Command}, nil
+	}
+	return nil, errors.New("unknown notification sink: " + config.Type)
+}
+
+func notifyConfigPath() string {
+	return path.Dir(getJarviceConfigPath()) + "/" + JarviceHpcNotifyFilename
+}
+
+// Read notification sinks
+// sendmail is used if notify.json does not exist
+func ReadNotifySinks() ([]NotifySink, error) {
+	config := NotifyConfig{
+		Sinks: []NotifySinkConfig{{Type: "sendmail"}},
+	}
+	if filename := notifyConfigPath(); fileExist(filename) {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, errors.New("invalid notification config " + filename)
+		}
+	}
+	sinks := []NotifySink{}
+	for _, sinkConfig := range config.Sinks {
+		sink, err := sinkConfig.Sink()
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// Notification recipients from comma separated list
+// Defaults to the submitting user (delivered by the local mail system)
+func NotifyRecipients(list string) []string {
+	recipients := []string{}
+	for _, recipient := range strings.Split(list, ",") {
+		if recipient = strings.TrimSpace(recipient); len(recipient) > 0 {
+			recipients = append(recipients, recipient)
+		}
+	}
+	if len(recipients) == 0 {
+		if current, err := user.Current(); err == nil {
+			recipients = append(recipients, current.Username)
+		}
+	}
+	return recipients
+}
+
+// Send notification through all sinks
+func SendNotification(sinks []NotifySink, notification Notification) error {
+	errs := []string{}
+	for _, sink := range sinks {
+		if err := sink.Send(notification); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
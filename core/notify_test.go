@@ -0,0 +1,236 @@
+package jarvice
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testNotification() Notification {
+	return Notification{
+		Event:      NotifyEnd,
+		Cluster:    "default",
+		Number:     42,
+		Name:       "job.sh",
+		Status:     JobStatusCompleted,
+		ExitCode:   3,
+		Recipients: []string{"alice@example.com", "bob@example.com"},
+	}
+}
+
+// Minimal SMTP server accepting a single message
+// Returns address, and channel receiving recipients and message
+func testSmtpServer(t *testing.T) (string, chan []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ESMTP")
+		recipients := []string{}
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); verb {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "MAIL":
+				reply("250 OK")
+			case "RCPT":
+				recipients = append(recipients, strings.Trim(line[len("RCPT TO:"):], "<>"))
+				reply("250 OK")
+			case "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+				message := ""
+				for {
+					data, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if data == ".\r\n" {
+						break
+					}
+					message += data
+				}
+				received <- append(recipients, message)
+				reply("250 OK")
+			case "QUIT":
+				reply("221 Bye")
+				return
+			default:
+				reply("502 Command not implemented")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestSmtpSink(t *testing.T) {
+	address, received := testSmtpServer(t)
+	notification := testNotification()
+	sink := SmtpSink{Address: address, From: "jarvice@example.com"}
+	if err := sink.Send(notification); err != nil {
+		t.Fatal(err)
+	}
+	mail := <-received
+	message := mail[len(mail)-1]
+	if recipients := mail[:len(mail)-1]; strings.Join(recipients, ",") !=
+		strings.Join(notification.Recipients, ",") {
+		t.Errorf("recipients: got %v, want %v", recipients, notification.Recipients)
+	}
+	for _, header := range []string{
+		"From: jarvice@example.com\r\n",
+		"To: alice@example.com, bob@example.com\r\n",
+		"Subject: " + notification.Subject() + "\r\n",
+	} {
+		if !strings.Contains(message, header) {
+			t.Errorf("message without %q:\n%s", header, message)
+		}
+	}
+	if !strings.Contains(message, "Exit code: 3\r\n") {
+		t.Errorf("message without exit code:\n%s", message)
+	}
+}
+
+func TestSmtpSinkUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	if err := (SmtpSink{Address: address}).Send(testNotification()); err == nil {
+		t.Error("expected error for unreachable SMTP server")
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var payload map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("method: got %s, want POST", r.Method)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+	notification := testNotification()
+	if err := (WebhookSink{Url: server.URL}).Send(notification); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]interface{}{
+		"event":     NotifyEnd,
+		"number":    float64(42),
+		"exit_code": float64(3),
+		"subject":   notification.Subject(),
+		"body":      notification.Body(),
+	} {
+		if payload[key] != want {
+			t.Errorf("%s: got %v, want %v", key, payload[key], want)
+		}
+	}
+}
+
+func TestWebhookSinkError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	if err := (WebhookSink{Url: server.URL}).Send(testNotification()); err == nil {
+		t.Error("expected error for HTTP 503")
+	}
+}
+
+// Write executable shell script into temporary directory
+func testScript(t *testing.T, name, script string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(filename, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func testReadFile(t *testing.T, filename string) string {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCommandSink(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	script := testScript(t, "notify",
+		`echo "$JARVICE_NOTIFY_EVENT $JARVICE_NOTIFY_JOB_ID $JARVICE_NOTIFY_EXIT_CODE $JARVICE_NOTIFY_RECIPIENTS" > "$1"
+cat >> "$1"
+`)
+	notification := testNotification()
+	if err := (CommandSink{Command: script + " " + out}).Send(notification); err != nil {
+		t.Fatal(err)
+	}
+	want := "END 42 3 alice@example.com,bob@example.com\n" + notification.Body()
+	if got := testReadFile(t, out); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCommandSinkError(t *testing.T) {
+	script := testScript(t, "notify", "echo unavailable >&2\nexit 1\n")
+	err := (CommandSink{Command: script}).Send(testNotification())
+	if err == nil || !strings.Contains(err.Error(), "unavailable") {
+		t.Errorf("expected error with command output, got %v", err)
+	}
+}
+
+func TestSendmailSink(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	os.Setenv("TEST_SENDMAIL_OUT", out)
+	defer os.Unsetenv("TEST_SENDMAIL_OUT")
+	sendmail := testScript(t, "sendmail", `echo "$@" > "$TEST_SENDMAIL_OUT"
+cat >> "$TEST_SENDMAIL_OUT"
+`)
+	notification := testNotification()
+	sink := SendmailSink{Path: sendmail, From: "jarvice@example.com"}
+	if err := sink.Send(notification); err != nil {
+		t.Fatal(err)
+	}
+	got := testReadFile(t, out)
+	if args := strings.SplitN(got, "\n", 2)[0]; args != "-t -i -f jarvice@example.com" {
+		t.Errorf("arguments: got %q", args)
+	}
+	for _, header := range []string{
+		"To: alice@example.com, bob@example.com\r\n",
+		"Subject: " + notification.Subject() + "\r\n",
+	} {
+		if !strings.Contains(got, header) {
+			t.Errorf("message without %q:\n%s", header, got)
+		}
+	}
+}
+
+func TestSendmailSinkError(t *testing.T) {
+	sendmail := testScript(t, "sendmail", "cat > /dev/null\nexit 75\n")
+	if err := (SendmailSink{Path: sendmail}).Send(testNotification()); err == nil {
+		t.Error("expected error for sendmail exit status")
+	}
+}
@@ -0,0 +1,144 @@
+package jarvice
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Maximum nesting of option files (-@ in option files)
+const optionFileDepth = 8
+
+// Split option file into arguments
+// Arguments are separated by white space (single or double quotes group
+// words) and # starts a comment
+func splitOptions(data string) []string {
+	args := []string{}
+	for _, line := range strings.Split(data, "\n") {
+		arg := ""
+		inArg := false
+		var quote rune
+	scan:
+		for _, char := range line {
+			switch {
+			case quote != 0:
+				if char == quote {
+					quote = 0
+				} else {
+					arg += string(char)
+				}
+			case char == '\'' || char == '"':
+				quote = char
+				inArg = true
+			case char == '#':
+				break scan
+			case char == ' ' || char == '\t' || char == '\r':
+				if inArg {
+					args = append(args, arg)
+				}
+				arg, inArg = "", false
+			default:
+				arg += string(char)
+				inArg = true
+			}
+		}
+		if inArg {
+			args = append(args, arg)
+		}
+	}
+	return args
+}
+
+// Read arguments of option file (qsub -@, sge_request)
+func ReadOptionFile(filename string) ([]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return splitOptions(string(data)), nil
+}
+
+func expandOptionFiles(args []string, depth int) ([]string, error) {
+	if depth > optionFileDepth {
+		return nil, errors.New("too many nested option files")
+	}
+	ret := []string{}
+	for index := 0; index < len(args); index++ {
+		if args[index] != "-@" {
+			ret = append(ret, args[index])
+			continue
+		}
+		if index+1 >= len(args) {
+			return nil, errors.New("missing option file after -@")
+		}
+		index++
+		fileArgs, err := ReadOptionFile(args[index])
+		if err != nil {
+			return nil, errors.New("cannot read option file " + args[index])
+		}
+		if fileArgs, err = expandOptionFiles(fileArgs, depth+1); err != nil {
+			return nil, err
+		}
+		ret = append(ret, fileArgs...)
+	}
+	return ret, nil
+}
+
+// Replace -@ <file> with the arguments of option file
+func ExpandOptionFiles(args []string) ([]string, error) {
+	return expandOptionFiles(args, 0)
+}
+
+// Discard arguments up to the last -clear
+// Returns remaining arguments and whether arguments were cleared
+func ClearOptions(args []string) ([]string, bool) {
+	for index := len(args) - 1; index >= 0; index-- {
+		if args[index] == "-clear" || args[index] == "--clear" {
+			return append([]string{}, args[index+1:]...), true
+		}
+	}
+	return args, false
+}
+
+// SGE default request files, lowest precedence first:
+// $SGE_ROOT/$SGE_CELL/common/sge_request, ~/.sge_request and ./.sge_request
+func SgeRequestFiles() []string {
+	files := []string{}
+	if root := os.Getenv("SGE_ROOT"); len(root) > 0 {
+		cell := os.Getenv("SGE_CELL")
+		if len(cell) == 0 {
+			cell = "default"
+		}
+		files = append(files, root+"/"+cell+"/common/sge_request")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, home+"/.sge_request")
+	}
+	return append(files, ".sge_request")
+}
+
+// Arguments of SGE default request files (option files are expanded)
+// Files that do not exist are skipped
+func ReadSgeRequest() ([]string, error) {
+	args := []string{}
+	read := map[string]bool{}
+	for _, filename := range SgeRequestFiles() {
+		// ./.sge_request is ~/.sge_request in home directory
+		abs, _ := filepath.Abs(filename)
+		if !fileExist(filename) || read[abs] {
+			continue
+		}
+		read[abs] = true
+		fileArgs, err := ReadOptionFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if fileArgs, err = ExpandOptionFiles(fileArgs); err != nil {
+			return nil, errors.New(filename + ": " + err.Error())
+		}
+		args = append(args, fileArgs...)
+	}
+	return args, nil
+}
@@ -0,0 +1,181 @@
+package jarvice
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Parallel environments (qsub -pe) are defined by the site in pe.json
+// (next to config.json)
+const JarviceHpcPeFilename = "pe.json"
+
+// Allocation rules of parallel environments
+const (
+	PeFillUp     = "$fill_up"
+	PeRoundRobin = "$round_robin"
+	PePeSlots    = "$pe_slots"
+)
+
+// PE host file in JARVICE jobs (SGE format)
+const PeHostfile = "/tmp/jarvice-hpc/pe_hostfile"
+
+// Parallel environment definition (pe.json)
+type PeDefinition struct {
+	// $fill_up | $round_robin | $pe_slots | slots per host
+	AllocationRule string `json:"allocation_rule"`
+	// maximum slots of a job (0: no limit)
+	Slots int `json:"slots,omitempty"`
+}
+
+type PeConfig struct {
+	Pes map[string]PeDefinition `json:"pes"`
+}
+
+// Slots per host of a parallel job
+type PeAllocation struct {
+	Slots int
+	Hosts []int
+}
+
+func peConfigPath() string {
+	return path.Dir(getJarviceConfigPath()) + "/" + JarviceHpcPeFilename
+}
+
+// Read definition of parallel environment
+// The "*" definition is used for parallel environments not defined,
+// $fill_up if pe.json does not define it
+func ReadPeDefinition(name string) (PeDefinition, error) {
+	config := PeConfig{}
+	if filename := peConfigPath(); fileExist(filename) {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return PeDefinition{}, err
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return PeDefinition{}, errors.New("invalid parallel environment config " + filename)
+		}
+	}
+	if def, ok := config.Pes[name]; ok {
+		return def, nil
+	}
+	if def, ok := config.Pes["*"]; ok {
+		return def, nil
+	}
+	return PeDefinition{AllocationRule: PeFillUp}, nil
+}
+
+// Parse slot range n[-[m]] or -m (qsub -pe)
+// max is 0 if the range has no upper bound
+func ParsePeRange(spec string) (min, max int, err error) {
+	invalid := errors.New("invalid slot range: " + spec)
+	bounds := strings.SplitN(spec, "-", 2)
+	min, max = 1, 0
+	if len(bounds[0]) > 0 {
+		if min, err = strconv.Atoi(bounds[0]); err != nil || min < 1 {
+			return 0, 0, invalid
+		}
+	}
+	if len(bounds) == 1 {
+		return min, min, nil
+	}
+	if len(bounds[1]) > 0 {
+		if max, err = strconv.Atoi(bounds[1]); err != nil || max < min {
+			return 0, 0, invalid
+		}
+	} else if len(bounds[0]) == 0 {
+		return 0, 0, invalid
+	}
+	return min, max, nil
+}
+
+// Slots per host for number of slots (false if slots do not fit)
+func (def PeDefinition) hosts(slots, cores, maxNodes int) ([]int, bool) {
+	if def.Slots > 0 && slots > def.Slots {
+		return nil, false
+	}
+	nodes := 0
+	switch def.AllocationRule {
+	case PePeSlots:
+		nodes = 1
+	case PeFillUp:
+		nodes = ceilDiv(slots, cores)
+	case PeRoundRobin:
+		nodes = slots
+		if nodes > maxNodes {
+			nodes = maxNodes
+		}
+	default:
+		perHost, _ := strconv.Atoi(def.AllocationRule)
+		if slots%perHost != 0 {
+			return nil, false
+		}
+		nodes = slots / perHost
+	}
+	if nodes < 1 || nodes > maxNodes {
+		return nil, false
+	}
+	hosts := make([]int, nodes)
+	for index := range hosts {
+		if def.AllocationRule == PeFillUp {
+			// first hosts are filled up
+			hosts[index] = cores
+			if index == nodes-1 {
+				hosts[index] = slots - cores*(nodes-1)
+			}
+		} else {
+			// slots are spread evenly
+			hosts[index] = slots / nodes
+			if index < slots%nodes {
+				hosts[index]++
+			}
+		}
+		if hosts[index] > cores {
+			return nil, false
+		}
+	}
+	return hosts, true
+}
+
+// Allocate largest number of slots in range on nodes with cores per node
+func (def PeDefinition) Allocate(min, max, cores, maxNodes int) (PeAllocation, error) {
+	switch def.AllocationRule {
+	case PeFillUp, PeRoundRobin, PePeSlots:
+	default:
+		if perHost, err := strconv.Atoi(def.AllocationRule); err != nil || perHost < 1 {
+			return PeAllocation{}, errors.New("invalid allocation rule: " + def.AllocationRule)
+		}
+	}
+	if cores < 1 {
+		cores = 1
+	}
+	if maxNodes < 1 {
+		maxNodes = 1
+	}
+	if max == 0 || max > cores*maxNodes {
+		max = cores * maxNodes
+	}
+	for slots := max; slots >= min; slots-- {
+		if hosts, ok := def.hosts(slots, cores, maxNodes); ok {
+			return PeAllocation{Slots: slots, Hosts: hosts}, nil
+		}
+	}
+	return PeAllocation{}, errors.New("cannot allocate slots with " +
+		strconv.Itoa(cores) + " cores per node")
+}
+
+// Remote shell snippet writing the PE host file of allocation
+// (<host> <slots> <queue>@<host> UNDEFINED, one line per node)
+func (alloc PeAllocation) HostfileEnvConfig(queue string) string {
+	slots := []string{}
+	for _, count := range alloc.Hosts {
+		slots = append(slots, strconv.Itoa(count))
+	}
+	return `mkdir -p ` + path.Dir(PeHostfile) + ` && ` +
+		`awk -v slots="` + strings.Join(slots, " ") + `" -v queue=` + ShellQuote(queue) + ` ` +
+		`'BEGIN{n=split(slots,s," ")} NR<=n{print $1, s[NR], queue "@" $1, "UNDEFINED"}' ` +
+		JobNodesFile + ` > ` + PeHostfile + `;`
+}
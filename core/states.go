@@ -0,0 +1,102 @@
+package jarvice
+
+import (
+	"time"
+)
+
+// JARVICE job status
+const (
+	JobStatusSubmitted          = "SUBMITTED"
+	JobStatusStarting           = "PROCESSING STARTING"
+	JobStatusShutdown           = "PROCESSING SHUTDOWN"
+	JobStatusCompleted          = "COMPLETED"
+	JobStatusCompletedWithError = "COMPLETED WITH ERROR"
+	JobStatusTerminated         = "TERMINATED"
+	JobStatusCanceled           = "CANCELED"
+	JobStatusExempt             = "EXEMPT"
+	JobStatusSequentiallyQueued = "SEQUENTIALLY QUEUED"
+)
+
+// Scheduler states for a JARVICE job status
+type JobState struct {
+	// Slurm compact state code (e.g. PD)
+	Slurm string
+	// Slurm state name (e.g. PENDING)
+	SlurmLong string
+	// Slurm pending/exit reason
+	SlurmReason string
+	// SGE state (e.g. qw)
+	Sge string
+	// Job is not running yet
+	Pending bool
+	// Job finished (hidden by default)
+	Terminal bool
+}
+
+var jarviceJobStates = map[string]JobState{
+	JobStatusSubmitted: {
+		Slurm: "PD", SlurmLong: "PENDING", SlurmReason: "Resources",
+		Sge: "qw", Pending: true,
+	},
+	JobStatusSequentiallyQueued: {
+		Slurm: "PD", SlurmLong: "PENDING", SlurmReason: "QOSMaxJobsPerUserLimit",
+		Sge: "qw", Pending: true,
+	},
+	JobStatusExempt: {
+		Slurm: "PD", SlurmLong: "PENDING", SlurmReason: "Priority",
+		Sge: "qw", Pending: true,
+	},
+	JobStatusStarting: {
+		Slurm: "R", SlurmLong: "RUNNING", SlurmReason: "None",
+		Sge: "r",
+	},
+	JobStatusShutdown: {
+		Slurm: "CG", SlurmLong: "COMPLETING", SlurmReason: "None",
+		Sge: "dr",
+	},
+	JobStatusCompleted: {
+		Slurm: "CD", SlurmLong: "COMPLETED", SlurmReason: "None",
+		Sge: "z", Terminal: true,
+	},
+	JobStatusCompletedWithError: {
+		Slurm: "F", SlurmLong: "FAILED", SlurmReason: "NonZeroExitCode",
+		Sge: "Eqw", Terminal: true,
+	},
+	JobStatusTerminated: {
+		Slurm: "CA", SlurmLong: "CANCELLED", SlurmReason: "None",
+		Sge: "dr", Terminal: true,
+	},
+	JobStatusCanceled: {
+		Slurm: "CA", SlurmLong: "CANCELLED", SlurmReason: "None",
+		Sge: "z", Terminal: true,
+	},
+}
+
+// Scheduler states for JARVICE job
+// Unknown status is reported as pending
+func (job JarviceJob) State() JobState {
+	state, ok := jarviceJobStates[job.Status]
+	if !ok {
+		state = jarviceJobStates[JobStatusSubmitted]
+	}
+	// job pods are scheduled but not started
+	if job.Status == JobStatusStarting && job.StartTime <= 0 {
+		state.Sge = "t"
+	}
+	return state
+}
+
+// Job run time in seconds (zero if job did not start)
+func (job JarviceJob) Elapsed(now time.Time) int64 {
+	if job.StartTime <= 0 {
+		return 0
+	}
+	end := now.Unix()
+	if job.EndTime > 0 && job.State().Terminal {
+		end = int64(job.EndTime)
+	}
+	if end < int64(job.StartTime) {
+		return 0
+	}
+	return end - int64(job.StartTime)
+}
@@ -0,0 +1,280 @@
+package jarvice
+
+import (
+	"time"
+
+	logger "jarvice.io/jarvice-hpc/logger"
+)
+
+// Minimum time between status checks of a watched job
+const NotifyCheckInterval = 30 * time.Second
+
+// Attempts to send a notification before it is dropped
+// (failed notifications are retried at the next status check)
+const NotifySendAttempts = 5
+
+// Submitted job watched for notifications (--mail-type, -m)
+type NotifyWatch struct {
+	Cluster string `json:"cluster"`
+	Number  int    `json:"number,omitempty"`
+	// local job ID of job held on the client (number unknown until submitted)
+	DeferredId int      `json:"deferred_id,omitempty"`
+	Name       string   `json:"name"`
+	Events     []string `json:"events"`
+	Recipients []string `json:"recipients"`
+	Sent       []string `json:"sent,omitempty"`
+	// failed attempts to send events not sent yet
+	Failures   map[string]int `json:"failures,omitempty"`
+	LastCheck  int64          `json:"last_check,omitempty"`
+	SubmitTime int64          `json:"submit_time"`
+	// job finished (watch is kept for requeue)
+	Done bool `json:"done,omitempty"`
+}
+
+// Watch needs a status check
+func (watch NotifyWatch) due(now time.Time) bool {
+	return !watch.Done &&
+		now.Sub(time.Unix(watch.LastCheck, 0)) >= NotifyCheckInterval
+}
+
+// Set job ID of watch (JARVICE job number or local job ID)
+func (watch *NotifyWatch) setId(id int) {
+	watch.Number, watch.DeferredId = 0, 0
+	if id >= DeferredJobIdBase {
+		watch.DeferredId = id
+	} else {
+		watch.Number = id
+	}
+}
+
+func (watch NotifyWatch) wants(event string) bool {
+	for _, val := range watch.Events {
+		if val == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (watch NotifyWatch) sent(event string) bool {
+	for _, val := range watch.Sent {
+		if val == event {
+			return true
+		}
+	}
+	return false
+}
+
+func newNotifyWatch(id int, name string, events, recipients []string) NotifyWatch {
+	watch := NotifyWatch{
+		Cluster:    ReadJarviceConfigTarget(),
+		Name:       name,
+		Events:     events,
+		Recipients: recipients,
+		SubmitTime: time.Now().Unix(),
+	}
+	watch.setId(id)
+	return watch
+}
+
+// Watch job for notifications
+// id is a JARVICE job number or a local job ID (job held on the client)
+func WatchJob(id int, name string, events, recipients []string) error {
+	if len(events) == 0 {
+		return nil
+	}
+	watch := newNotifyWatch(id, name, events, recipients)
+	return UpdateDeferredStore(func(store *DeferredStore) error {
+		store.Watches = append(store.Watches, watch)
+		return nil
+	})
+}
+
+// Events of job status not sent yet
+func (watch NotifyWatch) pendingEvents(job JarviceJob) []string {
+	events := []string{}
+	state := job.State()
+	if job.StartTime > 0 || job.Status == JobStatusShutdown {
+		events = append(events, NotifyBegin)
+	}
+	if state.Terminal {
+		events = append(events, NotifyEnd)
+		if job.Status != JobStatusCompleted || job.ExitCode != 0 {
+			events = append(events, NotifyFail)
+		}
+	}
+	pending := []string{}
+	for _, event := range events {
+		if watch.wants(event) && !watch.sent(event) {
+			pending = append(pending, event)
+		}
+	}
+	return pending
+}
+
+// Claim watches due for a status check (best effort against concurrent clients)
+func claimWatches(now time.Time) ([]NotifyWatch, error) {
+	claimed := []NotifyWatch{}
+	err := UpdateDeferredStore(func(store *DeferredStore) error {
+		watches := []NotifyWatch{}
+		for _, watch := range store.Watches {
+			if watch.Number == 0 {
+				// resolve job held on the client once submitted
+				found := false
+				for _, job := range store.Jobs {
+					if job.Id == watch.DeferredId && job.Cluster == watch.Cluster {
+						found = len(job.Error) == 0
+						watch.Number = job.Number
+					}
+				}
+				// job was canceled or failed to submit
+				if !found {
+					continue
+				}
+			}
+			if watch.Number > 0 && watch.due(now) {
+				watch.LastCheck = now.Unix()
+				claimed = append(claimed, watch)
+			}
+			watches = append(watches, watch)
+		}
+		store.Watches = watches
+		return nil
+	})
+	return claimed, err
+}
+
+// Check watched jobs and send notifications
+// Used by jarvice agent and every CLI invocation (best effort)
+func ProcessWatches() error {
+	if !fileExist(deferredStorePath()) {
+		return nil
+	}
+	// avoid locking store if no watch is due
+	now := time.Now()
+	if store, err := readDeferredStore(); err == nil {
+		due := false
+		for _, watch := range store.Watches {
+			due = due || watch.due(now)
+		}
+		if !due {
+			return nil
+		}
+	}
+	config, err := ReadJarviceConfig()
+	if err != nil {
+		return err
+	}
+	watches, err := claimWatches(now)
+	if err != nil || len(watches) == 0 {
+		return err
+	}
+	sinks, err := ReadNotifySinks()
+	if err != nil {
+		return err
+	}
+	sent := map[int][]string{}
+	failed := map[int][]string{}
+	done := map[int]bool{}
+	for _, watch := range watches {
+		cluster, ok := config[watch.Cluster]
+		if !ok {
+			continue
+		}
+		job, err := GetJobStatus(cluster, watch.Number)
+		if err != nil {
+			logger.WarningPrintf("notify: job %d: %v", watch.Number, err)
+			continue
+		}
+		for _, event := range watch.pendingEvents(job) {
+			notification := Notification{
+				Event:      event,
+				Cluster:    watch.Cluster,
+				Number:     watch.Number,
+				Name:       watch.Name,
+				Status:     job.Status,
+				ExitCode:   job.ExitCode,
+				Recipients: watch.Recipients,
+			}
+			if err := SendNotification(sinks, notification); err != nil {
+				logger.WarningPrintf("notify: job %d %s: %v", watch.Number, event, err)
+				failed[watch.Number] = append(failed[watch.Number], event)
+				continue
+			}
+			sent[watch.Number] = append(sent[watch.Number], event)
+		}
+		done[watch.Number] = job.State().Terminal
+	}
+	return UpdateDeferredStore(func(store *DeferredStore) error {
+		for index := range store.Watches {
+			watch := &store.Watches[index]
+			if watch.Number == 0 || watch.Done {
+				continue
+			}
+			for _, event := range sent[watch.Number] {
+				watch.Sent = append(watch.Sent, event)
+				delete(watch.Failures, event)
+			}
+			for _, event := range failed[watch.Number] {
+				if watch.Failures == nil {
+					watch.Failures = map[string]int{}
+				}
+				watch.Failures[event]++
+				if watch.Failures[event] >= NotifySendAttempts {
+					logger.WarningPrintf("notify: job %d %s: dropped after %d attempts",
+						watch.Number, event, watch.Failures[event])
+					watch.Sent = append(watch.Sent, event)
+					delete(watch.Failures, event)
+				}
+			}
+			// finished jobs are checked again until all notifications are sent
+			watch.Done = done[watch.Number] && len(watch.Failures) == 0
+		}
+		return nil
+	})
+}
+
+// Move watch to job resubmitted with a new job ID (scontrol update)
+// id is a JARVICE job number or a local job ID (job held on the client)
+func MoveWatch(number, id int) (watch NotifyWatch, found bool, err error) {
+	target := ReadJarviceConfigTarget()
+	err = UpdateDeferredStore(func(store *DeferredStore) error {
+		for index := range store.Watches {
+			if store.Watches[index].Number != number ||
+				store.Watches[index].Cluster != target {
+				continue
+			}
+			found = true
+			watch = store.Watches[index]
+			store.Watches[index].setId(id)
+			store.Watches[index].Sent = nil
+			store.Watches[index].Failures = nil
+			store.Watches[index].LastCheck = 0
+			store.Watches[index].Done = false
+			return nil
+		}
+		return nil
+	})
+	return
+}
+
+// Move watch of requeued job to the new job and send REQUEUE notification
+func RequeueWatch(number, newNumber int) error {
+	watch, found, err := MoveWatch(number, newNumber)
+	if err != nil || !found || !watch.wants(NotifyRequeue) {
+		return err
+	}
+	sinks, err := ReadNotifySinks()
+	if err != nil {
+		return err
+	}
+	return SendNotification(sinks, Notification{
+		Event:      NotifyRequeue,
+		Cluster:    watch.Cluster,
+		Number:     number,
+		Name:       watch.Name,
+		Status:     "REQUEUED",
+		Recipients: watch.Recipients,
+		RequeuedAs: newNumber,
+	})
+}
@@ -0,0 +1,97 @@
+package jarvice
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Client config with JARVICE API returning a finished job and
+// a command sink failing while fail file exists
+// Returns fail file and file of sent events
+func testWatchConfig(t *testing.T) (string, string) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"42": {"job_name": "jarvice-job-42", "job_status": "COMPLETED",
+			"job_start_time": 1, "job_end_time": 2, "job_exitcode": 0}}`)
+	}))
+	t.Cleanup(server.Close)
+	dir := t.TempDir()
+	config := filepath.Join(dir, JarviceHpcConfigFilename)
+	if err := ioutil.WriteFile(config, []byte(`{"default": {"jarvice_endpoint": "`+
+		server.URL+`", "jarvice_user": {"username": "alice", "apikey": "key"}}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(JarviceHpcConfigEnv, config)
+	t.Setenv("JXE_CLUSTER", "")
+	fail := filepath.Join(dir, "fail")
+	sent := filepath.Join(dir, "sent")
+	script := testScript(t, "notify", `[ -e "`+fail+`" ] && exit 1
+echo "$JARVICE_NOTIFY_EVENT" >> "`+sent+`"
+`)
+	if err := ioutil.WriteFile(filepath.Join(dir, JarviceHpcNotifyFilename),
+		[]byte(`{"sinks": [{"type": "command", "command": "`+script+`"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fail, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WatchJob(42, "job.sh", []string{NotifyEnd}, []string{"alice"}); err != nil {
+		t.Fatal(err)
+	}
+	return fail, sent
+}
+
+// Check watch again (status checks are rate limited) and return it
+func testProcessWatch(t *testing.T) NotifyWatch {
+	if err := UpdateDeferredStore(func(store *DeferredStore) error {
+		store.Watches[0].LastCheck = 0
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ProcessWatches(); err != nil {
+		t.Fatal(err)
+	}
+	store, err := readDeferredStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.Watches[0]
+}
+
+func TestProcessWatchesRetry(t *testing.T) {
+	fail, sent := testWatchConfig(t)
+	watch := testProcessWatch(t)
+	if watch.sent(NotifyEnd) || watch.Done || watch.Failures[NotifyEnd] != 1 {
+		t.Fatalf("failed notification recorded as sent: %+v", watch)
+	}
+	os.Remove(fail)
+	watch = testProcessWatch(t)
+	if !watch.sent(NotifyEnd) || !watch.Done || len(watch.Failures) > 0 {
+		t.Fatalf("notification not recorded as sent: %+v", watch)
+	}
+	if got := testReadFile(t, sent); got != "END\n" {
+		t.Errorf("sent events: got %q, want %q", got, "END\n")
+	}
+}
+
+func TestProcessWatchesDrop(t *testing.T) {
+	_, sent := testWatchConfig(t)
+	var watch NotifyWatch
+	for attempt := 1; attempt <= NotifySendAttempts; attempt++ {
+		if watch = testProcessWatch(t); attempt < NotifySendAttempts && watch.Done {
+			t.Fatalf("watch done after %d failed attempts: %+v", attempt, watch)
+		}
+	}
+	if !watch.sent(NotifyEnd) || !watch.Done || len(watch.Failures) > 0 {
+		t.Fatalf("notification not dropped after %d attempts: %+v", NotifySendAttempts, watch)
+	}
+	if _, err := os.Stat(sent); err == nil {
+		t.Errorf("events sent: %s", strings.TrimSpace(testReadFile(t, sent)))
+	}
+}
@@ -5,7 +5,7 @@ go 1.15
 require (
     jarvice.io/jarvice-hpc/core v0.0.0
     jarvice.io/jarvice-hpc/logger v0.0.0
-    github.com/jessevdk/go-flags v1.4.0
+    github.com/jessevdk/go-flags v1.5.0
 )
 
 replace (
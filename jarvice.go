@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	jarvice "jarvice.io/jarvice-hpc/core"
 	logger "jarvice.io/jarvice-hpc/logger"
@@ -18,6 +19,7 @@ type JarviceCommand struct {
 	Vault   JarviceVaultCommand   `command:"vault"`
 	Cluster JarviceClusterCommand `command:"cluster"`
 	Live    JarviceLiveCommand    `command:"live"`
+	Agent   JarviceAgentCommand   `command:"agent"`
 }
 
 type JarviceLoginCommand struct {
@@ -52,6 +54,12 @@ type JarviceLiveCommand struct {
 	} `positional-args:"true" required:"1"`
 }
 
+type JarviceAgentCommand struct {
+	Config   JarviceConfigFlags `group:"Configuration Options" hidden:"true"`
+	Interval int                `short:"i" long:"interval" description:"seconds between checks" default:"30"`
+	Once     bool               `long:"once" description:"check once and exit"`
+}
+
 var jarviceCommand JarviceCommand
 
 func (x *JarviceCommand) Execute(args []string) error {
@@ -115,6 +123,31 @@ func (x *JarviceLiveCommand) Execute(args []string) error {
 	return nil
 }
 
+func (x *JarviceAgentCommand) Execute(args []string) error {
+	if x.Config.Help {
+		return jarvice.CreateHelpErr()
+	}
+	if x.Interval < 1 {
+		return errors.New("agent: interval must be a positive integer")
+	}
+	logger.InfoPrintf("starting JARVICE HPC agent")
+	for {
+		if err := jarvice.ProcessDeferredJobs(); err != nil {
+			logger.WarningPrintf("agent: %v", err)
+		}
+		if err := jarvice.ProcessArrayJobs(); err != nil {
+			logger.WarningPrintf("agent: array jobs: %v", err)
+		}
+		if err := jarvice.ProcessWatches(); err != nil {
+			logger.WarningPrintf("agent: notifications: %v", err)
+		}
+		if x.Once {
+			return nil
+		}
+		time.Sleep(time.Duration(x.Interval) * time.Second)
+	}
+}
+
 func init() {
 	parser.AddCommand("jarvice",
 		"JARVICE configuration",
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"reflect"
 
 	"github.com/jessevdk/go-flags"
 	jarvice "jarvice.io/jarvice-hpc/core"
@@ -20,9 +21,61 @@ func printHelp(parser *flags.Parser) {
 	fmt.Println(b.String())
 }
 
+// Commands reading or changing job state (deferred jobs, array tasks and
+// notifications are processed first)
+var jobCommands = map[string]bool{
+	"sbatch":   true,
+	"squeue":   true,
+	"scancel":  true,
+	"sacct":    true,
+	"scontrol": true,
+	"srun":     true,
+	"salloc":   true,
+	"qsub":     true,
+	"qstat":    true,
+	"qdel":     true,
+	"qacct":    true,
+}
+
+// Command options request help message
+func helpRequested(command flags.Commander) bool {
+	value := reflect.Indirect(reflect.ValueOf(command))
+	if value.Kind() != reflect.Struct {
+		return false
+	}
+	help := value.FieldByName("Help")
+	return help.IsValid() && help.Kind() == reflect.Bool && help.Bool()
+}
+
+// Submit deferred jobs and held array tasks and send job notifications
+// (best effort)
+// Skipped in JARVICE-HPC jobs (in-job commands do not use the API)
+func processJobs(command flags.Commander) {
+	if jarvice.InJob() || parser.Active == nil || !jobCommands[parser.Active.Name] ||
+		helpRequested(command) {
+		return
+	}
+	if derr := jarvice.ProcessDeferredJobs(); derr != nil {
+		logger.WarningPrintf("deferred jobs: %v", derr)
+	}
+	if aerr := jarvice.ProcessArrayJobs(); aerr != nil {
+		logger.WarningPrintf("array jobs: %v", aerr)
+	}
+	if nerr := jarvice.ProcessWatches(); nerr != nil {
+		logger.WarningPrintf("notifications: %v", nerr)
+	}
+}
+
 func main() {
 	var err error
 	args := []string{}
+	parser.CommandHandler = func(command flags.Commander, args []string) error {
+		if command == nil {
+			return nil
+		}
+		processJobs(command)
+		return command.Execute(args)
+	}
 	if args, err = jarvice.PreprocessArgs(os.Args); err != nil {
 		logger.ErrorPrintf("flags error: %v",
 			fmt.Errorf("PreprocessArg: %w", err))
@@ -56,10 +109,17 @@ errHandler:
 		}
 		logger.DebugPrintf("unhandled flag error: %v", flagsErr.Error())
 		os.Exit(1)
+	case *jarvice.ExitError:
+		logger.DebugPrintf("main: %s", flagsErr.Error())
+		os.Exit(flagsErr.Code)
 	case *jarvice.SgeError:
 		logger.DebugPrintf("sge: %s", flagsErr.Error())
 		fmt.Println(flagsErr.Error())
 		os.Exit(1)
+	case *jarvice.SlurmError:
+		logger.DebugPrintf("slurm: %s", flagsErr.Error())
+		fmt.Fprintln(os.Stderr, flagsErr.Error())
+		os.Exit(1)
 	default:
 		// TODO create error type to prevent printing golang errors to user
 		logger.DebugPrintf("main: unhandled error: %v", flagsErr.Error())
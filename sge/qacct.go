@@ -1,84 +1,491 @@
 package main
 
 import (
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	jarvice "jarvice.io/jarvice-hpc/core"
 )
 
 type QAcctCommand struct {
-	Help bool `short:"h" long:"help" description:"Show this help message"`
+	Help      bool     `short:"h" long:"help" description:"Show this help message"`
+	Jobs      string   `short:"j" optional:"yes" optional-value:"*" description:"Prints the accounting information of jobs (all jobs without argument)\n[job_id|job_name|pattern]"`
+	Owner     string   `short:"o" description:"Only jobs of owner are considered"`
+	Queue     string   `short:"q" description:"Only jobs of queue are considered"`
+	Project   string   `short:"P" description:"Only jobs of project are considered"`
+	Days      int      `short:"d" description:"Only jobs started during the last days are considered"`
+	Begin     string   `short:"b" description:"Only jobs started after begin time are considered\n[[CC]YY]MMDDhhmm[.SS]"`
+	End       string   `short:"e" description:"Only jobs started before end time are considered\n[[CC]YY]MMDDhhmm[.SS]"`
+	Resources []string `short:"l" description:"Only jobs that requested the resources are considered\nresource=value,..."`
+	Csv       bool     `long:"csv" description:"Export accounting records of jobs in CSV format"`
+	Json      bool     `long:"json" description:"Export accounting records of jobs in JSON format"`
 }
 
 var qAcctCommand QAcctCommand
 
-func qAcctPrintJob(number int, job jarvice.JarviceJob) {
-	// Only print HPC jobs that have completed
-	if job.EndTime == 0 || len(job.ApiSubmission.Queue) == 0 {
-		//if job.EndTime == 0 {
-		return
-	}
-	fmt.Println("==============================================================")
-	fmt.Printf("qname\t%s\n", job.ApiSubmission.Queue)
-	fmt.Printf("hostname\t%s\n", job.ApiSubmission.Machine.Type)
-	fmt.Printf("group\t%s\n", job.User)
-	fmt.Printf("owner\t%s\n", job.User)
-	fmt.Printf("jobname\t%s\n", job.Label)
-	fmt.Printf("jobnumber\t%d\n", number)
-	fmt.Printf("account\t%s\n", job.User)
-	// Times are best effort
-	subTime := time.Unix(int64(job.SubmitTime), 0)
-	fmt.Printf("qsub_time\t%s\n", subTime.Format(time.UnixDate))
-	startTime := time.Unix(int64(job.StartTime), 0)
-	fmt.Printf("start_time\t%s\n", startTime.Format(time.UnixDate))
-	endTime := time.Unix(int64(job.EndTime), 0)
-	fmt.Printf("end_time\t%s\n", endTime.Format(time.UnixDate))
-	qAcctFailed := 0
-	if job.ExitCode != 0 {
-		qAcctFailed = 1
-	}
-	fmt.Printf("failed\t%d\n", qAcctFailed)
-	fmt.Printf("exit_status\t%d\n", job.ExitCode)
+const qAcctSeparator = "=============================================================="
+
+// Accounting record of a completed job
+// Memory and IO usage are not reported by JARVICE
+type qAcctRecord struct {
+	Queue      string  `json:"qname"`
+	Hostname   string  `json:"hostname"`
+	Group      string  `json:"group"`
+	Owner      string  `json:"owner"`
+	Project    string  `json:"project"`
+	Name       string  `json:"jobname"`
+	Id         int     `json:"jobnumber"`
+	Task       string  `json:"taskid"`
+	Account    string  `json:"account"`
+	SubmitTime int64   `json:"qsub_time"`
+	StartTime  int64   `json:"start_time"`
+	EndTime    int64   `json:"end_time"`
+	Pe         string  `json:"granted_pe"`
+	Slots      int     `json:"slots"`
+	Failed     int     `json:"failed"`
+	ExitStatus int     `json:"exit_status"`
+	Wallclock  int64   `json:"ru_wallclock"`
+	Utime      float64 `json:"ru_utime"`
+	Stime      float64 `json:"ru_stime"`
+	Cpu        float64 `json:"cpu"`
+	// JARVICE job number, machine type and cores of all nodes (chargeback)
+	Number  int    `json:"jarvice_job_number"`
+	Machine string `json:"machine"`
+	Nodes   int    `json:"nodes"`
+	Cores   int    `json:"cores"`
+	// hard resources (qsub -l)
+	Resources map[string]string `json:"-"`
+}
+
+// Execution host of JARVICE jobs (cluster endpoint)
+func qAcctHostname(cluster jarvice.JarviceCluster) string {
+	if endpoint, err := url.Parse(cluster.Endpoint); err == nil &&
+		len(endpoint.Hostname()) > 0 {
+		return endpoint.Hostname()
+	}
+	return cluster.Endpoint
+}
+
+// Primary group of local user (NONE if unknown)
+func qAcctGroup(owner string, groups map[string]string) string {
+	if group, ok := groups[owner]; ok {
+		return group
+	}
+	groups[owner] = "NONE"
+	if account, err := user.Lookup(owner); err == nil {
+		if group, err := user.LookupGroupId(account.Gid); err == nil {
+			groups[owner] = group.Name
+		}
+	}
+	return groups[owner]
+}
+
+// Cores of job nodes (slots if machine type is unknown)
+func qAcctCores(machine jarvice.JarviceMachine, machines jarvice.JarviceMachines,
+	slots int) int {
+
+	info, ok := machines[machine.Type]
+	if !ok || info.Cores < 1 {
+		return slots
+	}
+	nodes := machine.Nodes
+	if nodes < 1 {
+		nodes = 1
+	}
+	slaveCores := info.SlaveCores
+	if slaveCores < 1 {
+		slaveCores = info.Cores
+	}
+	return info.Cores + slaveCores*(nodes-1)
+}
+
+// Read accounting records of completed JARVICE jobs submitted to queues
+func qAcctReadRecords(cluster jarvice.JarviceCluster) ([]qAcctRecord, error) {
+	jarviceJobs, requests, err := jarvice.ReadJarviceJobs(cluster, true)
+	if err != nil {
+		return nil, err
+	}
+	// machine types are only used for CPU time
+	machines, err := jarvice.GetJarviceMachines(cluster)
+	if err != nil {
+		machines = jarvice.JarviceMachines{}
+	}
+	hostname := qAcctHostname(cluster)
+	groups := map[string]string{}
+	records := []qAcctRecord{}
+	for number, job := range jarviceJobs {
+		// Only HPC jobs that have completed
+		if job.EndTime == 0 || len(job.ApiSubmission.Queue) == 0 {
+			continue
+		}
+		request := requests[number]
+		record := qAcctRecord{
+			Queue:      job.ApiSubmission.Queue,
+			Hostname:   hostname,
+			Group:      qAcctGroup(job.User, groups),
+			Owner:      job.User,
+			Project:    sgeProject(request),
+			Name:       job.Label,
+			Id:         number,
+			Task:       "undefined",
+			Account:    "sge",
+			SubmitTime: int64(job.SubmitTime),
+			StartTime:  int64(job.StartTime),
+			EndTime:    int64(job.EndTime),
+			Pe:         "NONE",
+			Slots:      sgeSlots(request),
+			ExitStatus: job.ExitCode,
+			Wallclock:  job.Elapsed(time.Now()),
+			Number:     number,
+			Machine:    job.ApiSubmission.Machine.Type,
+			Nodes:      job.ApiSubmission.Machine.Nodes,
+			Resources:  map[string]string{},
+		}
+		// failed only if the job never started (exit status is kept
+		// in exit_status), e.g. canceled while queued
+		if job.StartTime == 0 {
+			record.Failed = 1
+		}
+		// array tasks are accounted with job ID of array job
+		if id, err := strconv.Atoi(request.Hpc.Envs["JOB_ID"]); err == nil {
+			record.Id = id
+		}
+		if task := request.Hpc.Envs["SGE_TASK_ID"]; len(task) > 0 {
+			record.Task = task
+		}
+		if pe := request.Hpc.Envs["PE"]; len(pe) > 0 {
+			record.Pe = pe
+		}
+		if record.Nodes < 1 {
+			record.Nodes = 1
+		}
+		record.Cores = qAcctCores(job.ApiSubmission.Machine, machines, record.Slots)
+		// CPU time of all cores of job nodes (system time is not reported)
+		record.Cpu = float64(record.Wallclock) * float64(record.Cores)
+		record.Utime = record.Cpu
+		for _, resource := range sgeHardResources(request) {
+			record.Resources[resource[0]] = resource[1]
+		}
+		records = append(records, record)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Id != records[j].Id {
+			return records[i].Id < records[j].Id
+		}
+		return records[i].Number < records[j].Number
+	})
+	return records, nil
+}
+
+// Record matches resource request (qacct -l)
+// qsub resource names (cpu, h_rss) are compared as requested by qsub
+func (record qAcctRecord) requested(resources map[string]string) bool {
+	for name, value := range resources {
+		switch name {
+		case "cpu":
+			name = "mc_cores"
+		case "h_rss":
+			name = "mc_ram"
+			if mem, err := decodeMemReq(value); err == nil {
+				value = strconv.Itoa(mem)
+			}
+		case "mc_project":
+			if record.Project != value {
+				return false
+			}
+			continue
+		}
+		if record.Resources[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Time window of considered jobs (qacct -d, -b, -e)
+func (x *QAcctCommand) window(now time.Time) (begin, end time.Time, err error) {
+	if x.Days > 0 {
+		begin = now.Add(-time.Duration(x.Days) * 24 * time.Hour)
+	}
+	if len(x.Begin) > 0 {
+		if begin, err = parseSgeDateTime(x.Begin, now); err != nil {
+			return
+		}
+	}
+	if len(x.End) > 0 {
+		end, err = parseSgeDateTime(x.End, now)
+	}
+	return
+}
+
+// Filter records by owner, queue, project, time window and resources
+func (x *QAcctCommand) filter(records []qAcctRecord) ([]qAcctRecord, error) {
+	begin, end, err := x.window(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	resources := parseSgeResources(x.Resources)
+	// queue instances (queue@host) select cluster queue
+	queue := strings.SplitN(x.Queue, "@", 2)[0]
+	ret := []qAcctRecord{}
+	for _, record := range records {
+		started := time.Unix(record.StartTime, 0)
+		if record.StartTime == 0 {
+			started = time.Unix(record.EndTime, 0)
+		}
+		switch {
+		case len(x.Owner) > 0 && record.Owner != x.Owner:
+		case len(queue) > 0 && record.Queue != queue:
+		case len(x.Project) > 0 && record.Project != x.Project:
+		case !begin.IsZero() && started.Before(begin):
+		case !end.IsZero() && !started.Before(end):
+		case !record.requested(resources):
+		default:
+			ret = append(ret, record)
+		}
+	}
+	return ret, nil
+}
+
+// Select records of job IDs, job names or job name patterns (qacct -j)
+func qAcctMatchJobs(records []qAcctRecord, list string) ([]qAcctRecord, error) {
+	if list == "*" {
+		return records, nil
+	}
+	ret := []qAcctRecord{}
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); len(entry) == 0 {
+			continue
+		}
+		found := false
+		id, err := strconv.Atoi(entry)
+		for _, record := range records {
+			match := false
+			if err == nil {
+				match = record.Id == id || record.Number == id
+			} else {
+				match, _ = path.Match(entry, record.Name)
+			}
+			if match {
+				found = true
+				ret = append(ret, record)
+			}
+		}
+		if !found && err == nil {
+			return nil, errors.New("job id " + entry + " not found")
+		} else if !found {
+			return nil, errors.New("job name " + entry + " not found")
+		}
+	}
+	return ret, nil
+}
+
+func qAcctTime(epoch int64) string {
+	if epoch == 0 {
+		return "-/-"
+	}
+	return time.Unix(epoch, 0).Format(time.ANSIC)
+}
+
+func qAcctPrintJob(record qAcctRecord) {
+	fields := [][2]string{
+		{"qname", record.Queue},
+		{"hostname", record.Hostname},
+		{"group", record.Group},
+		{"owner", record.Owner},
+		{"project", record.Project},
+		{"department", "defaultdepartment"},
+		{"jobname", record.Name},
+		{"jobnumber", strconv.Itoa(record.Id)},
+		{"taskid", record.Task},
+		{"account", record.Account},
+		{"priority", "0"},
+		{"qsub_time", qAcctTime(record.SubmitTime)},
+		{"start_time", qAcctTime(record.StartTime)},
+		{"end_time", qAcctTime(record.EndTime)},
+		{"granted_pe", record.Pe},
+		{"slots", strconv.Itoa(record.Slots)},
+		{"failed", strconv.Itoa(record.Failed)},
+		{"exit_status", strconv.Itoa(record.ExitStatus)},
+		{"ru_wallclock", fmt.Sprintf("%ds", record.Wallclock)},
+		{"ru_utime", fmt.Sprintf("%.3fs", record.Utime)},
+		{"ru_stime", fmt.Sprintf("%.3fs", record.Stime)},
+		{"cpu", fmt.Sprintf("%.3fs", record.Cpu)},
+		{"mem", "0.000GBs"},
+		{"io", "0.000GB"},
+		{"iow", "0.000s"},
+		{"maxvmem", "0.000B"},
+	}
+	fmt.Println(qAcctSeparator)
+	for _, field := range fields {
+		fmt.Printf("%-13s%s\n", field[0], field[1])
+	}
+}
+
+// Usage summary (WALLCLOCK, UTIME, STIME, CPU, MEMORY, IO, IOW), one line
+// per owner, queue and project if selected by -o, -q or -P
+func (x *QAcctCommand) printSummary(records []qAcctRecord) {
+	type usage struct {
+		Keys      []string
+		Wallclock int64
+		Utime     float64
+		Stime     float64
+		Cpu       float64
+	}
+	columns := []string{}
+	keys := []func(qAcctRecord) string{}
+	if len(x.Queue) > 0 {
+		columns = append(columns, "CLUSTER QUEUE")
+		keys = append(keys, func(record qAcctRecord) string { return record.Queue })
+	}
+	if len(x.Owner) > 0 {
+		columns = append(columns, "OWNER")
+		keys = append(keys, func(record qAcctRecord) string { return record.Owner })
+	}
+	if len(x.Project) > 0 {
+		columns = append(columns, "PROJECT")
+		keys = append(keys, func(record qAcctRecord) string { return record.Project })
+	}
+	lines := []*usage{}
+	index := map[string]*usage{}
+	for _, record := range records {
+		values := []string{}
+		for _, key := range keys {
+			values = append(values, key(record))
+		}
+		line, ok := index[strings.Join(values, "\x00")]
+		if !ok {
+			line = &usage{Keys: values}
+			index[strings.Join(values, "\x00")] = line
+			lines = append(lines, line)
+		}
+		line.Wallclock += record.Wallclock
+		line.Utime += record.Utime
+		line.Stime += record.Stime
+		line.Cpu += record.Cpu
+	}
+	if len(columns) == 0 {
+		fmt.Println("Total System Usage")
+		if len(lines) == 0 {
+			lines = append(lines, &usage{})
+		}
+	}
+	header := ""
+	for _, column := range columns {
+		header += fmt.Sprintf("%-13.13s ", column)
+	}
+	header += fmt.Sprintf("%13s%14s%14s%14s%19s%19s%19s",
+		"WALLCLOCK", "UTIME", "STIME", "CPU", "MEMORY", "IO", "IOW")
+	fmt.Println(header)
+	fmt.Println(strings.Repeat("=", len(header)))
+	for _, line := range lines {
+		row := ""
+		for _, key := range line.Keys {
+			row += fmt.Sprintf("%-13.13s ", key)
+		}
+		fmt.Printf("%s%13d%14.3f%14.3f%14.3f%19.3f%19.3f%19.3f\n", row,
+			line.Wallclock, line.Utime, line.Stime, line.Cpu, 0.0, 0.0, 0.0)
+	}
+}
+
+// Export accounting records for chargeback (times are epoch seconds)
+func qAcctPrintCsv(records []qAcctRecord) error {
+	writer := csv.NewWriter(os.Stdout)
+	writer.Write([]string{"qname", "hostname", "group", "owner", "project",
+		"jobname", "jobnumber", "taskid", "account", "qsub_time",
+		"start_time", "end_time", "granted_pe", "slots", "failed",
+		"exit_status", "ru_wallclock", "ru_utime", "ru_stime", "cpu",
+		"jarvice_job_number", "machine", "nodes", "cores"})
+	for _, record := range records {
+		writer.Write([]string{record.Queue, record.Hostname, record.Group,
+			record.Owner, record.Project, record.Name,
+			strconv.Itoa(record.Id), record.Task, record.Account,
+			strconv.FormatInt(record.SubmitTime, 10),
+			strconv.FormatInt(record.StartTime, 10),
+			strconv.FormatInt(record.EndTime, 10),
+			record.Pe, strconv.Itoa(record.Slots),
+			strconv.Itoa(record.Failed), strconv.Itoa(record.ExitStatus),
+			strconv.FormatInt(record.Wallclock, 10),
+			strconv.FormatFloat(record.Utime, 'f', 3, 64),
+			strconv.FormatFloat(record.Stime, 'f', 3, 64),
+			strconv.FormatFloat(record.Cpu, 'f', 3, 64),
+			strconv.Itoa(record.Number), record.Machine,
+			strconv.Itoa(record.Nodes), strconv.Itoa(record.Cores)})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func qAcctPrintJson(records []qAcctRecord) error {
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
 }
 
 func (x *QAcctCommand) Execute(args []string) error {
 	if x.Help {
 		return jarvice.CreateHelpErr()
 	}
+	// optional -j argument is not attached to the option
+	if x.Jobs == "*" && len(args) > 0 {
+		x.Jobs, args = args[0], args[1:]
+	}
+	if len(args) > 0 {
+		return jarvice.CreateHelpErr()
+	}
 	// Read JARVICE config for selected cluster
 	cluster, err := jarvice.GetClusterConfig()
 	if err != nil {
-		return &jarvice.SgeError {
+		return &jarvice.SgeError{
 			Command: "qacct",
-			Err: err,
-		}
-	}
-	// need JARVICE API creds and 'completed' for /jarvice/jobs request
-	urlValues := cluster.GetUrlCreds()
-	urlValues.Add("completed", "true")
-	if resp, err := jarvice.ApiReq(cluster.Endpoint,
-		"jobs",
-		cluster.Insecure,
-		urlValues); err == nil {
-		var jarviceJobs jarvice.JarviceJobs
-		if err := json.Unmarshal(resp, &jarviceJobs); err != nil {
-			return &jarvice.SgeError {
-				Command: "qacct",
-				Err: errors.New("cannot read response"),
-			}
+			Err:     err,
+		}
+	}
+	records, err := qAcctReadRecords(cluster)
+	if err == nil {
+		records, err = x.filter(records)
+	}
+	if err == nil && len(x.Jobs) > 0 {
+		records, err = qAcctMatchJobs(records, x.Jobs)
+	}
+	if err != nil {
+		return &jarvice.SgeError{
+			Command: "qacct",
+			Err:     err,
 		}
-		for index, val := range jarviceJobs {
-			qAcctPrintJob(index, val)
+	}
+	switch {
+	case x.Csv:
+		err = qAcctPrintCsv(records)
+	case x.Json:
+		err = qAcctPrintJson(records)
+	case len(x.Jobs) > 0:
+		for _, record := range records {
+			qAcctPrintJob(record)
 		}
-		return nil
+	default:
+		x.printSummary(records)
 	}
-	return &jarvice.SgeError {
-		Command: "qacct",
-		Err: errors.New("HTTP error"),
+	if err != nil {
+		return &jarvice.SgeError{
+			Command: "qacct",
+			Err:     err,
+		}
 	}
+	return nil
 }
 
 func init() {
@@ -1,49 +1,215 @@
 package main
 
 import (
-	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
 	jarvice "jarvice.io/jarvice-hpc/core"
 )
 
 type QDelCommand struct {
-	Help  bool `short:"h" long:"help" description:"Show this help message"`
-	Force bool `short:"f" description:"force job deletion"`
+	Help  bool     `short:"h" long:"help" description:"Show this help message"`
+	Force bool     `short:"f" description:"force job deletion"`
+	Users []string `short:"u" description:"Deletes jobs of the users\nuser[,user,...] | *"`
 	Args  struct {
-		JobNumber string `positional-arg-name:"number" description:"job number"`
-	} `positional-args:"true" required:"1"`
+		Jobs []string `positional-arg-name:"job" description:"job ID[.task range], job name or job name pattern (task range: n[-m[:s]])"`
+	} `positional-args:"true"`
 }
 
 var qDelCommand QDelCommand
 
+// Job selected for deletion
+// Tasks are only set for task ranges of array jobs
+type qdelTarget struct {
+	Id    int
+	Array bool
+	Tasks []int
+}
+
+// Resolve job list entry against active jobs
+// Returns false if entry matches no job
+func qdelResolve(jobs []qstatJob, entry string) ([]qdelTarget, bool, error) {
+	re := regexp.MustCompile(`^([0-9]+)(\.(.+))?$`)
+	match := re.FindStringSubmatch(entry)
+	ids := []int{}
+	if match == nil {
+		// job name or job name pattern
+		seen := map[int]bool{}
+		for _, job := range jobs {
+			if ok, _ := path.Match(entry, job.Name); ok && !seen[job.Id] {
+				seen[job.Id] = true
+				ids = append(ids, job.Id)
+			}
+		}
+	} else {
+		id, _ := strconv.Atoi(match[1])
+		for _, job := range jobs {
+			if job.Id == id {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil, false, nil
+	}
+	targets := []qdelTarget{}
+	for _, id := range ids {
+		array, ok := jarvice.FindArrayJob(id)
+		target := qdelTarget{Id: id, Array: ok}
+		if match == nil || len(match[3]) == 0 {
+			targets = append(targets, target)
+			continue
+		}
+		if !ok {
+			return nil, false, nil
+		}
+		first, last, step, err := jarvice.ParseTaskRange(match[3])
+		if err != nil {
+			return nil, false, err
+		}
+		// tasks held on the client or still running
+		selected := map[int]bool{}
+		for _, task := range jarvice.TaskRangeIds(first, last, step) {
+			selected[task] = true
+		}
+		for _, task := range array.Tasks {
+			if selected[task.Task] && (task.Held() || (task.Number > 0 && !task.Done)) {
+				target.Tasks = append(target.Tasks, task.Task)
+			}
+		}
+		if len(target.Tasks) == 0 {
+			return nil, false, nil
+		}
+		targets = append(targets, target)
+	}
+	return targets, true, nil
+}
+
+// Select jobs of job list entries and users
+// Returns job list entries matching no job
+func (x *QDelCommand) targets(jobs []qstatJob) ([]qdelTarget, []string, error) {
+	jobs = qstatFilterUsers(jobs, x.Users)
+	targets := []qdelTarget{}
+	unknown := []string{}
+	if len(x.Args.Jobs) == 0 {
+		// all jobs of users (-u)
+		seen := map[int]bool{}
+		for _, job := range jobs {
+			if !seen[job.Id] {
+				seen[job.Id] = true
+				_, array := jarvice.FindArrayJob(job.Id)
+				targets = append(targets, qdelTarget{Id: job.Id, Array: array})
+			}
+		}
+		sort.Slice(targets, func(i, j int) bool { return targets[i].Id < targets[j].Id })
+		return targets, unknown, nil
+	}
+	deleted := map[int]bool{}
+	for _, arg := range x.Args.Jobs {
+		for _, entry := range strings.Split(arg, ",") {
+			if entry = strings.TrimSpace(entry); len(entry) == 0 {
+				continue
+			}
+			resolved, ok, err := qdelResolve(jobs, entry)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !ok {
+				unknown = append(unknown, entry)
+			}
+			// jobs listed twice (e.g. by ID and name) are deleted once
+			for _, target := range resolved {
+				if len(target.Tasks) > 0 || !deleted[target.Id] {
+					deleted[target.Id] = len(target.Tasks) == 0
+					targets = append(targets, target)
+				}
+			}
+		}
+	}
+	return targets, unknown, nil
+}
+
 func (x *QDelCommand) Execute(args []string) error {
 	if x.Help {
 		return jarvice.CreateHelpErr()
 	}
+	if len(x.Args.Jobs) == 0 && len(x.Users) == 0 {
+		return jarvice.CreateHelpErr()
+	}
 	cluster, err := jarvice.GetClusterConfig()
 	if err != nil {
-		return &jarvice.SgeError {
+		return &jarvice.SgeError{
 			Command: "qdel",
-			Err: err,
+			Err:     err,
 		}
 	}
-	urlValues := cluster.GetUrlCreds()
-	urlValues.Add("number", x.Args.JobNumber)
-	api := "shutdown"
-	if x.Force {
-		api = "terminate"
+	jobs, err := qstatReadJobs(cluster, false)
+	if err != nil {
+		return &jarvice.SgeError{
+			Command: "qdel",
+			Err:     err,
+		}
 	}
-	if _, err := jarvice.ApiReq(cluster.Endpoint,
-		api,
-		cluster.Insecure,
-		urlValues); err == nil {
-
-		return nil
+	targets, unknown, err := x.targets(jobs)
+	if err != nil {
+		return &jarvice.SgeError{
+			Command: "qdel",
+			Err:     err,
+		}
+	}
+	user := cluster.Creds.Username
+	failed := len(unknown) > 0
+	for _, entry := range unknown {
+		fmt.Printf("denied: job \"%s\" does not exist\n", entry)
+	}
+	// jobs are canceled in parallel, array jobs one by one
+	numbers := []int{}
+	for _, target := range targets {
+		if !target.Array {
+			numbers = append(numbers, target.Id)
+		}
+	}
+	results := map[int]error{}
+	for _, result := range jarvice.CancelJobs(cluster, numbers, x.Force) {
+		results[result.Id] = result.Err
+	}
+	for _, target := range targets {
+		if !target.Array {
+			switch err := results[target.Id]; {
+			case err != nil:
+				fmt.Printf("denied: job \"%d\" cannot be deleted: %v\n", target.Id, err)
+				failed = true
+			case target.Id >= jarvice.DeferredJobIdBase:
+				// jobs held on the client (-a, -hold_jid) are removed
+				fmt.Printf("%s has deleted job %d\n", user, target.Id)
+			default:
+				fmt.Printf("%s has registered the job %d for deletion\n", user, target.Id)
+			}
+			continue
+		}
+		// held tasks are removed on the client
+		if err := jarvice.DeleteArrayTasks(cluster, target.Id, target.Tasks, x.Force); err != nil {
+			fmt.Printf("denied: job \"%d\" cannot be deleted: %v\n", target.Id, err)
+			failed = true
+			continue
+		}
+		if len(target.Tasks) == 0 {
+			fmt.Printf("%s has registered the job %d for deletion\n", user, target.Id)
+		}
+		for _, task := range target.Tasks {
+			fmt.Printf("%s has registered the job-array task %d.%d for deletion\n",
+				user, target.Id, task)
+		}
 	}
-	return &jarvice.SgeError {
-		Command: "qdel",
-		Err: errors.New("HTTP error"),
+	if failed {
+		return &jarvice.ExitError{Code: 1}
 	}
+	return nil
 }
 
 func init() {
@@ -2,9 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"os"
+	"path"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	jarvice "jarvice.io/jarvice-hpc/core"
@@ -12,9 +17,15 @@ import (
 
 type QStatCommand struct {
 	Help bool `short:"h" long:"help" description:"Show this help message"`
-	// user JARVICE config credentials for API requests (ignore Username option)
-	// Username string `short:"u" description:"username"`
-	Cluster string `short:"c" long:"cluster" description:"cluster name" default:"default"`
+	// user JARVICE config credentials for API requests
+	Cluster   string   `short:"c" long:"cluster" description:"cluster name (default: target of jarvice login)"`
+	Jobs      string   `short:"j" description:"Prints various information for the jobs contained in job_list\njob_list: job IDs, job names or job name patterns, comma separated"`
+	Users     []string `short:"u" description:"Display information only on those jobs being associated with the users from the given user list\nuser[,user,...] | *"`
+	States    string   `short:"s" description:"Prints only jobs in the specified state (default: pr)\np (pending), r (running), s (suspended), z (finished), h (hold), a (all: prs), e.g. -s pr"`
+	Full      bool     `short:"f" description:"Specifies a \"full\" format display of information (queue-centric view)"`
+	Resources bool     `short:"r" description:"Prints extended information about the resource requirements of the displayed jobs"`
+	Extended  bool     `long:"ext" description:"Displays additional information for each job related to the job ticket policy scheme"`
+	Xml       bool     `long:"xml" description:"Display the information in XML-Format"`
 }
 
 var qStatCommand QStatCommand
@@ -24,67 +35,999 @@ func sgeVersion() {
 	return
 }
 
+// XML schemas of qstat output
+const (
+	qstatXsd          = "http://arc.liv.ac.uk/repos/darcs/sge/source/dist/util/resources/schemas/qstat/qstat.xsd"
+	qstatDetailedXsd  = "http://arc.liv.ac.uk/repos/darcs/sge/source/dist/util/resources/schemas/qstat/detailed_job_info.xsd"
+	qstatTimeFormat   = "01/02/2006 15:04:05"
+	qstatXmlTimeForm  = "2006-01-02T15:04:05"
+	qstatJobSeparator = "=============================================================="
+)
+
+// Environment set by qsub (not shown in qstat -j env_list)
+var qstatJobEnvs = map[string]struct{}{
+	"JOB_ID":            struct{}{},
+	"NHOSTS":            struct{}{},
+	"NSLOTS":            struct{}{},
+	"PE":                struct{}{},
+	"PE_HOSTFILE":       struct{}{},
+	"SGE_TASK_FIRST":    struct{}{},
+	"SGE_TASK_ID":       struct{}{},
+	"SGE_TASK_LAST":     struct{}{},
+	"SGE_TASK_STEPSIZE": struct{}{},
+}
+
+// JARVICE job, job held on the client or held array tasks (task range)
+type qstatJob struct {
+	Id int
+	// first task of ja-task-ID (sorting)
+	Task    int
+	TaskIds string
+	// JARVICE job number (0 if held on the client)
+	Number  int
+	Name    string
+	User    string
+	State   string
+	Submit  time.Time
+	Start   time.Time
+	Queue   string
+	Request jarvice.JarviceJobRequest
+	Hold    []int
+	Error   string
+}
+
+func (job qstatJob) pending() bool {
+	return strings.HasSuffix(job.State, "qw")
+}
+
+func (job qstatJob) running() bool {
+	return !job.pending() && job.State != "z"
+}
+
+// Submit time of pending jobs, start time of running jobs
+func (job qstatJob) time() time.Time {
+	if job.running() && !job.Start.IsZero() {
+		return job.Start
+	}
+	return job.Submit
+}
+
+func (job qstatJob) slots() int {
+	return sgeSlots(job.Request)
+}
+
+func (job qstatJob) project() string {
+	return sgeProject(job.Request)
+}
+
+// Slots of job request (qsub -pe)
+func sgeSlots(req jarvice.JarviceJobRequest) int {
+	if slots, err := strconv.Atoi(req.Hpc.Envs["NSLOTS"]); err == nil {
+		return slots
+	}
+	return 1
+}
+
+// Project of job request (qsub -P)
+func sgeProject(req jarvice.JarviceJobRequest) string {
+	if req.JobProject != nil && len(*req.JobProject) > 0 {
+		return *req.JobProject
+	}
+	return "NA"
+}
+
+// Job is selected by state list (qstat -s)
+func (job qstatJob) selected(states string) bool {
+	if len(states) == 0 {
+		states = "pr"
+	}
+	for _, state := range states {
+		switch state {
+		case 'p':
+			if job.pending() {
+				return true
+			}
+		case 'r':
+			if job.running() {
+				return true
+			}
+		case 'z':
+			if job.State == "z" {
+				return true
+			}
+		case 'h':
+			if strings.HasPrefix(job.State, "h") {
+				return true
+			}
+		case 'a':
+			if job.State != "z" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Hard resources of job request (qstat -r, -j)
+func (job qstatJob) hardResources() [][2]string {
+	return sgeHardResources(job.Request)
+}
+
+// Hard resources of job request (qsub -l)
+func sgeHardResources(req jarvice.JarviceJobRequest) [][2]string {
+	resources := [][2]string{}
+	for _, name := range []string{"mc_name", "mc_cores", "mc_ram"} {
+		if val := req.Hpc.Resources[name]; len(val) > 0 && val != "0" {
+			resources = append(resources, [2]string{name, val})
+		}
+	}
+	if req.Licenses != nil && len(*req.Licenses) > 0 {
+		resources = append(resources, [2]string{"mc_licenses", *req.Licenses})
+	}
+	return resources
+}
+
+func qstatParseStates(states string) error {
+	for _, state := range states {
+		if !strings.ContainsRune("prszha", state) {
+			return errors.New("invalid job state: " + states)
+		}
+	}
+	return nil
+}
+
+// Read JARVICE jobs, jobs held on the client and held array tasks
+// Finished jobs are only read if zombies is set (qstat -s z)
+func qstatReadJobs(cluster jarvice.JarviceCluster, zombies bool) ([]qstatJob, error) {
+	var jarviceJobs jarvice.JarviceJobs
+	var requests map[int]jarvice.JarviceJobRequest
+	var err error
+	if zombies {
+		jarviceJobs, requests, err = jarvice.ReadAllJarviceJobs(cluster)
+	} else {
+		jarviceJobs, requests, err = jarvice.ReadJarviceJobs(cluster, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	jobs := []qstatJob{}
+	arrayTasks := jarvice.ReadArrayJobTasks()
+	for number, job := range jarviceJobs {
+		// Only show jobs from queue
+		if len(job.ApiSubmission.Queue) == 0 {
+			continue
+		}
+		state := job.State()
+		// finished jobs are not shown
+		if state.Terminal && !zombies {
+			continue
+		}
+		row := qstatJob{
+			Id:      number,
+			Number:  number,
+			Name:    job.Label,
+			User:    job.User,
+			State:   state.Sge,
+			Submit:  time.Unix(int64(job.SubmitTime), 0),
+			Queue:   job.ApiSubmission.Queue,
+			Request: requests[number],
+		}
+		if state.Terminal {
+			row.State = "z"
+		}
+		if job.StartTime > 0 {
+			row.Start = time.Unix(int64(job.StartTime), 0)
+		}
+		if arrayTask, ok := arrayTasks[number]; ok {
+			row.Id, row.Task, row.TaskIds = arrayTask.Id, arrayTask.Task,
+				strconv.Itoa(arrayTask.Task)
+		}
+		jobs = append(jobs, row)
+	}
+	// jobs held on the client (e.g. -a)
+	if deferredJobs, err := jarvice.ReadDeferredJobs(); err == nil {
+		for _, job := range deferredJobs {
+			if !job.Local() {
+				continue
+			}
+			row := qstatJob{
+				Id:      job.Id,
+				Name:    job.Request.JobLabel,
+				User:    job.Request.User.Username,
+				State:   "qw",
+				Submit:  time.Unix(job.SubmitTime, 0),
+				Queue:   job.Request.Hpc.Queue,
+				Request: job.Request,
+				Hold:    job.Hold,
+				Error:   job.Error,
+			}
+			if len(job.Error) > 0 {
+				row.State = "Eqw"
+			} else if len(job.Hold) > 0 {
+				// waiting for dependencies (-hold_jid)
+				row.State = "hqw"
+			}
+			jobs = append(jobs, row)
+		}
+	}
+	// array tasks held on the client (task ranges)
+	if arrayJobs, err := jarvice.ReadArrayJobs(); err == nil {
+		for _, job := range arrayJobs {
+			held, waiting, failed := []int{}, []int{}, []int{}
+			reason := ""
+			for _, task := range job.Tasks {
+				if task.Held() && (task.Waiting || len(job.Hold) > 0) {
+					waiting = append(waiting, task.Task)
+				} else if task.Held() {
+					held = append(held, task.Task)
+				} else if task.Number == 0 && len(task.Error) > 0 {
+					failed = append(failed, task.Task)
+					reason = task.Error
+				}
+			}
+			for _, tasks := range []struct {
+				State string
+				Ids   []int
+			}{{"qw", held}, {"hqw", waiting}, {"Eqw", failed}} {
+				if len(tasks.Ids) == 0 {
+					continue
+				}
+				row := qstatJob{
+					Id:      job.Id,
+					Task:    tasks.Ids[0],
+					TaskIds: jarvice.FormatTaskRanges(tasks.Ids),
+					Name:    job.Request.JobLabel,
+					User:    job.Request.User.Username,
+					State:   tasks.State,
+					Submit:  time.Unix(job.SubmitTime, 0),
+					Queue:   job.Request.Hpc.Queue,
+					Request: job.Request,
+					Hold:    append(append([]int{}, job.Hold...), job.HoldArray...),
+				}
+				if tasks.State == "Eqw" {
+					row.Error = reason
+				}
+				jobs = append(jobs, row)
+			}
+		}
+	}
+	sort.SliceStable(jobs, func(i, j int) bool {
+		if jobs[i].Id != jobs[j].Id {
+			return jobs[i].Id < jobs[j].Id
+		}
+		return jobs[i].Task < jobs[j].Task
+	})
+	return jobs, nil
+}
+
+// Jobs of users in user list (qstat -u, all users if not set or *)
+func qstatFilterUsers(jobs []qstatJob, lists []string) []qstatJob {
+	users := map[string]bool{}
+	for _, list := range lists {
+		for _, user := range strings.Split(list, ",") {
+			if user = strings.TrimSpace(user); len(user) > 0 {
+				users[user] = true
+			}
+		}
+	}
+	if len(users) == 0 || users["*"] {
+		return jobs
+	}
+	ret := []qstatJob{}
+	for _, job := range jobs {
+		if users[job.User] {
+			ret = append(ret, job)
+		}
+	}
+	return ret
+}
+
+// Jobs matching job list (job IDs, job names or job name patterns)
+// Returns job list entries matching no job
+func qstatMatchJobs(jobs []qstatJob, list string) ([]qstatJob, []string) {
+	ret := []qstatJob{}
+	unknown := []string{}
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); len(entry) == 0 {
+			continue
+		}
+		found := false
+		id, err := strconv.Atoi(entry)
+		for _, job := range jobs {
+			match := false
+			if err == nil {
+				match = job.Id == id
+			} else {
+				match, _ = path.Match(entry, job.Name)
+			}
+			if match {
+				found = true
+				ret = append(ret, job)
+			}
+		}
+		if !found {
+			unknown = append(unknown, entry)
+		}
+	}
+	return ret, unknown
+}
+
+// Job line of fixed width formats (qstat -f, -r)
+func qstatJobLine(job qstatJob, queue bool) string {
+	queueName := ""
+	if queue && job.running() {
+		queueName = job.Queue
+	}
+	return strings.TrimRight(fmt.Sprintf("%7d %7.5f %-10.10s %-12.12s %-5s %-19s %-30s %5d %s",
+		job.Id, 0.0, job.Name, job.User, job.State, job.time().Format(qstatTimeFormat),
+		queueName, job.slots(), job.TaskIds), " ")
+}
+
+// Requested resources of job (qstat -r)
+func qstatResourceLines(job qstatJob) []string {
+	lines := []string{"       Full jobname:     " + job.Name}
+	if job.running() {
+		lines = append(lines, "       Master Queue:     "+job.Queue)
+	}
+	if pe, ok := job.Request.Hpc.Envs["PE"]; ok {
+		lines = append(lines, "       Requested PE:     "+pe+" "+strconv.Itoa(job.slots()))
+		if job.running() {
+			lines = append(lines, "       Granted PE:       "+pe+" "+strconv.Itoa(job.slots()))
+		}
+	}
+	resources := []string{}
+	for _, resource := range job.hardResources() {
+		resources = append(resources, resource[0]+"="+resource[1]+" (0.000000)")
+	}
+	lines = append(lines, "       Hard Resources:   "+strings.Join(resources, "\n                         "),
+		"       Soft Resources:   ",
+		"       Hard requested queues: "+job.Request.Hpc.Queue)
+	return lines
+}
+
+// Print job table (default format, -ext)
+func (x *QStatCommand) printTable(jobs []qstatJob) {
+	header := []string{"job-ID", "prior", "name", "user", "state", "submit/start at",
+		"queue", "slots", "ja-task-ID"}
+	if x.Extended {
+		header = []string{"job-ID", "prior", "ntckts", "name", "user", "project",
+			"department", "state", "cpu", "mem", "io", "tckts", "ovrts", "otckt",
+			"ftckt", "stckt", "share", "queue", "slots", "ja-task-ID"}
+	}
+	table := [][]string{header}
+	for _, job := range jobs {
+		queue := job.Queue
+		if job.State == "z" {
+			queue = ""
+		}
+		if x.Extended {
+			table = append(table, []string{strconv.Itoa(job.Id), "0", "0.00000",
+				job.Name, job.User, job.project(), "defaultdepartment", job.State,
+				"NA", "NA", "NA", "0", "0", "0", "0", "0", "0.00", queue,
+				strconv.Itoa(job.slots()), job.TaskIds})
+			continue
+		}
+		table = append(table, []string{strconv.Itoa(job.Id),
+			"0",
+			job.Name,
+			job.User,
+			job.State,
+			job.time().Format(time.UnixDate),
+			queue,
+			strconv.Itoa(job.slots()),
+			job.TaskIds})
+	}
+	jarvice.PrintTable(table, true)
+}
+
+// Print jobs with requested resources (qstat -r)
+func (x *QStatCommand) printResources(jobs []qstatJob) {
+	fmt.Printf("%-7s %-7s %-10s %-12s %-5s %-19s %-30s %-5s %s\n", "job-ID", "prior",
+		"name", "user", "state", "submit/start at", "queue", "slots", "ja-task-ID")
+	fmt.Println(strings.Repeat("-", 118))
+	for _, job := range jobs {
+		fmt.Println(qstatJobLine(job, true))
+		for _, line := range qstatResourceLines(job) {
+			fmt.Println(line)
+		}
+	}
+}
+
+// Queue of queue-centric view (qstat -f)
+type qstatQueue struct {
+	Name  string
+	Used  int
+	Total int
+	Jobs  []qstatJob
+}
+
+// Queues with running jobs (best effort: queues of running jobs are shown
+// if queues cannot be read)
+func qstatQueues(cluster jarvice.JarviceCluster, jobs []qstatJob) []qstatQueue {
+	queues := map[string]*qstatQueue{}
+	urlValues := cluster.GetUrlCreds()
+	urlValues.Add("info", "true")
+	if resp, err := jarvice.ApiReq(cluster.Endpoint, "queues", cluster.Insecure,
+		urlValues); err == nil {
+		jarviceQueues := jarvice.JarviceQueues{}
+		if json.Unmarshal(resp, &jarviceQueues) == nil {
+			machines, _ := jarvice.GetJarviceMachines(cluster)
+			for _, queue := range jarviceQueues {
+				queues[queue.Name] = &qstatQueue{
+					Name:  queue.Name,
+					Total: queue.MachineScale * machines[queue.DefaultMachine].Cores,
+				}
+			}
+		}
+	}
+	for _, job := range jobs {
+		if !job.running() {
+			continue
+		}
+		queue, ok := queues[job.Queue]
+		if !ok {
+			queue = &qstatQueue{Name: job.Queue}
+			queues[job.Queue] = queue
+		}
+		queue.Used += job.slots()
+		queue.Jobs = append(queue.Jobs, job)
+	}
+	ret := []qstatQueue{}
+	for _, queue := range queues {
+		ret = append(ret, *queue)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+func qstatSection(title string) {
+	fmt.Println()
+	fmt.Println(strings.Repeat("#", 76))
+	fmt.Println(strings.TrimRight(strings.Repeat(" - "+title, 5), " "))
+	fmt.Println(strings.Repeat("#", 76))
+}
+
+// Print queue-centric view (qstat -f)
+func (x *QStatCommand) printFull(queues []qstatQueue, jobs []qstatJob) {
+	fmt.Printf("%-30s %-5s %-14s %-8s %-13s %s\n", "queuename", "qtype",
+		"resv/used/tot.", "load_avg", "arch", "states")
+	for _, queue := range queues {
+		fmt.Println(strings.Repeat("-", 81))
+		fmt.Printf("%-30s %-5s %-14s %-8s %s\n", queue.Name, "BIP",
+			fmt.Sprintf("0/%d/%d", queue.Used, queue.Total), "-NA-", "lx-amd64")
+		for _, job := range queue.Jobs {
+			fmt.Println(qstatJobLine(job, false))
+			if x.Resources {
+				for _, line := range qstatResourceLines(job) {
+					fmt.Println(line)
+				}
+			}
+		}
+	}
+	for _, section := range []struct {
+		Title string
+		Match func(qstatJob) bool
+	}{
+		{"PENDING JOBS", qstatJob.pending},
+		{"ZOMBIE JOBS", func(job qstatJob) bool { return job.State == "z" }},
+	} {
+		printed := false
+		for _, job := range jobs {
+			if !section.Match(job) {
+				continue
+			}
+			if !printed {
+				qstatSection(section.Title)
+				printed = true
+			}
+			fmt.Println(qstatJobLine(job, false))
+			if x.Resources {
+				for _, line := range qstatResourceLines(job) {
+					fmt.Println(line)
+				}
+			}
+		}
+	}
+}
+
+// Hard resource request (qstat -r -xml)
+type qstatXmlRequest struct {
+	Name         string `xml:"name,attr"`
+	Contribution string `xml:"resource_contribution,attr"`
+	Value        string `xml:",chardata"`
+}
+
+type qstatXmlPe struct {
+	Name  string `xml:"name,attr"`
+	Slots int    `xml:",chardata"`
+}
+
+// Job of qstat -xml (SGE qstat.xsd)
+type qstatXmlJob struct {
+	XMLName     xml.Name          `xml:"job_list"`
+	State       string            `xml:"state,attr"`
+	Number      int               `xml:"JB_job_number"`
+	Priority    string            `xml:"JAT_prio"`
+	Ntix        string            `xml:"JAT_ntix,omitempty"`
+	Name        string            `xml:"JB_name"`
+	Owner       string            `xml:"JB_owner"`
+	Project     string            `xml:"JB_project,omitempty"`
+	Department  string            `xml:"JB_department,omitempty"`
+	JobState    string            `xml:"state"`
+	StartTime   string            `xml:"JAT_start_time,omitempty"`
+	SubmitTime  string            `xml:"JB_submission_time,omitempty"`
+	CpuUsage    *string           `xml:"cpu_usage"`
+	MemUsage    *string           `xml:"mem_usage"`
+	IoUsage     *string           `xml:"io_usage"`
+	Tickets     *int              `xml:"tickets"`
+	Override    *int              `xml:"JB_override_tickets"`
+	Jobshare    *int              `xml:"JB_jobshare"`
+	Otickets    *int              `xml:"otickets"`
+	Ftickets    *int              `xml:"ftickets"`
+	Stickets    *int              `xml:"stickets"`
+	Share       *string           `xml:"JAT_share"`
+	Queue       string            `xml:"queue_name"`
+	Slots       int               `xml:"slots"`
+	Tasks       string            `xml:"tasks,omitempty"`
+	FullName    string            `xml:"full_job_name,omitempty"`
+	Requests    []qstatXmlRequest `xml:"hard_request"`
+	RequestedPe *qstatXmlPe       `xml:"requested_pe"`
+	GrantedPe   *qstatXmlPe       `xml:"granted_pe"`
+	HardQueue   string            `xml:"hard_req_queue,omitempty"`
+}
+
+type qstatXmlQueue struct {
+	XMLName xml.Name      `xml:"Queue-List"`
+	Name    string        `xml:"name"`
+	Qtype   string        `xml:"qtype"`
+	Used    int           `xml:"slots_used"`
+	Resv    int           `xml:"slots_resv"`
+	Total   int           `xml:"slots_total"`
+	Arch    string        `xml:"arch"`
+	Jobs    []qstatXmlJob `xml:"job_list"`
+}
+
+func (x *QStatCommand) xmlJob(job qstatJob, queue bool) qstatXmlJob {
+	ret := qstatXmlJob{
+		State:    "pending",
+		Number:   job.Id,
+		Priority: "0.00000",
+		Name:     job.Name,
+		Owner:    job.User,
+		JobState: job.State,
+		Slots:    job.slots(),
+		Tasks:    job.TaskIds,
+	}
+	switch {
+	case job.running():
+		ret.State = "running"
+		ret.StartTime = job.time().Format(qstatXmlTimeForm)
+		if queue {
+			ret.Queue = job.Queue
+		}
+	case job.State == "z":
+		ret.State = "zombie"
+		ret.SubmitTime = job.Submit.Format(qstatXmlTimeForm)
+	default:
+		ret.SubmitTime = job.Submit.Format(qstatXmlTimeForm)
+	}
+	if x.Extended {
+		na, share, zero := "NA", "0.00", 0
+		ret.Ntix = "0.00000"
+		ret.Project = job.project()
+		ret.Department = "defaultdepartment"
+		ret.CpuUsage, ret.MemUsage, ret.IoUsage = &na, &na, &na
+		ret.Tickets, ret.Override, ret.Jobshare = &zero, &zero, &zero
+		ret.Otickets, ret.Ftickets, ret.Stickets = &zero, &zero, &zero
+		ret.Share = &share
+	}
+	if x.Resources {
+		ret.FullName = job.Name
+		for _, resource := range job.hardResources() {
+			ret.Requests = append(ret.Requests, qstatXmlRequest{
+				Name:         resource[0],
+				Contribution: "0.000000",
+				Value:        resource[1],
+			})
+		}
+		if pe, ok := job.Request.Hpc.Envs["PE"]; ok {
+			ret.RequestedPe = &qstatXmlPe{Name: pe, Slots: job.slots()}
+			if job.running() {
+				ret.GrantedPe = ret.RequestedPe
+			}
+		}
+		ret.HardQueue = job.Request.Hpc.Queue
+	}
+	return ret
+}
+
+// Print jobs in XML format (qstat -xml, SGE qstat.xsd)
+func (x *QStatCommand) printXml(queues []qstatQueue, jobs []qstatJob) error {
+	var queueInfo struct {
+		XMLName xml.Name `xml:"queue_info"`
+		Queues  []qstatXmlQueue
+		Jobs    []qstatXmlJob
+	}
+	var jobInfo struct {
+		XMLName xml.Name `xml:"job_info"`
+		Jobs    []qstatXmlJob
+	}
+	if x.Full {
+		for _, queue := range queues {
+			xmlQueue := qstatXmlQueue{
+				Name:  queue.Name,
+				Qtype: "BIP",
+				Used:  queue.Used,
+				Total: queue.Total,
+				Arch:  "lx-amd64",
+			}
+			for _, job := range queue.Jobs {
+				xmlQueue.Jobs = append(xmlQueue.Jobs, x.xmlJob(job, true))
+			}
+			queueInfo.Queues = append(queueInfo.Queues, xmlQueue)
+		}
+	}
+	for _, job := range jobs {
+		if job.running() {
+			if !x.Full {
+				queueInfo.Jobs = append(queueInfo.Jobs, x.xmlJob(job, true))
+			}
+		} else {
+			jobInfo.Jobs = append(jobInfo.Jobs, x.xmlJob(job, false))
+		}
+	}
+	fmt.Println("<?xml version='1.0'?>")
+	fmt.Printf("<job_info  xmlns:xsd=\"%s\">\n", qstatXsd)
+	for _, info := range []interface{}{queueInfo, jobInfo} {
+		out, err := xml.MarshalIndent(info, "  ", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+	}
+	fmt.Println("</job_info>")
+	return nil
+}
+
+// Detailed job information (qstat -j)
+type qstatDetail struct {
+	Job qstatJob
+	// array job (job-array tasks)
+	Array *jarvice.ArrayJob
+	// address of running job (jarvice/info)
+	Address string
+}
+
+func (detail qstatDetail) envs() [][2]string {
+	envs := [][2]string{}
+	for name, value := range detail.Job.Request.Hpc.Envs {
+		if _, ok := qstatJobEnvs[name]; ok || strings.HasPrefix(name, "SGE_O_") {
+			continue
+		}
+		envs = append(envs, [2]string{name, value})
+	}
+	sort.Slice(envs, func(i, j int) bool {
+		return envs[i][0] < envs[j][0]
+	})
+	return envs
+}
+
+func (detail qstatDetail) lines() [][2]string {
+	job := detail.Job
+	req := job.Request
+	lines := [][2]string{
+		{"job_number", strconv.Itoa(job.Id)},
+		{"exec_file", "job_scripts/" + strconv.Itoa(job.Id)},
+		{"submission_time", job.Submit.Format(time.ANSIC)},
+		{"owner", job.User},
+	}
+	for _, name := range []string{"HOME", "LOGNAME", "PATH", "SHELL", "WORKDIR", "HOST"} {
+		if val, ok := req.Hpc.Envs["SGE_O_"+name]; ok {
+			label := "sge_o_" + strings.ToLower(name)
+			if name == "LOGNAME" {
+				label = "sge_o_log_name"
+			}
+			lines = append(lines, [2]string{label, val})
+		}
+	}
+	lines = append(lines, [2]string{"account", "sge"})
+	resources := []string{}
+	for _, resource := range job.hardResources() {
+		resources = append(resources, resource[0]+"="+resource[1])
+	}
+	if len(resources) > 0 {
+		lines = append(lines, [2]string{"hard resource_list", strings.Join(resources, ",")})
+	}
+	lines = append(lines, [2]string{"notify", "FALSE"},
+		[2]string{"job_name", job.Name},
+		[2]string{"jobshare", "0"},
+		[2]string{"hard_queue_list", req.Hpc.Queue})
+	envs := []string{}
+	for _, env := range detail.envs() {
+		envs = append(envs, env[0]+"="+env[1])
+	}
+	if len(envs) > 0 {
+		lines = append(lines, [2]string{"env_list", strings.Join(envs, ",")})
+	}
+	if len(req.Hpc.JobArgs) > 0 {
+		lines = append(lines, [2]string{"job_args", strings.Join(req.Hpc.JobArgs, ",")})
+	}
+	if project := job.project(); project != "NA" {
+		lines = append(lines, [2]string{"project", project})
+	}
+	if len(job.Hold) > 0 {
+		ids := []string{}
+		for _, id := range job.Hold {
+			ids = append(ids, strconv.Itoa(id))
+		}
+		lines = append(lines, [2]string{"jid_predecessor_list", strings.Join(ids, ",")})
+	}
+	if pe, ok := req.Hpc.Envs["PE"]; ok {
+		lines = append(lines, [2]string{"parallel environment",
+			pe + " range: " + strconv.Itoa(job.slots())})
+	}
+	if detail.Array != nil {
+		lines = append(lines, [2]string{"job-array tasks", strconv.Itoa(detail.Array.First) +
+			"-" + strconv.Itoa(detail.Array.Last) + ":" + strconv.Itoa(detail.Array.Step)})
+	}
+	if len(detail.Address) > 0 {
+		lines = append(lines, [2]string{"exec_host_list        1", detail.Address})
+	}
+	if len(job.Error) > 0 {
+		lines = append(lines, [2]string{"error reason          1", job.Error})
+	}
+	if job.pending() {
+		lines = append(lines, [2]string{"scheduling info",
+			"(Collecting of scheduler job information is turned off)"})
+	}
+	return lines
+}
+
+// Detailed job information in XML format (SGE detailed_job_info.xsd)
+type qstatXmlDetail struct {
+	XMLName       xml.Name               `xml:"element"`
+	Number        int                    `xml:"JB_job_number"`
+	Name          string                 `xml:"JB_job_name"`
+	Owner         string                 `xml:"JB_owner"`
+	SubmitTime    int64                  `xml:"JB_submission_time"`
+	Account       string                 `xml:"JB_account"`
+	Project       string                 `xml:"JB_project,omitempty"`
+	HardResources *qstatXmlResourceList  `xml:"JB_hard_resource_list,omitempty"`
+	HardQueues    *qstatXmlQueueList     `xml:"JB_hard_queue_list,omitempty"`
+	Envs          *qstatXmlEnvList       `xml:"JB_env_list,omitempty"`
+	Args          *qstatXmlArgList       `xml:"JB_job_args,omitempty"`
+	Predecessors  *qstatXmlPredecessors  `xml:"JB_jid_predecessor_list,omitempty"`
+	Pe            string                 `xml:"JB_pe,omitempty"`
+	PeRange       *qstatXmlPeRange       `xml:"JB_pe_range,omitempty"`
+	TaskRange     *qstatXmlTaskStructure `xml:"JB_ja_structure,omitempty"`
+}
+
+type qstatXmlResourceList struct {
+	Requests []qstatXmlResource `xml:"qstat_l_requests"`
+}
+
+type qstatXmlResource struct {
+	Name  string `xml:"CE_name"`
+	Value string `xml:"CE_stringval"`
+}
+
+type qstatXmlQueueList struct {
+	Queues []string `xml:"destin_ident_list>QR_name"`
+}
+
+type qstatXmlEnvList struct {
+	Envs []qstatXmlEnv `xml:"job_sublist"`
+}
+
+type qstatXmlEnv struct {
+	Name  string `xml:"VA_variable"`
+	Value string `xml:"VA_value"`
+}
+
+type qstatXmlArgList struct {
+	Args []string `xml:"element>ST_name"`
+}
+
+type qstatXmlPredecessors struct {
+	Ids []int `xml:"job_predecessors>JRE_job_number"`
+}
+
+type qstatXmlRange struct {
+	Min  int `xml:"RN_min"`
+	Max  int `xml:"RN_max"`
+	Step int `xml:"RN_step"`
+}
+
+type qstatXmlPeRange struct {
+	Ranges []qstatXmlRange `xml:"ranges"`
+}
+
+type qstatXmlTaskStructure struct {
+	Ranges []qstatXmlRange `xml:"task_id_range"`
+}
+
+func (detail qstatDetail) xml() qstatXmlDetail {
+	job := detail.Job
+	ret := qstatXmlDetail{
+		Number:     job.Id,
+		Name:       job.Name,
+		Owner:      job.User,
+		SubmitTime: job.Submit.Unix(),
+		Account:    "sge",
+		HardQueues: &qstatXmlQueueList{Queues: []string{job.Request.Hpc.Queue}},
+	}
+	if project := job.project(); project != "NA" {
+		ret.Project = project
+	}
+	if resources := job.hardResources(); len(resources) > 0 {
+		ret.HardResources = &qstatXmlResourceList{}
+		for _, resource := range resources {
+			ret.HardResources.Requests = append(ret.HardResources.Requests,
+				qstatXmlResource{resource[0], resource[1]})
+		}
+	}
+	if envs := detail.envs(); len(envs) > 0 {
+		ret.Envs = &qstatXmlEnvList{}
+		for _, env := range envs {
+			ret.Envs.Envs = append(ret.Envs.Envs, qstatXmlEnv{env[0], env[1]})
+		}
+	}
+	if len(job.Request.Hpc.JobArgs) > 0 {
+		ret.Args = &qstatXmlArgList{}
+		for _, arg := range job.Request.Hpc.JobArgs {
+			// one element per argument
+			ret.Args.Args = append(ret.Args.Args, arg)
+		}
+	}
+	if len(job.Hold) > 0 {
+		ret.Predecessors = &qstatXmlPredecessors{Ids: job.Hold}
+	}
+	if pe, ok := job.Request.Hpc.Envs["PE"]; ok {
+		ret.Pe = pe
+		ret.PeRange = &qstatXmlPeRange{
+			Ranges: []qstatXmlRange{{job.slots(), job.slots(), 1}},
+		}
+	}
+	if detail.Array != nil {
+		ret.TaskRange = &qstatXmlTaskStructure{
+			Ranges: []qstatXmlRange{{detail.Array.First, detail.Array.Last, detail.Array.Step}},
+		}
+	}
+	return ret
+}
+
+// Job connection address (jarvice/info)
+func qstatJobAddress(cluster jarvice.JarviceCluster, number int) string {
+	urlValues := cluster.GetUrlCreds()
+	urlValues.Add("number", strconv.Itoa(number))
+	resp, err := jarvice.ApiReq(cluster.Endpoint, "info", cluster.Insecure, urlValues)
+	if err != nil {
+		return ""
+	}
+	info := map[string]interface{}{}
+	if err := json.Unmarshal(resp, &info); err != nil {
+		return ""
+	}
+	address, _ := info["address"].(string)
+	return address
+}
+
+// Print detailed information of jobs (qstat -j)
+func (x *QStatCommand) printDetails(cluster jarvice.JarviceCluster, jobs []qstatJob) error {
+	matched, unknown := qstatMatchJobs(jobs, x.Jobs)
+	if len(unknown) > 0 {
+		return errors.New("Following jobs do not exist or permissions are not sufficient: \n" +
+			strings.Join(unknown, ", "))
+	}
+	details := []qstatDetail{}
+	seen := map[int]bool{}
+	for _, job := range matched {
+		// tasks of array jobs are shown once
+		if seen[job.Id] {
+			continue
+		}
+		seen[job.Id] = true
+		detail := qstatDetail{Job: job}
+		if array, ok := jarvice.FindArrayJob(job.Id); ok {
+			detail.Array = &array
+		} else if job.Number > 0 && job.running() {
+			detail.Address = qstatJobAddress(cluster, job.Number)
+		}
+		details = append(details, detail)
+	}
+	if x.Xml {
+		var info struct {
+			XMLName xml.Name         `xml:"djob_info"`
+			Jobs    []qstatXmlDetail `xml:"element"`
+		}
+		for _, detail := range details {
+			info.Jobs = append(info.Jobs, detail.xml())
+		}
+		out, err := xml.MarshalIndent(info, "  ", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println("<?xml version='1.0'?>")
+		fmt.Printf("<detailed_job_info  xmlns:xsd=\"%s\">\n", qstatDetailedXsd)
+		fmt.Println(string(out))
+		fmt.Println("</detailed_job_info>")
+		return nil
+	}
+	for _, detail := range details {
+		fmt.Println(qstatJobSeparator)
+		for _, line := range detail.lines() {
+			fmt.Printf("%-28s%s\n", line[0]+":", line[1])
+		}
+	}
+	return nil
+}
+
 func (x *QStatCommand) Execute(args []string) error {
 	if x.Help {
-		// return version string w/ normal exit
+		// version string precedes help message
 		sgeVersion()
-		return nil
+		return jarvice.CreateHelpErr()
+	}
+	if err := qstatParseStates(x.States); err != nil {
+		return &jarvice.SgeError{
+			Command: "qstat",
+			Err:     err,
+		}
 	}
 	// use Cluster option name in query
+	if len(x.Cluster) > 0 {
+		os.Setenv("JXE_CLUSTER", x.Cluster)
+	}
 	cluster, err := jarvice.GetClusterConfig()
 	if err != nil {
-		return &jarvice.SgeError {
+		return &jarvice.SgeError{
 			Command: "qstat",
-			Err: err,
+			Err:     err,
 		}
 	}
-	if resp, err := jarvice.ApiReq(cluster.Endpoint,
-		"jobs",
-		cluster.Insecure,
-		cluster.GetUrlCreds()); err == nil {
-
-		var jarviceJobs jarvice.JarviceJobs
-		if err := json.Unmarshal([]byte(resp), &jarviceJobs); err != nil {
-			return &jarvice.SgeError {
+	jobs, err := qstatReadJobs(cluster, strings.Contains(x.States, "z"))
+	if err != nil {
+		return &jarvice.SgeError{
+			Command: "qstat",
+			Err:     err,
+		}
+	}
+	jobs = qstatFilterUsers(jobs, x.Users)
+	if len(x.Jobs) > 0 {
+		if err := x.printDetails(cluster, jobs); err != nil {
+			return &jarvice.SgeError{
 				Command: "qstat",
-				Err: errors.New("cannot read response"),
+				Err:     err,
 			}
 		}
-		retTable := [][]string{
-			{"job-ID", "prior", "name", "user", "state", "submit/start at", "queue"},
+		return nil
+	}
+	selected := []qstatJob{}
+	for _, job := range jobs {
+		if job.selected(x.States) {
+			selected = append(selected, job)
 		}
-
-		sgeState := "qw"
-		for index, job := range jarviceJobs {
-			// Only show jobs from queue
-			if len(job.ApiSubmission.Queue) == 0 {
-				continue
+	}
+	var queues []qstatQueue
+	if x.Full {
+		queues = qstatQueues(cluster, selected)
+	}
+	switch {
+	case x.Xml:
+		if err := x.printXml(queues, selected); err != nil {
+			return &jarvice.SgeError{
+				Command: "qstat",
+				Err:     err,
 			}
-			switch job.Status {
-			case "PROCESSING STARTING":
-				sgeState = "r"
-				/*
-					case "SUBMITTED":
-					case "COMPLETED":
-					case "COMPLETED WITH ERROR":
-					case "TERMINATED":
-					case "CANCELED":
-					case "EXEMPT":
-					case "SEQUENTIALLY QUEUED":
-				*/
-			default:
-				sgeState = "qw"
-			}
-			subTime := time.Unix(int64(job.SubmitTime), 0)
-			retTable = append(retTable, []string{strconv.Itoa(index),
-				"0",
-				job.Label,
-				job.User,
-				sgeState,
-				subTime.Format(time.UnixDate),
-				job.ApiSubmission.Queue})
-		}
-		jarvice.PrintTable(retTable, true)
+		}
+	case x.Full:
+		x.printFull(queues, selected)
+	case x.Resources:
+		x.printResources(selected)
+	default:
+		x.printTable(selected)
 	}
 	return nil
 }
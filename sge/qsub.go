@@ -8,27 +8,46 @@ import (
 	"math"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/jessevdk/go-flags"
 	jarvice "jarvice.io/jarvice-hpc/core"
+	logger "jarvice.io/jarvice-hpc/logger"
 )
 
 type QSubCommand struct {
 	Help      bool     `short:"h" long:"help" description:"Show this help message"`
-	Binary    string   `short:"b" description:"binary or script"`
+	Binary    string   `short:"b" description:"Gives the user the possibility to indicate explicitly whether command should be treated as binary or script\ny|n (default n: job script with script arguments)"`
 	Shell     string   `short:"S" description:"job shell"`
 	JobName   string   `short:"N" description:"job name"`
 	Cwd       bool     `long:"cwd" description:"current working directory"`
 	Resources []string `short:"l" description:"job resources. NOTE: -soft treated as hard resources"`
-	Pe        int      `long:"pe" description:"parallel environment job scale.\n-pe <pe-name> <pe-scale>\nNOTE: ranges not support (expect single integer)\n<pe-name> will be discarded"`
+	Pe        string   `long:"pe" description:"Parallel programming environment (PE) to instantiate\n-pe <pe-name> <slots>, slots: n[-[m]] | -m (largest feasible value)\nNOTE: slots are mapped to nodes with the cores of the queue machine type and the PE allocation rule (pe.json)"`
 	Queue     string   `short:"q" description:"target queue" default:"default"`
 	Project   string   `short:"P" description:"Specifies the project to which this  job  is  assigned."`
-	Output    string   `short:"o" description:"Output file."`
-	Error     string   `short:"e" description:"Error file."`
+	Output    string   `short:"o" description:"The path used for the standard output stream of the job (file or directory)\n[[hostname]:]path,...\npseudo variables: $HOME, $USER, $JOB_ID, $JOB_NAME, $HOSTNAME, $TASK_ID"`
+	Error     string   `short:"e" description:"The path used for the standard error stream of the job (file or directory)\n[[hostname]:]path,..."`
+	Input     string   `short:"i" description:"Defines or redefines the file used for the standard input stream of the job\n[[hostname]:]file,..."`
+	Join      string   `short:"j" description:"Specifies whether or not the standard error stream of the job is merged into the standard output stream\ny|n"`
+	ExportAll bool     `short:"V" description:"Specifies that all environment variables active within the qsub utility be exported to the context of the job (site filter applies)"`
+	Export    []string `short:"v" description:"Defines or redefines the environment variables to be exported to the execution context of the job\nvariable[=value][,variable[=value],...]"`
+	Terse     bool     `long:"terse" description:"Tersed output, print only the job-id of the job"`
+	Start     string   `short:"a" description:"Defines the time and date at which a job is eligible for execution.\n[[CC]YY]MMDDhhmm[.SS]"`
+	Mail      string   `short:"m" description:"Defines under which circumstances mail is to be sent to the job owner or to the users defined with -M\nb|e|a|s|n\nNOTE: notifications are sent by the client (qsub, qstat, ... or jarvice agent); s is ignored"`
+	MailList  string   `short:"M" description:"Defines the list of users to which the server that executes the job has to send mail\nuser[@host][,user[@host],...]"`
+	Tasks     string   `short:"t" description:"Submits a so called Array Job, i.e. an array of identical tasks being differentiated only by an index number (SGE_TASK_ID)\nn[-m[:s]]"`
+	HoldJid   []string `long:"hold_jid" description:"Defines or redefines the job dependency list of the submitted job\nwc_job_list: job ID, job name or job name pattern (wildcards), comma separated\nNOTE: jobs are held by the client until dependencies finish"`
+	HoldJidAd []string `long:"hold_jid_ad" description:"Defines or redefines the job array dependency list of the submitted job. Task n of the submitted job waits for task n of each array job"`
+	Sync      string   `long:"sync" description:"Wait for the job to complete before exiting and exit with the exit code of the job\ny|n\nNOTE: on interrupt the job is deleted only if JARVICE_HPC_SYNC_CANCEL=y"`
+	Options   []string `short:"@" description:"Forces qsub to use the options contained in optionfile\noptionfile"`
+	Clear     bool     `long:"clear" description:"Causes all elements of the job to be reset to the initial default status prior to applying any modifications appearing in this specific command (sge_request files are discarded)"`
+	TaskLimit int      `long:"tc" description:"Allow users to limit the number of concurrent array job task scheduled to run\nNOTE: held tasks are submitted to JARVICE by the client (qsub, qstat, ... or jarvice agent)"`
 	Args      struct {
 		JobScript []string `positional-arg-name:"jobscript" description:"SGE job script | job command"`
 		//JobCommand string `positional-arg-name:"command" description:
@@ -104,6 +123,435 @@ func decodeMemReq(req string) (mem int, err error) {
 	return
 }
 
+// Parse SGE date_time ([[CC]YY]MMDDhhmm[.SS])
+func parseSgeDateTime(spec string, now time.Time) (time.Time, error) {
+	invalidErr := errors.New("invalid date_time format \"" + spec + "\"")
+	re := regexp.MustCompile("^([0-9]{8}|[0-9]{10}|[0-9]{12})(\\.([0-9]{2}))?$")
+	match := re.FindStringSubmatch(spec)
+	if match == nil {
+		return time.Time{}, invalidErr
+	}
+	digits := match[1]
+	year := now.Year()
+	switch len(digits) {
+	case 10:
+		yy, _ := strconv.Atoi(digits[:2])
+		year = (now.Year()/100)*100 + yy
+		digits = digits[2:]
+	case 12:
+		year, _ = strconv.Atoi(digits[:4])
+		digits = digits[4:]
+	}
+	fields := []int{}
+	for i := 0; i < len(digits); i += 2 {
+		val, _ := strconv.Atoi(digits[i : i+2])
+		fields = append(fields, val)
+	}
+	sec := 0
+	if len(match[3]) > 0 {
+		sec, _ = strconv.Atoi(match[3])
+	}
+	month, day, hour, min := fields[0], fields[1], fields[2], fields[3]
+	if month < 1 || month > 12 || day < 1 || day > 31 ||
+		hour > 23 || min > 59 || sec > 59 {
+		return time.Time{}, invalidErr
+	}
+	return time.Date(year, time.Month(month), day, hour, min, sec, 0, now.Location()), nil
+}
+
+// Environment exported to the job
+// Only -V (site filter applies) or -v variables are exported, with SGE_O_*
+// variables of the submit host
+// Variables listed in allow are exported if set
+func sgeExportEnvs(exportAll bool, lists, allow, environ []string,
+	hostname, cwd string) map[string]string {
+
+	current := map[string]string{}
+	for _, env := range environ {
+		if name, value, ok := jarvice.SplitEnv(env); ok {
+			current[name] = value
+		}
+	}
+	envs := map[string]string{}
+	if exportAll {
+		envs = jarvice.FilterEnvironment(environ)
+	}
+	// explicitly requested variables bypass the site filter
+	for _, name := range allow {
+		if value, ok := current[name]; ok {
+			envs[name] = value
+		}
+	}
+	for _, list := range lists {
+		for _, item := range splitAtCommas(list) {
+			if name, value, ok := jarvice.SplitEnv(item); ok {
+				envs[name] = strings.Trim(value, "\"")
+			} else if value, ok := current[item]; ok && len(item) > 0 {
+				envs[item] = value
+			}
+		}
+	}
+	logname := current["LOGNAME"]
+	if len(logname) == 0 {
+		logname = current["USER"]
+	}
+	for name, value := range map[string]string{
+		"SGE_O_HOME":    current["HOME"],
+		"SGE_O_HOST":    hostname,
+		"SGE_O_LOGNAME": logname,
+		"SGE_O_MAIL":    current["MAIL"],
+		"SGE_O_PATH":    current["PATH"],
+		"SGE_O_SHELL":   current["SHELL"],
+		"SGE_O_TZ":      current["TZ"],
+		"SGE_O_WORKDIR": cwd,
+	} {
+		if len(value) > 0 {
+			envs[name] = value
+		}
+	}
+	return envs
+}
+
+// Remote shell snippet resolving SGE output paths at job start
+// sge_path <path> <default-prefix>: <path>/<default-prefix><job_id>[.<task_id>]
+// if path is a directory, else path
+const sgePathEnvConfig = `sge_job_id="${JOB_ID:-${jobid}}";` +
+	`sge_task="";` +
+	`if [ "${SGE_TASK_ID:-undefined}" != undefined ]; then sge_task=".${SGE_TASK_ID}"; fi;` +
+	`sge_path () { if [ -d "$1" ]; then echo "$1/$2${sge_job_id}${sge_task}"; else echo "$1"; fi; };`
+
+// Select path of [[hostname]:]path list (qsub -o, -e, -i)
+// Execution hosts are not known at submission: the first path without
+// hostname is used, else the first path
+func sgeSelectPath(list string) string {
+	paths := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if index := strings.Index(item, ":"); index >= 0 {
+			if index == 0 {
+				return item[1:]
+			}
+			paths = append(paths, item[index+1:])
+		} else if len(item) > 0 {
+			return item
+		}
+	}
+	if len(paths) > 0 {
+		return paths[0]
+	}
+	return ""
+}
+
+// Convert SGE path into a shell word expanded at job start
+// Pseudo variables $HOME, $USER, $JOB_ID, $JOB_NAME, $HOSTNAME and $TASK_ID
+// are replaced (job ID is only known by the remote job)
+// e.g. "$HOME/$JOB_NAME.log" => "${HOME}"'/'name'.log'
+func sgePathWord(path, jobName, user string) string {
+	variables := []struct {
+		name  string
+		value string
+	}{
+		{"$HOME", `"${HOME}"`},
+		{"$USER", jarvice.ShellQuote(user)},
+		{"$JOB_ID", `"${sge_job_id}"`},
+		{"$JOB_NAME", jarvice.ShellQuote(jobName)},
+		{"$HOSTNAME", `"$(hostname)"`},
+		{"$TASK_ID", `"${SGE_TASK_ID:-undefined}"`},
+	}
+	word := ""
+	literal := ""
+	for i := 0; i < len(path); i++ {
+		found := false
+		if path[i] == '$' {
+			for _, variable := range variables {
+				if strings.HasPrefix(path[i:], variable.name) {
+					if len(literal) > 0 {
+						word += jarvice.ShellQuote(literal)
+						literal = ""
+					}
+					word += variable.value
+					i += len(variable.name) - 1
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			literal += string(path[i])
+		}
+	}
+	if len(literal) > 0 || len(word) == 0 {
+		word += jarvice.ShellQuote(literal)
+	}
+	return word
+}
+
+// Build shell redirections for job standard input, output and error files
+// Default output and error files are <job_name>.o<job_id> and
+// <job_name>.e<job_id> (.<task_id> for array tasks) in the working directory
+func sgeOutputRedirect(input, output, errorFile string, join bool,
+	jobName, user string) string {
+
+	redirect := "exec"
+	if len(input) > 0 {
+		redirect += " <" + sgePathWord(sgeSelectPath(input), jobName, user)
+	}
+	outputPath := "."
+	if len(output) > 0 {
+		outputPath = sgeSelectPath(output)
+	}
+	redirect += ` >"$(sge_path ` + sgePathWord(outputPath, jobName, user) + " " +
+		jarvice.ShellQuote(jobName+".o") + `)"`
+	if join {
+		// -e is ignored if streams are merged
+		return redirect + " 2>&1 && "
+	}
+	errorPath := "."
+	if len(errorFile) > 0 {
+		errorPath = sgeSelectPath(errorFile)
+	}
+	return redirect + ` 2>"$(sge_path ` + sgePathWord(errorPath, jobName, user) + " " +
+		jarvice.ShellQuote(jobName+".e") + `)" && `
+}
+
+// Queue machine type requested with -l mc_name (queue default if not requested)
+func qsubMachine(cluster jarvice.JarviceCluster, queue jarvice.JarviceQueue,
+	machineName string) (jarvice.JarviceMachineInfo, error) {
+
+	machines, err := jarvice.GetJarviceMachines(cluster)
+	if err != nil {
+		return jarvice.JarviceMachineInfo{}, err
+	}
+	if len(machineName) == 0 {
+		machineName = queue.DefaultMachine
+	}
+	for _, machine := range jarvice.QueueMachines(queue, machines) {
+		if machine.Name == machineName {
+			return machine, nil
+		}
+	}
+	return jarvice.JarviceMachineInfo{}, errors.New("cannot find machine type " +
+		machineName + " for queue " + queue.Name)
+}
+
+// Map parallel environment request (-pe <pe-name> <slots>) to nodes of queue
+// machine type
+func (x *QSubCommand) peAllocation(queue jarvice.JarviceQueue,
+	machine jarvice.JarviceMachineInfo) (jarvice.PeAllocation, error) {
+
+	fields := strings.Fields(x.Pe)
+	if len(fields) != 2 {
+		return jarvice.PeAllocation{}, errors.New("invalid -pe request: " + x.Pe)
+	}
+	min, max, err := jarvice.ParsePeRange(fields[1])
+	if err != nil {
+		return jarvice.PeAllocation{}, err
+	}
+	def, err := jarvice.ReadPeDefinition(fields[0])
+	if err != nil {
+		return jarvice.PeAllocation{}, err
+	}
+	maxNodes := queue.MachineScale
+	if machine.ScaleMax > 0 && (maxNodes < 1 || machine.ScaleMax < maxNodes) {
+		maxNodes = machine.ScaleMax
+	}
+	pe, err := def.Allocate(min, max, machine.Cores, maxNodes)
+	if err != nil {
+		return jarvice.PeAllocation{}, errors.New("-pe " + x.Pe + ": " + err.Error() +
+			" (queue size " + strconv.Itoa(maxNodes) + ")")
+	}
+	return pe, nil
+}
+
+// Job flags of sge_request files, job script directives and option files (-@)
+// -clear discards the sge_request files and the option files or job script
+// directives preceding it (CLI -clear discards sge_request files only)
+func (x *QSubCommand) jobArgs(directives []string) ([]string, error) {
+	options := []string{}
+	for _, filename := range x.Options {
+		fileOptions, err := jarvice.ExpandOptionFiles([]string{"-@", filename})
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, fileOptions...)
+	}
+	options, cleared := jarvice.ClearOptions(options)
+	defaults := []string{}
+	if !x.Clear && !cleared {
+		var err error
+		if defaults, err = jarvice.ReadSgeRequest(); err != nil {
+			return nil, err
+		}
+	}
+	directives, err := jarvice.ExpandOptionFiles(directives)
+	if err != nil {
+		return nil, err
+	}
+	args, _ := jarvice.ClearOptions(append(defaults, directives...))
+	return append(args, options...), nil
+}
+
+// Print job ID of submitted job (only job ID with -terse)
+func (x *QSubCommand) printSubmitted(id int, jobScriptFilename string) {
+	if x.Terse {
+		fmt.Println(id)
+		return
+	}
+	fmt.Printf("Your job %d (\"%s\") has been submitted\n", id, jobScriptFilename)
+}
+
+// Interval between job status checks (-sync y)
+const qsubSyncInterval = 5 * time.Second
+
+// Delete job if qsub -sync y is interrupted (y|n, default n)
+const qsubSyncCancelEnv = "JARVICE_HPC_SYNC_CANCEL"
+
+// JARVICE job or held job waited for (array task or job)
+type qsubSyncJob struct {
+	Id     string
+	Number int
+	// job will not run (deleted or failed to submit)
+	NeverRan bool
+}
+
+// Jobs of job ID waited for (tasks of array job)
+func qsubSyncJobs(id int) []qsubSyncJob {
+	if arrayJob, ok := jarvice.FindArrayJob(id); ok {
+		jobs := []qsubSyncJob{}
+		for _, task := range arrayJob.Tasks {
+			jobs = append(jobs, qsubSyncJob{
+				Id:       strconv.Itoa(id) + "." + strconv.Itoa(task.Task),
+				Number:   task.Number,
+				NeverRan: task.Number == 0 && !task.Held(),
+			})
+		}
+		return jobs
+	}
+	job := qsubSyncJob{Id: strconv.Itoa(id), Number: id}
+	if id >= jarvice.DeferredJobIdBase {
+		job.Number, job.NeverRan = 0, true
+		if deferredJobs, err := jarvice.ReadDeferredJobs(); err == nil {
+			for _, deferredJob := range deferredJobs {
+				if deferredJob.Id == id {
+					job.Number = deferredJob.Number
+					job.NeverRan = len(deferredJob.Error) > 0
+				}
+			}
+		}
+	}
+	return []qsubSyncJob{job}
+}
+
+// Wait for submitted job to finish (-sync y)
+// Returns the exit code of the job (highest exit code of array tasks)
+func qsubSync(cluster jarvice.JarviceCluster, id int) error {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+	exitCode := 0
+	reported := map[string]bool{}
+	for {
+		// jobs held on the client are submitted while waiting
+		if err := jarvice.ProcessDeferredJobs(); err != nil {
+			logger.WarningPrintf("deferred jobs: %v", err)
+		}
+		if err := jarvice.ProcessArrayJobs(); err != nil {
+			logger.WarningPrintf("array jobs: %v", err)
+		}
+		jarviceJobs, _, err := jarvice.ReadAllJarviceJobs(cluster)
+		if err != nil {
+			logger.WarningPrintf("qsub: %v", err)
+		}
+		waiting := false
+		for _, job := range qsubSyncJobs(id) {
+			if reported[job.Id] {
+				continue
+			}
+			if job.NeverRan {
+				fmt.Printf("Job %s never ran.\n", job.Id)
+				reported[job.Id] = true
+				if exitCode < 1 {
+					exitCode = 1
+				}
+				continue
+			}
+			jarviceJob, ok := jarviceJobs[job.Number]
+			if job.Number == 0 || !ok || !jarviceJob.State().Terminal {
+				waiting = true
+				continue
+			}
+			reported[job.Id] = true
+			code := jarviceJob.ExitCode
+			switch {
+			case jarviceJob.StartTime <= 0 && jarviceJob.Status != jarvice.JobStatusCompleted &&
+				jarviceJob.Status != jarvice.JobStatusCompletedWithError:
+				fmt.Printf("Job %s never ran.\n", job.Id)
+				code = 1
+			case jarviceJob.Status == jarvice.JobStatusCanceled ||
+				jarviceJob.Status == jarvice.JobStatusTerminated:
+				fmt.Printf("Job %s exited because of signal SIGKILL.\n", job.Id)
+				code = 128 + int(syscall.SIGKILL)
+			default:
+				fmt.Printf("Job %s exited with exit code %d.\n", job.Id, code)
+			}
+			if code > exitCode {
+				exitCode = code
+			}
+		}
+		if !waiting {
+			break
+		}
+		select {
+		case <-interrupt:
+			fmt.Fprintln(os.Stderr, "\nqsub: interrupted while waiting for job "+strconv.Itoa(id))
+			if jarvice.IsYes(os.Getenv(qsubSyncCancelEnv)) {
+				if _, ok := jarvice.FindArrayJob(id); ok {
+					err = jarvice.DeleteArrayTasks(cluster, id, nil, false)
+				} else {
+					err = jarvice.CancelJob(cluster, id, false)
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "qsub: unable to delete job %d: %v\n", id, err)
+				} else {
+					fmt.Fprintf(os.Stderr, "qsub: job %d has been deleted\n", id)
+				}
+			} else {
+				fmt.Fprintf(os.Stderr, "qsub: job %d is still queued or running (qdel %d to delete it)\n",
+					id, id)
+			}
+			return &jarvice.ExitError{Code: 130}
+		case <-time.After(qsubSyncInterval):
+		}
+	}
+	if exitCode != 0 {
+		return &jarvice.ExitError{Code: exitCode}
+	}
+	return nil
+}
+
+// Notification events of qsub -m
+// JARVICE cannot suspend jobs (s is accepted and ignored)
+func sgeMailEvents(mail string) ([]string, error) {
+	events := []string{}
+	for _, option := range mail {
+		switch option {
+		case 'b':
+			events = append(events, jarvice.NotifyBegin)
+		case 'e':
+			events = append(events, jarvice.NotifyEnd)
+		case 'a':
+			events = append(events, jarvice.NotifyFail)
+		case 's':
+		case 'n':
+			if len(mail) > 1 {
+				return nil, errors.New("-m n cannot be combined with other options")
+			}
+		default:
+			return nil, errors.New("invalid mail option: " + mail)
+		}
+	}
+	return events, nil
+}
+
 func (x *QSubCommand) Execute(args []string) error {
 	// leave early if parsing jobscript arguments
 	if jobScriptParser.Active != nil &&
@@ -114,18 +562,17 @@ func (x *QSubCommand) Execute(args []string) error {
 	if x.Help {
 		return jarvice.CreateHelpErr()
 	}
-	// Set jobscript name
+	// Set jobscript name and script arguments
 	jobScriptFilename := "STDIN"
-	submitCommand := "STDIN"
-	if len(x.Args.JobScript) == 1 {
+	var scriptArgs []string
+	binary := jarvice.IsYes(x.Binary)
+	if len(x.Args.JobScript) > 0 {
 		jobScriptFilename = x.Args.JobScript[0]
-	} else if len(x.Args.JobScript) > 1 {
-		submitCommand = strings.Join(x.Args.JobScript, " ")
-		jobScriptFilename = ""
+		scriptArgs = x.Args.JobScript[1:]
 	}
 
 	// validate binary flag
-	if jarvice.IsYes(x.Binary) && jobScriptFilename == "STDIN" {
+	if binary && len(x.Args.JobScript) == 0 {
 		return &jarvice.SgeError {
 			Command: "qsub",
 			Err: errors.New("missing command"),
@@ -134,31 +581,45 @@ func (x *QSubCommand) Execute(args []string) error {
 
 	var jobScript jarvice.JobScript
 
-	if len(jobScriptFilename) > 0 {
-		if val, jerr := jarvice.ParseJobScript("$", jobScriptFilename); jerr != nil {
-			return &jarvice.SgeError {
-				Command: "qsub",
-				Err: errors.New("WARNING unable to parse job script"),
-			}
-		} else {
-			jobScript = val
+	if binary {
+		// command is run as is (no job script directives)
+		command := []string{}
+		for _, arg := range x.Args.JobScript {
+			command = append(command, jarvice.ShellQuote(arg))
 		}
-	} else {
 		jobScript = jarvice.JobScript{
 			Shell:  "/bin/sh",
-			Script: []byte(submitCommand),
+			Script: []byte(strings.Join(command, " ")),
+		}
+		scriptArgs = nil
+	} else if val, jerr := jarvice.ParseJobScript("$", jobScriptFilename); jerr != nil {
+		if pathErr, ok := jerr.(*os.PathError); ok {
+			return &jarvice.SgeError{
+				Command: "qsub",
+				Err: errors.New("Unable to read script file because of error: error opening " +
+					jobScriptFilename + ": " + pathErr.Err.Error()),
+			}
+		}
+		return &jarvice.SgeError {
+			Command: "qsub",
+			Err: errors.New("WARNING unable to parse job script"),
 		}
+	} else {
+		jobScript = val
 	}
-	// workaround for slice copy
-	if len(x.Resources) < 1 {
-		sliceMax := len(jobScript.Args) + 10
-		x.Resources = make([]string, sliceMax, sliceMax)
+	// parse flags from sge_request files, jobscript and option files (-@)
+	// (later flags take precedence, CLI flags take precedence;override == false)
+	jobArgs, err := x.jobArgs(jobScript.Args)
+	if err != nil {
+		return &jarvice.SgeError{
+			Command: "qsub",
+			Err:     err,
+		}
 	}
-	// parse flags from jobscript (CLI flags take precedence;override == false)
 	if jarvice.ParseJobFlags(x,
 		parser,
 		jobScriptParser,
-		append([]string{jarvice.JobScriptArg}, jobScript.Args...),
+		append([]string{jarvice.JobScriptArg}, jobArgs...),
 		false) != nil {
 		// Best effort
 		fmt.Println("WARNING: unable to parse flags in jobscript")
@@ -166,6 +627,50 @@ func (x *QSubCommand) Execute(args []string) error {
 
 	jobScriptFilename = filepath.Base(jobScriptFilename)
 
+	var beginTime time.Time
+	if len(x.Start) > 0 {
+		if val, err := parseSgeDateTime(x.Start, time.Now()); err != nil {
+			return &jarvice.SgeError{
+				Command: "qsub",
+				Err:     err,
+			}
+		} else {
+			beginTime = val
+		}
+	}
+	// array job task range
+	taskFirst, taskLast, taskStep := 0, 0, 0
+	if len(x.Tasks) > 0 {
+		var err error
+		if taskFirst, taskLast, taskStep, err = jarvice.ParseTaskRange(x.Tasks); err != nil {
+			return &jarvice.SgeError{
+				Command: "qsub",
+				Err:     err,
+			}
+		}
+	}
+	if x.TaskLimit < 0 {
+		return &jarvice.SgeError{
+			Command: "qsub",
+			Err:     errors.New("invalid -tc value: " + strconv.Itoa(x.TaskLimit)),
+		}
+	}
+	mailEvents, err := sgeMailEvents(x.Mail)
+	if err != nil {
+		return &jarvice.SgeError{
+			Command: "qsub",
+			Err:     err,
+		}
+	}
+	// watch submitted job for -m notifications (best effort)
+	watchJob := func(id int, name string) {
+		if err := jarvice.WatchJob(id, name, mailEvents,
+			jarvice.NotifyRecipients(x.MailList)); err != nil {
+			fmt.Fprintln(os.Stderr, "qsub: WARNING unable to watch job for notifications: "+
+				err.Error())
+		}
+	}
+
 	resources := parseSgeResources(x.Resources)
 
 	// Read JARVICE config for selected cluster
@@ -207,16 +712,6 @@ func (x *QSubCommand) Execute(args []string) error {
 	if len(x.Shell) > 0 {
 		jobScript.Shell = x.Shell
 	}
-	// Setup I/O redirect using block { ... }
-	jobScript.Script = append([]byte{'{', '\n'}, jobScript.Script...)
-	jobScript.Script = append(jobScript.Script, '\n', '}')
-	if len(x.Output) > 0 {
-		jobScript.Script = append(jobScript.Script, []byte(" >"+x.Output)...)
-	}
-	if len(x.Error) > 0 {
-		jobScript.Script = append(jobScript.Script, []byte(" 2>"+x.Error)...)
-	}
-
 	var cwd string
 	if x.Cwd {
 		if wd, err := os.Getwd(); err != nil {
@@ -229,6 +724,11 @@ func (x *QSubCommand) Execute(args []string) error {
 	if len(x.JobName) > 0 {
 		jobName = x.JobName
 	}
+	// name of default output files (script name unless set with -N)
+	outputName := jobScriptFilename
+	if len(x.JobName) > 0 {
+		outputName = x.JobName
+	}
 
 	// Set /etc/hosts for remote HPC job
 	// Best effort
@@ -240,54 +740,24 @@ func (x *QSubCommand) Execute(args []string) error {
 		ipString = myPrivateIP + " " + myHostname
 	}
 	// Set SGE Output Environment Variables
-	sgeEnvs := make(map[string]string)
-	blacklisted_envs := map[string]struct{}{
-		"PATH":                 struct{}{},
-		"USER":                 struct{}{},
-		"HOME":                 struct{}{},
-		"EDITOR":               struct{}{},
-		"UID":                  struct{}{},
-		"TERM":                 struct{}{},
-		"SHELL":                struct{}{},
-		"HOSTNAME":             struct{}{},
-		"GLAD":                 struct{}{},
-		"JARVICE_HEALTH_PORT":  struct{}{},
-		"JARVICE_HPC_LOGLEVEL": struct{}{},
-		"JARVICE_ID_GID":       struct{}{},
-		"JARVICE_ID_GROUP":     struct{}{},
-		"JARVICE_ID_UID":       struct{}{},
-		"JARVICE_ID_USER":      struct{}{},
-		"JARVICE_INGRESSPATH":  struct{}{},
-		"JARVICE_JOBTOKEN":     struct{}{},
-		"JARVICE_MPI_CMA":      struct{}{},
-		"JARVICE_MPI_PROVIDER": struct{}{},
-		"JARVICE_TOOLS":        struct{}{},
-		"JARVICE_TOOLS_BIN":    struct{}{},
-		"JARVICE_VAULT_NAME":   struct{}{},
-		"JOB_LABEL":            struct{}{},
-		"JOB_NAME":             struct{}{},
-		"JOB_PRIVATEIP":        struct{}{},
-		"JOB_PUBLICIP":         struct{}{},
-		"MODULEPATH":           struct{}{},
-		"MODULESHOME":          struct{}{},
-	}
+	allowedEnvs := []string{}
 	if val, ok := resources["mc_export"]; ok {
 		for _, env := range strings.Split(val, ",") {
 			if strings.Contains(env, "PATH") {
-				delete(blacklisted_envs, "PATH")
+				allowedEnvs = append(allowedEnvs, "PATH")
 			}
 		}
 	}
-	for _, env := range os.Environ() {
-		parts := strings.Split(env, "=")
-		if len(parts) == 2 {
-			if _, ok := blacklisted_envs[parts[0]]; !ok &&
-				!strings.Contains(parts[0], "BASH_FUNC") &&
-				!strings.Contains(parts[0], "KUBERNETES_") {
-				sgeEnvs[parts[0]] = parts[1]
-			}
-		}
+	submitDir, _ := os.Getwd()
+	sgeEnvs := sgeExportEnvs(x.ExportAll, x.Export, allowedEnvs, os.Environ(),
+		myHostname, submitDir)
+	// task variables are set for each task of array jobs
+	for _, name := range []string{"SGE_TASK_ID", "SGE_TASK_FIRST", "SGE_TASK_LAST",
+		"SGE_TASK_STEPSIZE"} {
+		sgeEnvs[name] = "undefined"
 	}
+	// JOB_ID is set by the job (array job ID for array tasks)
+	delete(sgeEnvs, "JOB_ID")
 	myHpcReq := jarvice.HpcReq{
 		// sudo is required to edit /etc/hosts (best effort)
 		JobEnvConfig: `join () { local IFS="$1"; shift; echo "$*"; };` +
@@ -298,15 +768,21 @@ func (x *QSubCommand) Execute(args []string) error {
 			`numnodes="$(cat /etc/JARVICE/nodes | wc -l )";` +
 			`cpupernode="$(( $(cat /etc/JARVICE/cores | wc -l) / $(cat /etc/JARVICE/nodes | wc -l) ))";` +
 			`procid="$(ps axo pid,command | grep '/bin/sh -l -c join ()' | awk 'NR==1{print $1}')";` +
+			jarvice.JobIdEnvConfig +
+			sgePathEnvConfig +
 			`echo ` + ipString + ` | sudo tee -a /etc/hosts || true`,
 		JobScript: base64.StdEncoding.EncodeToString(jobScript.Script),
 		JobShell: "cd " + cwd + " && " +
+			sgeOutputRedirect(x.Input, x.Output, x.Error, jarvice.IsYes(x.Join),
+				outputName, cluster.Creds.Username) +
+			"JOB_ID=${sge_job_id} " +
 			"SGE_JOB_NODELIST=${sge_hosts} " +
 			"SGE_CPUS_ON_NODE=${numcpu} " +
 			"SGE_JOB_NUM_NODES=${numnodes} " +
 			"SGE_JOB_CPUS_PER_NODE=${cpupernode} " +
 			"SGE_PROCID=${procid} " +
-			jobScript.Shell,
+			jarvice.JobShellCommand(jobScript.Shell, scriptArgs),
+		JobArgs:   scriptArgs,
 		Queue:     myQueue.Name,
 		Umask:     0,
 		Envs:      sgeEnvs,
@@ -358,21 +834,36 @@ func (x *QSubCommand) Execute(args []string) error {
 		Command:  jarvice.JarviceHpcCommandName,
 		Geometry: jarvice.JarviceHpcGeometry,
 	}
-	// need to validate scale (positive integer)
-	nodeScale := 1
-	if x.Pe > 0 {
-		nodeScale = x.Pe
+	machineType := myQueue.DefaultMachine
+	var machine jarvice.JarviceMachineInfo
+	if len(hpcMachineReq) > 0 || len(x.Pe) > 0 {
+		if machine, err = qsubMachine(cluster, myQueue, hpcMachineReq); err != nil {
+			return &jarvice.SgeError{
+				Command: "qsub",
+				Err:     err,
+			}
+		}
+		machineType = machine.Name
 	}
-	// check if -pe request is larger than queue size
-	if nodeScale > myQueue.MachineScale {
-		return &jarvice.SgeError {
-			Command: "qsub",
-			Err: errors.New("-pe request larger than queue size (" +
-				strconv.Itoa(myQueue.MachineScale) + ")"),
+	// parallel environment slots are mapped to nodes
+	nodeScale := 1
+	pe := jarvice.PeAllocation{Slots: 1, Hosts: []int{1}}
+	if len(x.Pe) > 0 {
+		if pe, err = x.peAllocation(myQueue, machine); err != nil {
+			return &jarvice.SgeError{
+				Command: "qsub",
+				Err:     err,
 			}
+		}
+		nodeScale = len(pe.Hosts)
+		myHpcReq.Envs["PE"] = strings.Fields(x.Pe)[0]
+		myHpcReq.Envs["PE_HOSTFILE"] = jarvice.PeHostfile
+		myHpcReq.JobEnvConfig = pe.HostfileEnvConfig(myQueue.Name) + myHpcReq.JobEnvConfig
 	}
+	myHpcReq.Envs["NSLOTS"] = strconv.Itoa(pe.Slots)
+	myHpcReq.Envs["NHOSTS"] = strconv.Itoa(nodeScale)
 	myMachine := jarvice.JarviceMachine{
-		Type:  myQueue.DefaultMachine,
+		Type:  machineType,
 		Nodes: nodeScale,
 	}
 	// TODO: set ReadOnly and Force options?
@@ -397,6 +888,69 @@ func (x *QSubCommand) Execute(args []string) error {
 		Licenses:    hpcLicenses,
 		JobProject:  jobProject,
 	}
+	// job dependencies (held on the client)
+	hold, err := jarvice.ResolveHoldJobs(cluster, x.HoldJid)
+	if err != nil {
+		return &jarvice.SgeError{
+			Command: "qsub",
+			Err:     err,
+		}
+	}
+	var holdArray []int
+	if len(x.HoldJidAd) > 0 {
+		if taskFirst == 0 {
+			return &jarvice.SgeError{
+				Command: "qsub",
+				Err:     errors.New("-hold_jid_ad requires an array job (-t)"),
+			}
+		}
+		tasks := len(jarvice.TaskRangeIds(taskFirst, taskLast, taskStep))
+		if holdArray, err = jarvice.ResolveHoldArrayJobs(cluster, x.HoldJidAd, tasks); err != nil {
+			return &jarvice.SgeError{
+				Command: "qsub",
+				Err:     err,
+			}
+		}
+	}
+	// one JARVICE job per task
+	if taskFirst > 0 {
+		id, err := jarvice.SubmitArrayJob(cluster, myReq, taskFirst, taskLast, taskStep,
+			x.TaskLimit, beginTime, hold, holdArray, mailEvents,
+			jarvice.NotifyRecipients(x.MailList))
+		if err != nil {
+			return &jarvice.SgeError{
+				Command: "qsub",
+				Err:     err,
+			}
+		}
+		if x.Terse {
+			fmt.Printf("%d.%d-%d:%d\n", id, taskFirst, taskLast, taskStep)
+		} else {
+			fmt.Printf("Your job-array %d.%d-%d:%d (\"%s\") has been submitted\n",
+				id, taskFirst, taskLast, taskStep, jobScriptFilename)
+		}
+		if jarvice.IsYes(x.Sync) {
+			return qsubSync(cluster, id)
+		}
+		return nil
+	}
+	// JARVICE has no delayed start; hold job on the client until start time
+	// and until dependencies finish
+	if beginTime.After(time.Now()) || len(hold) > 0 {
+		id, err := jarvice.DeferJob(myReq, beginTime, hold...)
+		if err != nil {
+			return &jarvice.SgeError{
+				Command: "qsub",
+				Err:     err,
+			}
+		}
+		watchJob(id, myReq.JobLabel)
+		x.printSubmitted(id, jobScriptFilename)
+		if jarvice.IsYes(x.Sync) {
+			return qsubSync(cluster, id)
+		}
+		return nil
+	}
 	// Submit job request to JARVICE API
 	var myJobResponse jarvice.JarviceJobResponse
 	if jobResponse, err := jarvice.JarviceSubmitJob(cluster.Endpoint,
@@ -408,7 +962,11 @@ func (x *QSubCommand) Execute(args []string) error {
 	} else {
 		myJobResponse = jobResponse
 	}
-	fmt.Printf("Your job %d (\"%s\") has been submitted\n", int(myJobResponse.Number), jobScriptFilename)
+	watchJob(int(myJobResponse.Number), myReq.JobLabel)
+	x.printSubmitted(int(myJobResponse.Number), jobScriptFilename)
+	if jarvice.IsYes(x.Sync) {
+		return qsubSync(cluster, int(myJobResponse.Number))
+	}
 
 	return nil
 
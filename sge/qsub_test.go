@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	jarvice "jarvice.io/jarvice-hpc/core"
+)
+
+// ~/.sge_request with default queue and project
+func testSgeRequest(t *testing.T) {
+	home := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(home, ".sge_request"),
+		[]byte("-q defaultq -P defaultp\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", home)
+	t.Setenv("SGE_ROOT", "")
+}
+
+func testFile(t *testing.T, name, data string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestQsubJobArgsClear(t *testing.T) {
+	testSgeRequest(t)
+	script := testFile(t, "job.sh", "#!/bin/sh\n#$ -N named\n#$ -q scriptq\nhostname\n")
+	jobScript, err := jarvice.ParseJobScript("$", script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearFile := testFile(t, "clear", "-l mc_name=n8 -clear -j y\n")
+	for _, test := range []struct {
+		name       string
+		command    QSubCommand
+		directives []string
+		want       []string
+	}{
+		{"defaults", QSubCommand{}, jobScript.Args,
+			[]string{"-q", "defaultq", "-P", "defaultp", "-N", "named", "-q", "scriptq"}},
+		{"qsub -clear", QSubCommand{Clear: true}, jobScript.Args,
+			[]string{"-N", "named", "-q", "scriptq"}},
+		{"#$ -clear", QSubCommand{}, []string{"-N", "named", "-clear", "-q", "scriptq"},
+			[]string{"-q", "scriptq"}},
+		{"-@ with -clear", QSubCommand{Options: []string{clearFile}}, jobScript.Args,
+			[]string{"-N", "named", "-q", "scriptq", "-j", "y"}},
+	} {
+		args, err := test.command.jobArgs(test.directives)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(args, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, args, test.want)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	jarvice "jarvice.io/jarvice-hpc/core"
+)
+
+type SAcctCommand struct {
+	Help       bool   `short:"h" long:"help" description:"Show this help message"`
+	Jobs       string `short:"j" long:"jobs" description:"Displays information about the specified comma separated list of job IDs"`
+	StartTime  string `short:"S" long:"starttime" description:"Select jobs eligible after the specified time. Default is 00:00:00 of the current day, unless -j is used"`
+	EndTime    string `short:"E" long:"endtime" description:"Select jobs eligible before the specified time. Default is now"`
+	States     string `short:"s" long:"state" description:"Selects jobs based on a comma separated list of states (e.g. CD,F,CA or COMPLETED)"`
+	Allocation bool   `short:"X" long:"allocations" description:"Only show statistics relevant to the job allocation itself, not taking steps into consideration"`
+	NoHeader   bool   `short:"n" long:"noheader" description:"No heading will be added to the output"`
+	Parsable   bool   `short:"P" long:"parsable2" description:"Output will be delimited without a trailing delimiter"`
+	Delimiter  string `long:"delimiter" description:"Delimiter used with --parsable2" default:"|"`
+	Format     string `short:"o" long:"format" description:"Comma separated list of fields (use \"%NUMBER\" to set the field width)\nJobID,JobName,Partition,Account,State,ExitCode,Elapsed,Start,End,NNodes,NodeList,Submit"`
+}
+
+var sAcctCommand SAcctCommand
+
+const sacctDefaultFormat = "JobID,JobName,Partition,Account,State,ExitCode"
+
+// sacct fields and default widths
+var sacctFieldWidths = map[string]int{
+	"JobID":     12,
+	"JobName":   10,
+	"Partition": 10,
+	"Account":   10,
+	"State":     10,
+	"ExitCode":  8,
+	"Elapsed":   10,
+	"Start":     19,
+	"End":       19,
+	"NNodes":    8,
+	"NodeList":  15,
+	"Submit":    19,
+}
+
+type sacctField struct {
+	Name  string
+	Width int
+}
+
+// Parse sacct --format (e.g. "JobID,JobName%30,State")
+func parseSacctFormat(format string) ([]sacctField, error) {
+	fields := []sacctField{}
+	for _, item := range strings.Split(format, ",") {
+		if len(item) == 0 {
+			continue
+		}
+		parts := strings.SplitN(item, "%", 2)
+		field := sacctField{}
+		for name, width := range sacctFieldWidths {
+			if strings.EqualFold(name, parts[0]) {
+				field = sacctField{Name: name, Width: width}
+			}
+		}
+		if len(field.Name) == 0 {
+			return nil, errors.New("Invalid field requested: \"" + parts[0] + "\"")
+		}
+		if len(parts) == 2 {
+			width, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return nil, errors.New("Invalid field width: \"" + item + "\"")
+			}
+			field.Width = width
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// sacct times refer to the past: a time of day is for the current day
+// and a date without year is in the current year
+func parseSacctTime(spec string, now time.Time) (time.Time, error) {
+	lower := strings.ToLower(strings.TrimSpace(spec))
+	if strings.HasPrefix(lower, "now-") {
+		later, err := parseSlurmTime("now+"+lower[len("now-"):], now)
+		if err != nil {
+			return time.Time{}, errors.New("Invalid time specification: " + spec)
+		}
+		return now.Add(now.Sub(later)), nil
+	}
+	t, err := parseSlurmTime(lower, now)
+	if err != nil {
+		return t, err
+	}
+	if regexp.MustCompile("^[0-9]{1,2}:[0-9]{2}").MatchString(lower) {
+		return time.Date(now.Year(), now.Month(), now.Day(),
+			t.Hour(), t.Minute(), t.Second(), 0, now.Location()), nil
+	}
+	if regexp.MustCompile("^[0-9]{2}[/.]?[0-9]{2}$").MatchString(lower) &&
+		t.Year() > now.Year() {
+		return t.AddDate(-1, 0, 0), nil
+	}
+	return t, nil
+}
+
+// Format elapsed seconds as [DD-]HH:MM:SS
+func sacctElapsed(seconds int64) string {
+	days := seconds / 86400
+	hours := (seconds % 86400) / 3600
+	mins := (seconds % 3600) / 60
+	secs := seconds % 60
+	if days > 0 {
+		return fmt.Sprintf("%d-%02d:%02d:%02d", days, hours, mins, secs)
+	}
+	return fmt.Sprintf("%02d:%02d:%02d", hours, mins, secs)
+}
+
+// Slurm exit code (exit code:signal)
+// Shell exit status 128+n is reported as signal n
+func slurmExitCode(code int) string {
+	if code > 128 && code < 128+65 {
+		return fmt.Sprintf("0:%d", code-128)
+	}
+	return fmt.Sprintf("%d:0", code)
+}
+
+// sacct rows (job allocation and batch step) for JARVICE job
+func sacctRows(number int, job jarvice.JarviceJob, req jarvice.JarviceJobRequest,
+	steps bool, now time.Time) []map[string]string {
+	state := job.State()
+	nodeList := "None assigned"
+	if job.StartTime > 0 {
+		nodeList = job.ApiSubmission.Machine.Type
+	}
+	end := "Unknown"
+	if state.Terminal && job.EndTime > 0 {
+		end = slurmTimestamp(int64(job.EndTime))
+	}
+	start := "Unknown"
+	if job.StartTime > 0 {
+		start = slurmTimestamp(int64(job.StartTime))
+	}
+	exitCode := "0:0"
+	if state.Terminal {
+		exitCode = slurmExitCode(job.ExitCode)
+	}
+	row := map[string]string{
+		"JobID":     strconv.Itoa(number),
+		"JobName":   job.Label,
+		"Partition": job.ApiSubmission.Queue,
+		"Account":   scontrolAccount(req, job.User),
+		"State":     state.SlurmLong,
+		"ExitCode":  exitCode,
+		"Elapsed":   sacctElapsed(job.Elapsed(now)),
+		"Start":     start,
+		"End":       end,
+		"NNodes":    strconv.Itoa(job.ApiSubmission.Machine.Nodes),
+		"NodeList":  nodeList,
+		"Submit":    slurmTimestamp(int64(job.SubmitTime)),
+	}
+	rows := []map[string]string{row}
+	if steps && job.StartTime > 0 {
+		step := map[string]string{}
+		for key, val := range row {
+			step[key] = val
+		}
+		step["JobID"] = row["JobID"] + ".batch"
+		step["JobName"] = "batch"
+		step["Partition"] = ""
+		step["NNodes"] = "1"
+		step["Submit"] = start
+		rows = append(rows, step)
+	}
+	return rows
+}
+
+// Pad value right justified to field width (truncated values end with '+')
+func (field sacctField) pad(value string) string {
+	if field.Width <= 0 {
+		return value
+	}
+	if len(value) > field.Width {
+		value = value[:field.Width-1] + "+"
+	}
+	return fmt.Sprintf("%*s", field.Width, value)
+}
+
+func (x *SAcctCommand) printRow(fields []sacctField, row map[string]string) {
+	values := []string{}
+	for _, field := range fields {
+		if x.Parsable {
+			values = append(values, row[field.Name])
+		} else {
+			values = append(values, field.pad(row[field.Name]))
+		}
+	}
+	if x.Parsable {
+		fmt.Println(strings.Join(values, x.Delimiter))
+	} else {
+		fmt.Println(strings.Join(values, " ") + " ")
+	}
+}
+
+func (x *SAcctCommand) Execute(args []string) error {
+	if x.Help {
+		return jarvice.CreateHelpErr()
+	}
+	format := sacctDefaultFormat
+	if len(x.Format) > 0 {
+		format = x.Format
+	}
+	fields, err := parseSacctFormat(format)
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "sacct",
+			Err:     err,
+		}
+	}
+	now := time.Now()
+	windowStart := time.Time{}
+	windowEnd := now
+	if len(x.Jobs) == 0 {
+		windowStart = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	}
+	if len(x.StartTime) > 0 {
+		if windowStart, err = parseSacctTime(x.StartTime, now); err != nil {
+			return &jarvice.SlurmError{
+				Command: "sacct",
+				Err:     err,
+			}
+		}
+	}
+	if len(x.EndTime) > 0 {
+		if windowEnd, err = parseSacctTime(x.EndTime, now); err != nil {
+			return &jarvice.SlurmError{
+				Command: "sacct",
+				Err:     err,
+			}
+		}
+	}
+	cluster, err := jarvice.GetClusterConfig()
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "sacct",
+			Err:     err,
+		}
+	}
+	jarviceJobs, requests, err := jarvice.ReadAllJarviceJobs(cluster)
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "sacct",
+			Err:     err,
+		}
+	}
+	jobFilter := map[string]struct{}(nil)
+	if len(x.Jobs) > 0 {
+		jobFilter = map[string]struct{}{}
+		for _, id := range strings.Split(x.Jobs, ",") {
+			// job steps are reported with job allocation
+			jobFilter[strings.SplitN(id, ".", 2)[0]] = struct{}{}
+		}
+	}
+	stateFilter := squeueFilter(x.States, true)
+	numbers := []int{}
+	for number := range jarviceJobs {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	if !x.NoHeader {
+		header := map[string]string{}
+		dashes := map[string]string{}
+		for _, field := range fields {
+			header[field.Name] = field.Name
+			dashes[field.Name] = strings.Repeat("-", field.Width)
+		}
+		x.printRow(fields, header)
+		if !x.Parsable {
+			x.printRow(fields, dashes)
+		}
+	}
+	for _, number := range numbers {
+		job := jarviceJobs[number]
+		// Only report HPC jobs
+		if len(job.ApiSubmission.Queue) == 0 {
+			continue
+		}
+		if !squeueMatch(jobFilter, strconv.Itoa(number)) {
+			continue
+		}
+		state := job.State()
+		if !squeueMatch(stateFilter, state.Slurm, state.SlurmLong) {
+			continue
+		}
+		// job must be eligible during time window
+		if int64(job.SubmitTime) > windowEnd.Unix() ||
+			(state.Terminal && int64(job.EndTime) < windowStart.Unix()) {
+			continue
+		}
+		for _, row := range sacctRows(number, job, requests[number], !x.Allocation, now) {
+			x.printRow(fields, row)
+		}
+	}
+	return nil
+}
+
+func init() {
+	parser.AddCommand("sacct",
+		"Slurm sacct",
+		"displays accounting data for all jobs and job steps in the Slurm job accounting log",
+		&sAcctCommand)
+}
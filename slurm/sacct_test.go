@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	jarvice "jarvice.io/jarvice-hpc/core"
+)
+
+// Output of run on stdout
+func testStdout(t *testing.T, run func() error) string {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	err = run()
+	os.Stdout = stdout
+	writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestSacctRowsAccount(t *testing.T) {
+	job := jarvice.JarviceJob{
+		Label:     "job",
+		User:      "alice",
+		Status:    jarvice.JobStatusCompleted,
+		StartTime: 1,
+		EndTime:   2,
+	}
+	project := "physics"
+	for _, test := range []struct {
+		req  jarvice.JarviceJobRequest
+		want string
+	}{
+		{jarvice.JarviceJobRequest{}, "alice"},
+		{jarvice.JarviceJobRequest{JobProject: &project}, "physics"},
+	} {
+		rows := sacctRows(42, job, test.req, true, time.Now())
+		if len(rows) != 2 {
+			t.Fatalf("got %d rows, want job and batch step", len(rows))
+		}
+		for _, row := range rows {
+			if row["Account"] != test.want {
+				t.Errorf("%s: account %q, want %q", row["JobID"], row["Account"], test.want)
+			}
+		}
+	}
+}
+
+func TestSacctAccount(t *testing.T) {
+	now := time.Now().Unix()
+	testCluster(t, func(w http.ResponseWriter, r *http.Request) {
+		number, status := 43, "PROCESSING STARTING"
+		if r.URL.Query().Get("completed") == "true" {
+			number, status = 42, "COMPLETED"
+		}
+		fmt.Fprintf(w, `{"%d": {"job_label": "job", "job_owner_username": "alice",
+			"job_status": "%s", "job_submit_time": %d, "job_start_time": %d,
+			"job_end_time": %d, "job_api_submission": {"queue": "default",
+			"job_project": "physics", "machine": {"type": "n8", "nodes": 1}}}}`,
+			number, status, now, now, now)
+	})
+	command := SAcctCommand{Format: "JobID,Account", Parsable: true,
+		Delimiter: "|", Allocation: true, NoHeader: true}
+	out := testStdout(t, func() error { return command.Execute(nil) })
+	if want := "42|physics\n43|physics\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	jarvice "jarvice.io/jarvice-hpc/core"
+)
+
+type SAllocCommand struct {
+	Help        bool   `short:"h" long:"help" description:"Show this help message"`
+	Nodes       int    `short:"N" long:"nodes" description:"Number of nodes be allocated to this job"`
+	NTasks      int    `short:"n" long:"ntasks" description:"Number of tasks. Used with the queue machine types to select machine type and node count"`
+	CpusPerTask int    `short:"c" long:"cpus-per-task" description:"Number of processors per task"`
+	Partition   string `short:"p" long:"partition" description:"Request a specific partition for the resource allocation" default:"default"`
+	Jobname     string `short:"J" long:"job-name" description:"Specify a name for the job allocation" default:"interactive"`
+	Time        string `short:"t" long:"time" description:"Set a limit on the total run time of the job allocation (ignored: JARVICE does not enforce job time limits)"`
+	Account     string `short:"A" long:"account" description:"Charge resources used by this job to specified account"`
+	Args        struct {
+		Command []string `positional-arg-name:"command" description:"command to run in the allocation (default: $SHELL, use -- before command options)"`
+	} `positional-args:"true"`
+}
+
+var sAllocCommand SAllocCommand
+
+// Interval between JARVICE job status requests
+const slurmPollInterval = 5 * time.Second
+
+// Placeholder job keeping an allocation until it is relinquished
+var slurmAllocationScript = jarvice.JobScript{
+	Shell:  "/bin/sh",
+	Script: []byte("while true; do sleep 3600; done\n"),
+}
+
+// Options for sbatch request of a salloc/srun job
+func slurmAllocationOptions(nodes, tasks, cpusPerTask int,
+	partition, jobName, timeLimit, account string) *SBatchCommand {
+
+	return &SBatchCommand{
+		Nodes:       nodes,
+		NTasks:      tasks,
+		CpusPerTask: cpusPerTask,
+		Partition:   partition,
+		Jobname:     jobName,
+		Time:        timeLimit,
+		Account:     account,
+		OpenMode:    "truncate",
+	}
+}
+
+// Submit job and wait until it is running (PROCESSING STARTING) or finished
+// Job is canceled if interrupted while pending
+func slurmStartJob(cluster jarvice.JarviceCluster, req jarvice.JarviceJobRequest,
+	command string) (int, jarvice.JarviceJob, error) {
+
+	resp, err := jarvice.JarviceSubmitJob(cluster.Endpoint, cluster.Insecure, req)
+	if err != nil {
+		return 0, jarvice.JarviceJob{}, &jarvice.SlurmError{
+			Command: command,
+			Err:     err,
+		}
+	}
+	number := resp.Number
+	fmt.Fprintf(os.Stderr, "%s: Pending job allocation %d\n", command, number)
+	fmt.Fprintf(os.Stderr, "%s: job %d queued and waiting for resources\n", command, number)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+	for {
+		job, err := jarvice.GetJobStatus(cluster, number)
+		if err != nil {
+			jarvice.CancelJob(cluster, number, false)
+			return number, job, &jarvice.SlurmError{
+				Command: command,
+				Err:     err,
+			}
+		}
+		if job.Status == jarvice.JobStatusStarting {
+			fmt.Fprintf(os.Stderr, "%s: job %d has been allocated resources\n", command, number)
+			return number, job, nil
+		}
+		if job.State().Terminal {
+			return number, job, nil
+		}
+		select {
+		case <-interrupt:
+			jarvice.CancelJob(cluster, number, false)
+			fmt.Fprintf(os.Stderr, "%s: Job allocation %d has been revoked.\n", command, number)
+			return number, job, &jarvice.ExitError{Code: 1}
+		case <-time.After(slurmPollInterval):
+		}
+	}
+}
+
+// Environment of a command running in an allocation
+func slurmAllocationEnv(req jarvice.JarviceJobRequest, number int,
+	connect jarvice.JarviceConnect) []string {
+
+	nodes := strconv.Itoa(req.Machine.Nodes)
+	return append(os.Environ(),
+		"SLURM_JOB_ID="+strconv.Itoa(number),
+		"SLURM_JOBID="+strconv.Itoa(number),
+		"SLURM_JOB_NAME="+req.JobLabel,
+		"SLURM_JOB_PARTITION="+req.Hpc.Queue,
+		"SLURM_JOB_NUM_NODES="+nodes,
+		"SLURM_NNODES="+nodes,
+		"SLURM_CLUSTER_NAME="+jarvice.ReadJarviceConfigTarget(),
+		"JARVICE_JOB_ADDRESS="+connect.Address)
+}
+
+// Read connection information of a started job
+// JARVICE may not publish the address as soon as the job starts
+func slurmJobConnect(cluster jarvice.JarviceCluster, number int) (jarvice.JarviceConnect, error) {
+	var err error
+	for retry := 0; retry < 12; retry++ {
+		var connect jarvice.JarviceConnect
+		if connect, err = jarvice.GetJobConnect(cluster, number); err == nil &&
+			len(connect.Address) > 0 {
+			return connect, nil
+		}
+		time.Sleep(slurmPollInterval)
+	}
+	if err == nil {
+		err = errors.New("no address for job " + strconv.Itoa(number))
+	}
+	return jarvice.JarviceConnect{}, err
+}
+
+// Start placeholder job and read its connection information
+func slurmAllocate(cluster jarvice.JarviceCluster, req jarvice.JarviceJobRequest,
+	command string) (int, jarvice.JarviceConnect, error) {
+
+	number, job, err := slurmStartJob(cluster, req, command)
+	if err == nil && job.State().Terminal {
+		err = &jarvice.SlurmError{
+			Command: command,
+			Err: fmt.Errorf("job %d ended before allocation was granted (%s)",
+				number, job.Status),
+		}
+	}
+	if err != nil {
+		return number, jarvice.JarviceConnect{}, err
+	}
+	connect, err := slurmJobConnect(cluster, number)
+	if err != nil {
+		slurmRelinquish(cluster, number, command)
+		return number, connect, &jarvice.SlurmError{
+			Command: command,
+			Err:     err,
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%s: Granted job allocation %d\n", command, number)
+	fmt.Fprintf(os.Stderr, "%s: Job %d is reachable at %s\n", command, number, connect.Address)
+	return number, connect, nil
+}
+
+// Release allocation (shutdown placeholder job)
+func slurmRelinquish(cluster jarvice.JarviceCluster, number int, command string) {
+	fmt.Fprintf(os.Stderr, "%s: Relinquishing job allocation %d\n", command, number)
+	if err := jarvice.CancelJob(cluster, number, false); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: error: unable to release job allocation %d: %v\n",
+			command, number, err)
+	}
+}
+
+// Exit status of command (128+signal if killed by a signal, like a shell)
+func slurmExitStatus(exitErr *exec.ExitError) int {
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exitErr.ExitCode()
+}
+
+// Run command attached to terminal
+// Interrupts are left to the command
+// Returns the exit status of the command as ExitError
+func slurmRunAttached(command, name string, args []string, env []string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = env
+	signal.Ignore(os.Interrupt)
+	defer signal.Reset(os.Interrupt)
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return &jarvice.ExitError{Code: slurmExitStatus(exitErr)}
+	} else if err != nil {
+		return &jarvice.SlurmError{
+			Command: command,
+			Err:     err,
+		}
+	}
+	return nil
+}
+
+func (x *SAllocCommand) Execute(args []string) error {
+	if x.Help {
+		return jarvice.CreateHelpErr()
+	}
+	command := x.Args.Command
+	if len(command) == 0 {
+		shell := os.Getenv("SHELL")
+		if len(shell) == 0 {
+			shell = "/bin/sh"
+		}
+		command = []string{shell}
+	}
+	cluster, err := jarvice.GetClusterConfig()
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "salloc",
+			Err:     err,
+		}
+	}
+	opts := slurmAllocationOptions(x.Nodes, x.NTasks, x.CpusPerTask,
+		x.Partition, x.Jobname, x.Time, x.Account)
+	req, _, err := opts.jobRequest(cluster, slurmAllocationScript, x.Jobname, nil)
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "salloc",
+			Err:     err,
+		}
+	}
+	number, connect, err := slurmAllocate(cluster, req, "salloc")
+	if err != nil {
+		return err
+	}
+	defer slurmRelinquish(cluster, number, "salloc")
+	return slurmRunAttached("salloc", command[0], command[1:],
+		slurmAllocationEnv(req, number, connect))
+}
+
+func init() {
+	parser.AddCommand("salloc",
+		"Slurm salloc",
+		"Obtain a Slurm job allocation, execute a command, and then release the allocation when the command is finished",
+		&sAllocCommand)
+}
@@ -10,27 +10,43 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jessevdk/go-flags"
 	jarvice "jarvice.io/jarvice-hpc/core"
 )
 
 type SBatchCommand struct {
-	Help      bool   `short:"h" long:"help" description:"Show this help message"`
-	Chdir     string `short:"D" long:"chdir" description:"working directory"`
-	Jobname   string `short:"J" long:"job-name" description:"Specify a name for the job allocation"`
-	Nodes     int    `short:"N" long:"nodes" description:"Number of nodes be allocated to this job"`
-	Time      string `short:"t" long:"time" description:"time limit hours:minutes:seconds"`
-	Partition string `short:"p" long:"partition" description:"Request a specific partition for the resource allocation" default:"default"`
-	Account   string `short:"A" long:"account" description:"Charge resources used by this job to specified account"`
-	NodeInfo  string `short:"B" long:"extra-node-info" description:"Restrict node selection to nodes with at least the specified number of sockets, cores per socket and/or threads per core\nsockets[:cores[:threads]]\nNOTE: JARVICE does not accept socket or thread requests; cores request := sockets x cores"`
-	Gpus      string `short:"G" long:"gpus" description:"Specify the total number of GPUs required for the job"`
-	Mem       string `long:"mem" description:"Specify the real memory required per node. Default units are megabytes. Different units can be specified using the suffix [K|M|G|T]"`
-	Gres      string `long:"gres" description:"Specifies a comma delimited list of generic consumable resources. The format of each entry on the list is \"name[[:type]:count]\""`
-	Args      struct {
+	Help          bool   `short:"h" long:"help" description:"Show this help message"`
+	Chdir         string `short:"D" long:"chdir" description:"working directory"`
+	Jobname       string `short:"J" long:"job-name" description:"Specify a name for the job allocation"`
+	Nodes         int    `short:"N" long:"nodes" description:"Number of nodes be allocated to this job"`
+	Time          string `short:"t" long:"time" description:"time limit hours:minutes:seconds"`
+	Partition     string `short:"p" long:"partition" description:"Request a specific partition for the resource allocation" default:"default"`
+	Account       string `short:"A" long:"account" description:"Charge resources used by this job to specified account"`
+	NodeInfo      string `short:"B" long:"extra-node-info" description:"Restrict node selection to nodes with at least the specified number of sockets, cores per socket and/or threads per core\nsockets[:cores[:threads]]\nNOTE: JARVICE does not accept socket or thread requests; cores request := sockets x cores"`
+	Gpus          string `short:"G" long:"gpus" description:"Specify the total number of GPUs required for the job"`
+	Mem           string `long:"mem" description:"Specify the real memory required per node. Default units are megabytes. Different units can be specified using the suffix [K|M|G|T]"`
+	Gres          string `long:"gres" description:"Specifies a comma delimited list of generic consumable resources. The format of each entry on the list is \"name[[:type]:count]\""`
+	Output        string `short:"o" long:"output" description:"Connect the batch script's standard output directly to the file name specified in the \"filename pattern\"" default:"slurm-%j.out"`
+	Error         string `short:"e" long:"error" description:"Connect the batch script's standard error directly to the file name specified in the \"filename pattern\". By default both standard output and standard error are directed to the same file"`
+	NTasks        int    `short:"n" long:"ntasks" description:"Number of tasks. Used with the queue machine types to select machine type and node count"`
+	NTasksPerNode int    `long:"ntasks-per-node" description:"Request that ntasks be invoked on each node"`
+	CpusPerTask   int    `short:"c" long:"cpus-per-task" description:"Number of processors per task"`
+	MemPerCpu     string `long:"mem-per-cpu" description:"Minimum memory required per allocated CPU. Default units are megabytes"`
+	MemPerGpu     string `long:"mem-per-gpu" description:"Minimum memory required per allocated GPU. Default units are megabytes"`
+	Export        string `long:"export" description:"Identify which environment variables from the submission environment are propagated to the launched application\nALL | NONE | [ALL,]<environment_variable>[=value][,...]\nDefault: ALL (filtered by site)"`
+	TestOnly      bool   `long:"test-only" description:"Validate the batch script and show where each option was set. No job is actually submitted"`
+	Wrap          string `long:"wrap" description:"Sbatch will wrap the specified command string in a simple \"sh\" shell script, and submit that script"`
+	Begin         string `short:"b" long:"begin" description:"Submit the batch script to JARVICE immediately, like normal, but defer the job start until the specified time\nHH:MM[:SS] [AM|PM] | MMDD[YY] | MM/DD[/YY] | YYYY-MM-DD[THH:MM[:SS]] | now[+count[seconds|minutes|hours|days|weeks]] | midnight | noon | teatime"`
+	MailType      string `long:"mail-type" description:"Notify user by email when certain event types occur\nNONE | BEGIN | END | FAIL | REQUEUE | ALL\nNOTE: notifications are sent by the client (sbatch, squeue, ... or jarvice agent)"`
+	MailUser      string `long:"mail-user" description:"User to receive email notification of state changes as defined by --mail-type. The default value is the submitting user"`
+	OpenMode      string `long:"open-mode" description:"Open the output and error files using append or truncate mode as specified" choice:"append" choice:"truncate" default:"truncate"`
+	Args          struct {
 		JobScript []string `positional-arg-name:"jobscript" description:"job script | job command"`
 		//JobCommand string `positional-arg-name:"command" description:
 	} `positional-args:"true"`
@@ -42,6 +58,161 @@ var jobScriptParser = flags.NewNamedParser(jarvice.JobScriptArg,
 
 var jobScriptParserCommand SBatchCommand
 
+// parser for SBATCH_* input environment variables
+var envParser = flags.NewNamedParser(jarvice.JobScriptArg,
+	flags.PassDoubleDash|flags.IgnoreUnknown)
+
+var envParserCommand SBatchCommand
+
+// Slurm input environment variables and matching sbatch options
+// Precedence: command line > environment > script directives
+var sbatchInputEnvs = []struct {
+	Env    string
+	Option string
+}{
+	{"SBATCH_ACCOUNT", "account"},
+	{"SBATCH_EXPORT", "export"},
+	{"SBATCH_GPUS", "gpus"},
+	{"SBATCH_GRES", "gres"},
+	{"SBATCH_JOB_NAME", "job-name"},
+	{"SBATCH_MEM_PER_CPU", "mem-per-cpu"},
+	{"SBATCH_MEM_PER_GPU", "mem-per-gpu"},
+	{"SBATCH_MEM_PER_NODE", "mem"},
+	{"SBATCH_OPEN_MODE", "open-mode"},
+	{"SBATCH_PARTITION", "partition"},
+	{"SBATCH_TIMELIMIT", "time"},
+}
+
+// Build sbatch arguments from input environment variables
+// Returns arguments and environment variable used for each option
+func sbatchEnvArgs(environ []string) ([]string, map[string]string) {
+	envs := map[string]string{}
+	for _, env := range environ {
+		if name, value, ok := jarvice.SplitEnv(env); ok {
+			envs[name] = value
+		}
+	}
+	args := []string{}
+	sources := map[string]string{}
+	for _, input := range sbatchInputEnvs {
+		if value, ok := envs[input.Env]; ok && len(value) > 0 {
+			args = append(args, "--"+input.Option, value)
+			sources[input.Option] = input.Env
+		}
+	}
+	return args, sources
+}
+
+// Print resolved sbatch options and where each was set (--test-only)
+func printSbatchSources(x *SBatchCommand, envSources map[string]string) {
+	table := [][]string{
+		{"OPTION", "VALUE", "SOURCE"},
+	}
+	for _, option := range parser.Active.Options() {
+		name := option.LongName
+		if len(name) == 0 || name == "help" || name == "test-only" {
+			continue
+		}
+		source := ""
+		if option.IsSet() && !option.IsSetDefault() {
+			source = "command line"
+		} else if env, ok := envSources[name]; ok {
+			source = "environment (" + env + ")"
+		} else if scriptOption := jobScriptParser.Active.FindOptionByLongName(name); scriptOption != nil &&
+			scriptOption.IsSet() && !scriptOption.IsSetDefault() {
+			source = "script"
+		} else if len(option.Default) > 0 {
+			source = "default"
+		} else {
+			continue
+		}
+		value := reflect.ValueOf(x).Elem().FieldByName(option.Field().Name)
+		table = append(table, []string{"--" + name, fmt.Sprint(value.Interface()), source})
+	}
+	jarvice.PrintTable(table, false)
+}
+
+// Environment exported to the job (sbatch --export)
+func slurmExportEnvs(export string, environ []string) map[string]string {
+	envs := map[string]string{}
+	current := map[string]string{}
+	for _, env := range environ {
+		if name, value, ok := jarvice.SplitEnv(env); ok {
+			current[name] = value
+		}
+	}
+	if len(export) == 0 {
+		export = "ALL"
+	}
+	for _, item := range strings.Split(export, ",") {
+		switch item {
+		case "ALL":
+			for name, value := range jarvice.FilterEnvironment(environ) {
+				envs[name] = value
+			}
+		case "NONE", "NIL", "":
+		default:
+			// explicitly requested variables bypass the site filter
+			if name, value, ok := jarvice.SplitEnv(item); ok {
+				envs[name] = value
+			} else if value, ok := current[item]; ok {
+				envs[item] = value
+			}
+		}
+	}
+	return envs
+}
+
+// Notification events of sbatch --mail-type
+// Events JARVICE does not report (e.g. TIME_LIMIT_90) are accepted and ignored
+func slurmMailEvents(mailType string) ([]string, error) {
+	if len(mailType) == 0 {
+		return nil, nil
+	}
+	events := []string{}
+	add := func(event string) {
+		for _, val := range events {
+			if val == event {
+				return
+			}
+		}
+		events = append(events, event)
+	}
+	for _, item := range strings.Split(strings.ToUpper(mailType), ",") {
+		switch item {
+		case "NONE":
+			events = []string{}
+		case "BEGIN":
+			add(jarvice.NotifyBegin)
+		case "END":
+			add(jarvice.NotifyEnd)
+		case "FAIL":
+			add(jarvice.NotifyFail)
+		case "REQUEUE":
+			add(jarvice.NotifyRequeue)
+		case "ALL":
+			add(jarvice.NotifyBegin)
+			add(jarvice.NotifyEnd)
+			add(jarvice.NotifyFail)
+			add(jarvice.NotifyRequeue)
+		case "INVALID_DEPEND", "STAGE_OUT", "TIME_LIMIT", "TIME_LIMIT_90",
+			"TIME_LIMIT_80", "TIME_LIMIT_50", "ARRAY_TASKS":
+		default:
+			return nil, errors.New("--mail-type=" + mailType + " invalid")
+		}
+	}
+	return events, nil
+}
+
+// Watch submitted job for --mail-type notifications (best effort)
+func slurmWatchJob(id int, name, mailType, mailUser string) {
+	events, _ := slurmMailEvents(mailType)
+	if err := jarvice.WatchJob(id, name, events,
+		jarvice.NotifyRecipients(mailUser)); err != nil {
+		log.Println("sbatch: WARNING unable to watch job for notifications: " + err.Error())
+	}
+}
+
 type slurmGres struct {
 	Type  string
 	Count string
@@ -74,7 +245,202 @@ func parseSlurmResources(resources string) slurmResources {
 	return res
 }
 
-func decodeMemReq(req string) (mem int, err error) {
+// Convert Slurm filename pattern into a shell word expanded at job start
+// (job ID is only known by the remote job)
+// e.g. "%x-%4j.out" => "$(printf '%s-%04d.out' 'name' "${jobid}")"
+func slurmFilenamePattern(pattern, jobName, user string) string {
+	quote := jarvice.ShellQuote
+	// a backslash disables processing of replacement symbols
+	if strings.Contains(pattern, "\\") {
+		return quote(strings.ReplaceAll(pattern, "\\", ""))
+	}
+	format := ""
+	args := []string{}
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i == len(pattern)-1 {
+			format += strings.ReplaceAll(string(pattern[i]), "%", "%%")
+			continue
+		}
+		// optional zero padding (e.g. %4a)
+		j := i + 1
+		for j < len(pattern) && pattern[j] >= '0' && pattern[j] <= '9' {
+			j++
+		}
+		if j == len(pattern) {
+			format += strings.ReplaceAll(pattern[i:], "%", "%%")
+			break
+		}
+		pad := "%d"
+		if width, err := strconv.Atoi(pattern[i+1 : j]); err == nil {
+			if width > 10 {
+				width = 10
+			}
+			pad = "%0" + strconv.Itoa(width) + "d"
+		}
+		switch pattern[j] {
+		case '%':
+			format += "%%"
+		case 'j':
+			format += pad
+			args = append(args, `"${jobid}"`)
+		case 'A':
+			format += pad
+			args = append(args, `"${SLURM_ARRAY_JOB_ID:-${jobid}}"`)
+		case 'a':
+			format += pad
+			args = append(args, `"${SLURM_ARRAY_TASK_ID:-4294967294}"`)
+		case 'n':
+			format += pad
+			args = append(args, `"${SLURM_NODEID:-0}"`)
+		case 't':
+			format += pad
+			args = append(args, `"${SLURM_PROCID:-0}"`)
+		case 'N':
+			format += "%s"
+			args = append(args, `"$(hostname -s)"`)
+		case 's':
+			format += "%s"
+			args = append(args, quote("batch"))
+		case 'u':
+			format += "%s"
+			args = append(args, quote(user))
+		case 'x':
+			format += "%s"
+			args = append(args, quote(jobName))
+		default:
+			// unknown replacement symbols are kept as is
+			format += strings.ReplaceAll(pattern[i:j+1], "%", "%%")
+		}
+		i = j
+	}
+	return `"$(printf ` + strings.Join(append([]string{quote(format)}, args...), " ") + `)"`
+}
+
+// Build shell redirections for job standard output and error files
+// Output is left on the job console if no output file is set (srun)
+func slurmOutputRedirect(output, errorFile, openMode, jobName, user string) string {
+	if len(output) == 0 && len(errorFile) == 0 {
+		return ""
+	}
+	mode := ">"
+	if openMode == "append" {
+		mode = ">>"
+	}
+	redirect := "exec"
+	if len(output) > 0 {
+		redirect += " " + mode + slurmFilenamePattern(output, jobName, user)
+	}
+	if len(errorFile) > 0 {
+		redirect += " 2" + mode + slurmFilenamePattern(errorFile, jobName, user)
+	} else {
+		redirect += " 2>&1"
+	}
+	return redirect + " && "
+}
+
+// Next occurrence of time of day (today or tomorrow)
+func nextTimeOfDay(now time.Time, hour, min, sec int) time.Time {
+	ret := time.Date(now.Year(), now.Month(), now.Day(), hour, min, sec, 0, now.Location())
+	if ret.Before(now) {
+		ret = ret.AddDate(0, 0, 1)
+	}
+	return ret
+}
+
+// Parse Slurm time specification (sbatch --begin)
+func parseSlurmTime(spec string, now time.Time) (time.Time, error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	invalidErr := errors.New("Invalid time specification: " + spec)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch spec {
+	case "now":
+		return now, nil
+	case "today":
+		return midnight, nil
+	case "tomorrow":
+		return midnight.AddDate(0, 0, 1), nil
+	case "midnight":
+		return midnight.AddDate(0, 0, 1), nil
+	case "noon":
+		return nextTimeOfDay(now, 12, 0, 0), nil
+	case "elevenses":
+		return nextTimeOfDay(now, 11, 0, 0), nil
+	case "fika":
+		return nextTimeOfDay(now, 15, 0, 0), nil
+	case "teatime":
+		return nextTimeOfDay(now, 16, 0, 0), nil
+	}
+	// now+count[units]
+	if strings.HasPrefix(spec, "now+") {
+		re := regexp.MustCompile("^now\\+([0-9]+)([a-z]*)$")
+		match := re.FindStringSubmatch(spec)
+		if match == nil {
+			return time.Time{}, invalidErr
+		}
+		count, _ := strconv.Atoi(match[1])
+		unit := time.Second
+		switch match[2] {
+		case "", "s", "sec", "secs", "second", "seconds":
+		case "m", "min", "mins", "minute", "minutes":
+			unit = time.Minute
+		case "h", "hour", "hours":
+			unit = time.Hour
+		case "d", "day", "days":
+			unit = 24 * time.Hour
+		case "w", "week", "weeks":
+			unit = 7 * 24 * time.Hour
+		default:
+			return time.Time{}, invalidErr
+		}
+		return now.Add(time.Duration(count) * unit), nil
+	}
+	// YYYY-MM-DD[THH:MM[:SS]] (spec is lower case)
+	for _, layout := range []string{"2006-01-02t15:04:05", "2006-01-02t15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, spec, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	// HH:MM[:SS] [AM|PM]
+	re := regexp.MustCompile("^([0-9]{1,2}):([0-9]{2})(:([0-9]{2}))? ?(am|pm)?$")
+	if match := re.FindStringSubmatch(spec); match != nil {
+		hour, _ := strconv.Atoi(match[1])
+		min, _ := strconv.Atoi(match[2])
+		sec, _ := strconv.Atoi(match[4])
+		if match[5] == "pm" && hour < 12 {
+			hour += 12
+		} else if match[5] == "am" && hour == 12 {
+			hour = 0
+		}
+		if hour > 23 || min > 59 || sec > 59 {
+			return time.Time{}, invalidErr
+		}
+		return nextTimeOfDay(now, hour, min, sec), nil
+	}
+	// MMDD[YY] | MM/DD[/YY] | MM.DD[.YY]
+	re = regexp.MustCompile("^([0-9]{2})[/.]?([0-9]{2})([/.]?([0-9]{2}))?$")
+	if match := re.FindStringSubmatch(spec); match != nil {
+		month, _ := strconv.Atoi(match[1])
+		day, _ := strconv.Atoi(match[2])
+		year := now.Year()
+		if len(match[4]) > 0 {
+			yy, _ := strconv.Atoi(match[4])
+			year = 2000 + yy
+		}
+		if month < 1 || month > 12 || day < 1 || day > 31 {
+			return time.Time{}, invalidErr
+		}
+		ret := time.Date(year, time.Month(month), day, 0, 0, 0, 0, now.Location())
+		// date without year is assumed in the future
+		if len(match[4]) == 0 && ret.Before(midnight) {
+			ret = ret.AddDate(1, 0, 0)
+		}
+		return ret, nil
+	}
+	return time.Time{}, invalidErr
+}
+
+// Decode memory request in megabytes (default unit)
+func decodeMemReqMB(req string) (mem int, err error) {
 	re := regexp.MustCompile("^[0-9]+")
 	te := regexp.MustCompile("[KMGT]$")
 	if match := re.FindString(req); len(match) > 0 {
@@ -82,19 +448,18 @@ func decodeMemReq(req string) (mem int, err error) {
 			if mag := te.FindString(req); len(mag) > 0 {
 				switch mag {
 				case "K":
-					mem = int(base) * 1024
+					mem = int(math.Ceil(float64(base) / 1024))
 				case "M":
-					mem = int(base) * 1024 * 1024
+					mem = int(base)
 				case "G":
-					mem = int(base) * 1024 * 1024 * 1024
+					mem = int(base) * 1024
 				case "T":
-					mem = int(base) * 1024 * 1024 * 1024 * 1024
+					mem = int(base) * 1024 * 1024
 				}
 
 			} else {
-				mem = int(base) * 1024 * 1024
+				mem = int(base)
 			}
-			mem = int(math.Ceil(float64(mem) / float64((1024 * 1024 * 1024))))
 			return
 		}
 	}
@@ -102,60 +467,58 @@ func decodeMemReq(req string) (mem int, err error) {
 	return
 }
 
-func (x *SBatchCommand) Execute(args []string) error {
-	// leave early if parsing jobscript arguments
-	if jobScriptParser.Active != nil &&
-		jobScriptParser.Active.Name == jarvice.JobScriptArg {
-		return nil
+// Decode memory request in gigabytes (rounded up)
+func decodeMemReq(req string) (mem int, err error) {
+	if mem, err = decodeMemReqMB(req); err == nil {
+		mem = int(math.Ceil(float64(mem) / 1024))
 	}
+	return
+}
 
-	if x.Help {
-		return jarvice.CreateHelpErr()
+// Decode GPU count from --gpus request ([type:]number)
+func decodeGpuReq(req string) int {
+	split := strings.Split(req, ":")
+	if count, err := strconv.Atoi(split[len(split)-1]); err == nil {
+		return count
 	}
+	return 0
+}
 
-	// Set jobscript name
-	jobScriptFilename := "STDIN"
-	submitCommand := "STDIN"
-	if len(x.Args.JobScript) == 1 {
-		jobScriptFilename = x.Args.JobScript[0]
-	} else if len(x.Args.JobScript) > 1 {
-		submitCommand = strings.Join(x.Args.JobScript, " ")
+// Slurm compressed tasks per node (e.g. 10 tasks over 3 nodes => 4(x2),2)
+func slurmTasksPerNode(tasks, tasksPerNode, nodes int) string {
+	counts := []int{}
+	for node := 0; node < nodes; node++ {
+		count := tasksPerNode
+		if tasks < count {
+			count = tasks
+		}
+		tasks -= count
+		counts = append(counts, count)
 	}
-
-	var jobScript jarvice.JobScript
-
-	if len(jobScriptFilename) > 0 {
-		if val, jerr := jarvice.ParseJobScript("SBATCH", jobScriptFilename); jerr != nil {
-			return errors.New("sbatch: WARNING unable to parse job script")
-		} else {
-			jobScript = val
+	ret := []string{}
+	for i := 0; i < len(counts); {
+		j := i
+		for j < len(counts) && counts[j] == counts[i] {
+			j++
 		}
-	} else {
-		jobScript = jarvice.JobScript{
-			Shell:  "/bin/sh",
-			Script: []byte(submitCommand),
+		if j-i > 1 {
+			ret = append(ret, fmt.Sprintf("%d(x%d)", counts[i], j-i))
+		} else {
+			ret = append(ret, strconv.Itoa(counts[i]))
 		}
+		i = j
 	}
-	// parse flags from jobscript (CLI flags take precedence;override == false)
-	if jarvice.ParseJobFlags(x,
-		parser,
-		jobScriptParser,
-		append([]string{jarvice.JobScriptArg}, jobScript.Args...),
-		false) != nil {
-		// Best effort
-		fmt.Println("WARNING: unable to parse flags in jobscript")
-	}
+	return strings.Join(ret, ",")
+}
 
-	jobScriptFilename = filepath.Base(jobScriptFilename)
+// Build JARVICE job request for job script and sbatch options
+// (shared with salloc and srun)
+func (x *SBatchCommand) jobRequest(cluster jarvice.JarviceCluster,
+	jobScript jarvice.JobScript, jobScriptFilename string,
+	scriptArgs []string) (jarvice.JarviceJobRequest, jarvice.JarviceQueue, error) {
 
 	resources := parseSlurmResources(x.Gres)
 
-	// Read JARVICE config for selected cluster
-	cluster, err := jarvice.GetClusterConfig()
-	if err != nil {
-		return nil
-	}
-
 	queueName := x.Partition
 	// need JARVICE API creds, 'info', and 'name' for /jarvice/queues request
 	urlValues := cluster.GetUrlCreds()
@@ -168,10 +531,10 @@ func (x *SBatchCommand) Execute(args []string) error {
 		urlValues); err == nil {
 
 		if err := json.Unmarshal(resp, &jarviceQueues); err != nil {
-			return errors.New("sbatch: " + err.Error())
+			return jarvice.JarviceJobRequest{}, jarvice.JarviceQueue{}, err
 		}
 	} else {
-		return errors.New("sbatch: connot find partition: " + queueName + "  " + err.Error())
+		return jarvice.JarviceJobRequest{}, jarvice.JarviceQueue{}, errors.New("cannot find partition: " + queueName + ": " + err.Error())
 	}
 	var myQueue jarvice.JarviceQueue
 	for _, queue := range jarviceQueues {
@@ -198,7 +561,7 @@ func (x *SBatchCommand) Execute(args []string) error {
 		ipString = myPrivateIP + " " + myHostname
 	}
 	// Set Slurm Output Environment Variables
-	slurmEnvs := make(map[string]string)
+	slurmEnvs := slurmExportEnvs(x.Export, os.Environ())
 	slurmEnvs["SLURM_CLUSTER_NAME"] = jarvice.ReadJarviceConfigTarget()
 	if len(x.Account) > 0 {
 		slurmEnvs["SLURM_JOB_ACCOUNT"] = x.Account
@@ -237,6 +600,10 @@ func (x *SBatchCommand) Execute(args []string) error {
 			`ips=$(cat /var/JARVICE/c/hosts | awk '{print $1}' | xargs);` +
 			`hosts=$(cat /var/JARVICE/c/hosts | awk '{print $2}' | xargs);` +
 			`sge_hosts="$(join , $hosts)";` +
+			jarvice.JobShimEnvConfig(slurmJobCommands...) +
+			`slurm_hosts="$(scontrol show hostlist "$sge_hosts" 2>/dev/null || echo "$sge_hosts")";` +
+			`slurm_host="$(hostname)";` +
+			jarvice.JobIdEnvConfig +
 			`numcpu="$(cat /etc/JARVICE/cores | grep $(hostname) | wc -l)";` +
 			`numnodes="$(cat /etc/JARVICE/nodes | wc -l )";` +
 			`cpupernode="$(( $(cat /etc/JARVICE/cores | wc -l) / $(cat /etc/JARVICE/nodes | wc -l) ))";` +
@@ -244,6 +611,10 @@ func (x *SBatchCommand) Execute(args []string) error {
 			`echo ` + ipString + ` | sudo tee -a /etc/hosts || true`,
 		JobScript: base64.StdEncoding.EncodeToString(jobScript.Script),
 		JobShell: "cd " + cwd + " && " +
+			slurmOutputRedirect(x.Output, x.Error, x.OpenMode,
+				slurmEnvs["SLURM_JOB_NAME"], cluster.Creds.Username) +
+			"SLURM_JOB_ID=${jobid} " +
+			"SLURM_JOBID=${jobid} " +
 			"SLURM_JOB_NODELIST=${slurm_hosts} " +
 			"SLURM_NODELIST=${slurm_hosts} " +
 			"SLURM_NODE_ALIASES=${host_alias} " +
@@ -253,7 +624,8 @@ func (x *SBatchCommand) Execute(args []string) error {
 			"SLURM_NNODES=${numnodes} " +
 			"SLURM_JOB_CPUS_PER_NODE=${cpupernode} " +
 			"SLURM_PROCID=${procid} " +
-			jobScript.Shell,
+			jarvice.JobShellCommand(jobScript.Shell, scriptArgs),
+		JobArgs:   scriptArgs,
 		Queue:     myQueue.Name,
 		Umask:     0,
 		Envs:      slurmEnvs,
@@ -317,13 +689,62 @@ func (x *SBatchCommand) Execute(args []string) error {
 	if x.Nodes > 0 {
 		nodeScale = x.Nodes
 	}
+	machineType := myQueue.DefaultMachine
+	// resolve task geometry into machine type and scale
+	if x.NTasks > 0 || x.NTasksPerNode > 0 || x.CpusPerTask > 0 ||
+		len(x.MemPerCpu) > 0 || len(x.MemPerGpu) > 0 {
+		machineReq := jarvice.MachineRequest{
+			Nodes:        x.Nodes,
+			Tasks:        x.NTasks,
+			TasksPerNode: x.NTasksPerNode,
+			CpusPerTask:  x.CpusPerTask,
+			Gpus:         decodeGpuReq(x.Gpus),
+		}
+		if val := x.MemPerCpu; len(val) > 0 {
+			if mb, err := decodeMemReqMB(val); err == nil {
+				machineReq.MemPerCpu = mb
+			}
+		}
+		if val := x.MemPerGpu; len(val) > 0 {
+			if mb, err := decodeMemReqMB(val); err == nil {
+				machineReq.MemPerGpu = mb
+			}
+		}
+		machines, err := jarvice.GetJarviceMachines(cluster)
+		if err != nil {
+			return jarvice.JarviceJobRequest{}, jarvice.JarviceQueue{}, errors.New("cannot read machines: " + err.Error())
+		}
+		selection, err := jarvice.SelectMachine(machineReq, myQueue, machines)
+		if err != nil {
+			return jarvice.JarviceJobRequest{}, jarvice.JarviceQueue{}, errors.New("Batch job submission failed: " + err.Error())
+		}
+		machineType = selection.Machine
+		nodeScale = selection.Nodes
+		myHpcReq.Resources["mc_name"] = machineType
+		myHpcReq.Resources["mc_cores"] = strconv.Itoa(selection.CoresPerNode)
+		if memReq == 0 {
+			memPerNode := selection.TasksPerNode * selection.CpusPerTask * machineReq.MemPerCpu
+			gpusPerNode := math.Ceil(float64(machineReq.Gpus) / float64(selection.Nodes))
+			memPerNode += int(gpusPerNode) * machineReq.MemPerGpu
+			myHpcReq.Resources["mc_ram"] = strconv.Itoa(
+				int(math.Ceil(float64(memPerNode) / 1024)))
+		}
+		slurmEnvs["SLURM_NTASKS"] = strconv.Itoa(selection.Tasks)
+		slurmEnvs["SLURM_NPROCS"] = strconv.Itoa(selection.Tasks)
+		slurmEnvs["SLURM_NTASKS_PER_NODE"] = strconv.Itoa(selection.TasksPerNode)
+		slurmEnvs["SLURM_TASKS_PER_NODE"] = slurmTasksPerNode(selection.Tasks,
+			selection.TasksPerNode, selection.Nodes)
+		if x.CpusPerTask > 0 {
+			slurmEnvs["SLURM_CPUS_PER_TASK"] = strconv.Itoa(x.CpusPerTask)
+		}
+	}
 	// check if scale request is larger than queue size
 	if nodeScale > myQueue.MachineScale {
-		return errors.New("sbatch: -Nodes request larger than partition size (" +
+		return jarvice.JarviceJobRequest{}, jarvice.JarviceQueue{}, errors.New("-Nodes request larger than partition size (" +
 			strconv.Itoa(myQueue.MachineScale) + ")")
 	}
 	myMachine := jarvice.JarviceMachine{
-		Type:  myQueue.DefaultMachine,
+		Type:  machineType,
 		Nodes: nodeScale,
 	}
 	// TODO: set ReadOnly and Force options?
@@ -348,15 +769,370 @@ func (x *SBatchCommand) Execute(args []string) error {
 		Licenses:    hpcLicenses,
 		JobProject:  jobProject,
 	}
+	return myReq, myQueue, nil
+}
+
+// Parser of sbatch options into command
+// (used for options of heterogeneous job components)
+func sbatchOptionParser(command *SBatchCommand) *flags.Parser {
+	// arguments after the job script belong to the job script
+	optionParser := flags.NewNamedParser(jarvice.JobScriptArg,
+		flags.PassDoubleDash|flags.IgnoreUnknown|flags.PassAfterNonOption)
+	optionParser.AddCommand(jarvice.JobScriptArg,
+		jarvice.JobScriptArg,
+		jarvice.JobScriptArg,
+		command)
+	return optionParser
+}
+
+// Split sbatch arguments into heterogeneous job components
+// Components are separated by ":" before the job script (e.g. sbatch -N 1 : -N 2 job.sh)
+// Options of the first component are the arguments before the positional arguments
+// Returns nil if job is not heterogeneous, and the job script with its arguments
+func sbatchHetjobArgs(positional, args []string) ([][]string, []string, error) {
+	if len(positional) == 0 || positional[0] != ":" {
+		return nil, positional, nil
+	}
+	components := [][]string{args[:len(args)-len(positional)]}
+	for len(positional) > 0 && positional[0] == ":" {
+		rest := positional[1:]
+		component := &SBatchCommand{}
+		pArgs, err := jarvice.PreprocessArgs(append([]string{jarvice.JobScriptArg}, rest...))
+		if err == nil {
+			_, err = sbatchOptionParser(component).ParseArgs(pArgs)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid options for hetjob component %d: %v",
+				len(components), err)
+		}
+		// options of the component end where its positional arguments begin
+		positional = rest[len(rest)-len(component.Args.JobScript):]
+		components = append(components, rest[:len(rest)-len(positional)])
+	}
+	return components, positional, nil
+}
+
+// Options of heterogeneous job components
+// Precedence for each component: command line > environment > script directives
+func sbatchHetjobComponents(cliArgs, scriptArgs [][]string,
+	envArgs []string) ([]*SBatchCommand, error) {
+
+	size := len(cliArgs)
+	if len(scriptArgs) > size {
+		size = len(scriptArgs)
+	}
+	components := []*SBatchCommand{}
+	for index := 0; index < size; index++ {
+		component := &SBatchCommand{}
+		cliParser := sbatchOptionParser(component)
+		args := []string{jarvice.JobScriptArg}
+		if index < len(cliArgs) {
+			args = append(args, cliArgs[index]...)
+		}
+		pArgs, err := jarvice.PreprocessArgs(args)
+		if err == nil {
+			_, err = cliParser.ParseArgs(pArgs)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid options for hetjob component %d: %v",
+				index, err)
+		}
+		if index < len(scriptArgs) {
+			if jarvice.ParseJobFlags(component,
+				cliParser,
+				sbatchOptionParser(&SBatchCommand{}),
+				append([]string{jarvice.JobScriptArg}, scriptArgs[index]...),
+				false) != nil {
+				// Best effort
+				fmt.Printf("WARNING: unable to parse flags in jobscript (hetjob component %d)\n", index)
+			}
+		}
+		if len(envArgs) > 0 {
+			if jarvice.ParseJobFlags(component,
+				cliParser,
+				sbatchOptionParser(&SBatchCommand{}),
+				append([]string{jarvice.JobScriptArg}, envArgs...),
+				false) != nil {
+				// Best effort
+				fmt.Println("WARNING: unable to parse SBATCH_* environment variables")
+			}
+		}
+		// components share the job name of the first component
+		if index > 0 && len(component.Jobname) == 0 {
+			component.Jobname = components[0].Jobname
+		}
+		components = append(components, component)
+	}
+	return components, nil
+}
+
+// Export heterogeneous job information to component
+// numbers holds JARVICE job numbers of components already submitted
+func sbatchHetjobEnvs(req *jarvice.JarviceJobRequest, index int,
+	reqs []jarvice.JarviceJobRequest, numbers []int) {
+
+	envs := req.Hpc.Envs
+	envs["SLURM_HET_SIZE"] = strconv.Itoa(len(reqs))
+	// every component runs the job script
+	envs["SLURM_HET_JOB_OFFSET"] = strconv.Itoa(index)
+	for group, groupReq := range reqs {
+		suffix := "_HET_GROUP_" + strconv.Itoa(group)
+		envs["SLURM_JOB_PARTITION"+suffix] = groupReq.Hpc.Queue
+		envs["SLURM_JOB_NUM_NODES"+suffix] = strconv.Itoa(groupReq.Machine.Nodes)
+		if numbers[group] > 0 {
+			envs["SLURM_JOB_ID"+suffix] = strconv.Itoa(numbers[group])
+		}
+	}
+	// job ID of the component itself is only known in the job
+	req.Hpc.JobShell = strings.Replace(req.Hpc.JobShell, "SLURM_JOB_ID=${jobid} ",
+		"SLURM_JOB_ID=${jobid} SLURM_JOB_ID_HET_GROUP_"+strconv.Itoa(index)+"=${jobid} ", 1)
+}
+
+// Submit heterogeneous job components as JARVICE jobs
+// Components are submitted in reverse order so that the first component
+// (leader) knows the job IDs of all components
+func (x *SBatchCommand) submitHetjob(cliArgs [][]string, jobScript jarvice.JobScript,
+	jobScriptFilename string, scriptArgs, envArgs []string) error {
+
+	components, err := sbatchHetjobComponents(cliArgs,
+		append([][]string{jobScript.Args}, jobScript.Hetjob...), envArgs)
+	if err != nil {
+		return err
+	}
+	testOnly := x.TestOnly
+	for _, component := range components {
+		if len(component.Begin) > 0 {
+			return errors.New("--begin is not supported for heterogeneous jobs")
+		}
+		testOnly = testOnly || component.TestOnly
+		if _, err := slurmMailEvents(component.MailType); err != nil {
+			return err
+		}
+	}
+	cluster, err := jarvice.GetClusterConfig()
+	if err != nil {
+		return err
+	}
+	reqs := []jarvice.JarviceJobRequest{}
+	for index, component := range components {
+		req, queue, err := component.jobRequest(cluster, jobScript, jobScriptFilename, scriptArgs)
+		if err != nil {
+			return err
+		}
+		if testOnly {
+			fmt.Printf("sbatch: Job component %d to start at %s using %d node(s) of %s in partition %s\n",
+				index, time.Now().Format("2006-01-02T15:04:05"), req.Machine.Nodes,
+				req.Machine.Type, queue.Name)
+		}
+		reqs = append(reqs, req)
+	}
+	if testOnly {
+		return nil
+	}
+	numbers := make([]int, len(reqs))
+	for index := len(reqs) - 1; index >= 0; index-- {
+		req := reqs[index]
+		sbatchHetjobEnvs(&req, index, reqs, numbers)
+		resp, err := jarvice.JarviceSubmitJob(cluster.Endpoint, cluster.Insecure, req)
+		if err != nil {
+			// cancel components already submitted
+			for _, number := range numbers[index+1:] {
+				jarvice.CancelJob(cluster, number, false)
+			}
+			return errors.New("hetjob component " + strconv.Itoa(index) +
+				": " + err.Error())
+		}
+		numbers[index] = resp.Number
+	}
+	if err := jarvice.AddHetJob(numbers); err != nil {
+		log.Println("sbatch: WARNING unable to record heterogeneous job: " + err.Error())
+	}
+	// notifications are sent for the leader
+	slurmWatchJob(numbers[0], reqs[0].JobLabel, components[0].MailType,
+		components[0].MailUser)
+	fmt.Printf("Your job %d (\"%s\") has been submitted\n", numbers[0], jobScriptFilename)
+	return nil
+}
+
+func (x *SBatchCommand) Execute(args []string) error {
+	// leave early if parsing jobscript arguments
+	if jobScriptParser.Active != nil &&
+		jobScriptParser.Active.Name == jarvice.JobScriptArg {
+		return nil
+	}
+	if envParser.Active != nil &&
+		envParser.Active.Name == jarvice.JobScriptArg {
+		return nil
+	}
+	// leave early if parsing heterogeneous job component arguments
+	if x != &sBatchCommand {
+		return nil
+	}
+
+	if x.Help {
+		return jarvice.CreateHelpErr()
+	}
+
+	// positional arguments start at the job script, arguments after it are
+	// passed to the script unprocessed (PreprocessArgs keeps the argument count)
+	x.Args.JobScript = os.Args[len(os.Args)-len(x.Args.JobScript):]
+	// heterogeneous job components on the command line (separated by :)
+	hetjobArgs, positional, err := sbatchHetjobArgs(x.Args.JobScript, os.Args[1:])
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "sbatch",
+			Err:     err,
+		}
+	}
+	x.Args.JobScript = positional
+
+	// Set jobscript name and script arguments
+	jobScriptFilename := "STDIN"
+	var scriptArgs []string
+	if len(x.Args.JobScript) > 0 {
+		if len(x.Wrap) > 0 {
+			return &jarvice.SlurmError{
+				Command: "sbatch",
+				Err:     errors.New("Script arguments not permitted with --wrap option"),
+			}
+		}
+		jobScriptFilename = x.Args.JobScript[0]
+		scriptArgs = x.Args.JobScript[1:]
+	}
+
+	var jobScript jarvice.JobScript
+
+	if len(x.Wrap) > 0 {
+		// wrap command string in a simple sh script
+		jobScriptFilename = "wrap"
+		jobScript = jarvice.JobScript{
+			Shell:  "/bin/sh",
+			Script: []byte(x.Wrap + "\n"),
+		}
+	} else if val, jerr := jarvice.ParseJobScript("SBATCH", jobScriptFilename); jerr != nil {
+		if _, ok := jerr.(*os.PathError); ok {
+			return &jarvice.SlurmError{
+				Command: "sbatch",
+				Err:     errors.New("Unable to open file " + jobScriptFilename),
+			}
+		}
+		return &jarvice.SlurmError{
+			Command: "sbatch",
+			Err:     errors.New("unable to parse job script"),
+		}
+	} else {
+		jobScript = val
+	}
+	envArgs, envSources := sbatchEnvArgs(os.Environ())
+	if len(hetjobArgs) > 0 || len(jobScript.Hetjob) > 0 {
+		if len(hetjobArgs) == 0 {
+			// command line options apply to the first component
+			hetjobArgs = [][]string{os.Args[1 : len(os.Args)-len(x.Args.JobScript)]}
+		}
+		if err := x.submitHetjob(hetjobArgs, jobScript, filepath.Base(jobScriptFilename),
+			scriptArgs, envArgs); err != nil {
+			return &jarvice.SlurmError{
+				Command: "sbatch",
+				Err:     err,
+			}
+		}
+		return nil
+	}
+	// parse flags from jobscript (CLI flags take precedence;override == false)
+	if jarvice.ParseJobFlags(x,
+		parser,
+		jobScriptParser,
+		append([]string{jarvice.JobScriptArg}, jobScript.Args...),
+		false) != nil {
+		// Best effort
+		fmt.Println("WARNING: unable to parse flags in jobscript")
+	}
+	// parse flags from SBATCH_* environment (CLI flags take precedence;
+	// environment overrides jobscript)
+	if len(envArgs) > 0 {
+		if jarvice.ParseJobFlags(x,
+			parser,
+			envParser,
+			append([]string{jarvice.JobScriptArg}, envArgs...),
+			false) != nil {
+			// Best effort
+			fmt.Println("WARNING: unable to parse SBATCH_* environment variables")
+		}
+	}
+
+	jobScriptFilename = filepath.Base(jobScriptFilename)
+
+	var beginTime time.Time
+	if len(x.Begin) > 0 {
+		if val, err := parseSlurmTime(x.Begin, time.Now()); err != nil {
+			return &jarvice.SlurmError{
+				Command: "sbatch",
+				Err:     err,
+			}
+		} else {
+			beginTime = val
+		}
+	}
+	if _, err := slurmMailEvents(x.MailType); err != nil {
+		return &jarvice.SlurmError{
+			Command: "sbatch",
+			Err:     err,
+		}
+	}
+
+	// Read JARVICE config for selected cluster
+	cluster, err := jarvice.GetClusterConfig()
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "sbatch",
+			Err:     err,
+		}
+	}
+
+	myReq, myQueue, err := x.jobRequest(cluster, jobScript, jobScriptFilename, scriptArgs)
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "sbatch",
+			Err:     err,
+		}
+	}
 	// SgeJobReqDebug(myReq)
+	if x.TestOnly {
+		printSbatchSources(x, envSources)
+		startTime := time.Now()
+		if beginTime.After(startTime) {
+			startTime = beginTime
+		}
+		fmt.Printf("sbatch: Job to start at %s using %d node(s) of %s in partition %s\n",
+			startTime.Format("2006-01-02T15:04:05"), myReq.Machine.Nodes, myReq.Machine.Type,
+			myQueue.Name)
+		return nil
+	}
+	// JARVICE has no delayed start; hold job on the client until begin time
+	if beginTime.After(time.Now()) {
+		id, err := jarvice.DeferJob(myReq, beginTime)
+		if err != nil {
+			return &jarvice.SlurmError{
+				Command: "sbatch",
+				Err:     err,
+			}
+		}
+		slurmWatchJob(id, myReq.JobLabel, x.MailType, x.MailUser)
+		fmt.Printf("Your job %d (\"%s\") has been submitted\n", id, jobScriptFilename)
+		return nil
+	}
 	// Submit job request to JARVICE API
 	var myJobResponse jarvice.JarviceJobResponse
 	if jobResponse, err := jarvice.JarviceSubmitJob(cluster.Endpoint,
 		cluster.Insecure, myReq); err != nil {
-		return errors.New("sbatch: " + err.Error())
+		return &jarvice.SlurmError{
+			Command: "sbatch",
+			Err:     errors.New("Batch job submission failed: " + err.Error()),
+		}
 	} else {
 		myJobResponse = jobResponse
 	}
+	slurmWatchJob(int(myJobResponse.Number), myReq.JobLabel, x.MailType, x.MailUser)
 	fmt.Printf("Your job %d (\"%s\") has been submitted\n", int(myJobResponse.Number), jobScriptFilename)
 
 	return nil
@@ -368,9 +1144,19 @@ func init() {
 		"Slurm sbatch",
 		"Submit a batch script to Slurm",
 		&sBatchCommand)
+	// options after the job script are arguments of the job script
+	// (the parser is shared by all commands: only set for sbatch)
+	if filepath.Base(os.Args[0]) == "sbatch" {
+		parser.Options |= flags.PassAfterNonOption
+	}
 	// parser for jobscript flags
 	jobScriptParser.AddCommand(jarvice.JobScriptArg,
 		jarvice.JobScriptArg,
 		jarvice.JobScriptArg,
 		&jobScriptParserCommand)
+	// parser for input environment variables
+	envParser.AddCommand(jarvice.JobScriptArg,
+		jarvice.JobScriptArg,
+		jarvice.JobScriptArg,
+		&envParserCommand)
 }
@@ -1,43 +1,239 @@
 package main
 
 import (
+	"bufio"
 	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
 	jarvice "jarvice.io/jarvice-hpc/core"
 )
 
 type SCancelCommand struct {
-	Help  bool `short:"h" long:"help" description:"Show this help message"`
-	Force bool `short:"f" description:"force job deletion"`
-	Args  struct {
-		JobNumber string `positional-arg-name:"number" description:"job number"`
-	} `positional-args:"true" required:"1"`
+	Help        bool   `short:"h" long:"help" description:"Show this help message"`
+	Force       bool   `short:"f" description:"force job deletion"`
+	User        string `short:"u" long:"user" description:"Restrict the scancel operation to jobs owned by the given user"`
+	Name        string `short:"n" long:"name" description:"Restrict the scancel operation to jobs with this job name"`
+	Partition   string `short:"p" long:"partition" description:"Restrict the scancel operation to jobs in this partition"`
+	State       string `short:"t" long:"state" description:"Restrict the scancel operation to jobs in this state (PENDING, RUNNING)"`
+	Interactive bool   `short:"i" long:"interactive" description:"Interactive mode. Confirm each job_id.step_id before performing the cancel operation"`
+	Signal      string `short:"s" long:"signal" description:"The name or number of the signal to send (JARVICE supports TERM, INT and KILL)"`
+	Args        struct {
+		JobIds []string `positional-arg-name:"job_id" description:"job ID (job_id[_array_id][+het_offset])"`
+	} `positional-args:"true"`
 }
 
 var sCancelCommand SCancelCommand
 
+// Job selected for cancel
+type scancelJob struct {
+	Id        int
+	Name      string
+	Partition string
+}
+
+// Force (terminate) for signal name or number
+// JARVICE shuts down jobs gracefully (TERM, INT) or terminates them (KILL)
+func scancelSignalForce(signal string) (bool, error) {
+	switch strings.TrimPrefix(strings.ToUpper(signal), "SIG") {
+	case "TERM", "15", "INT", "2":
+		return false, nil
+	case "KILL", "9":
+		return true, nil
+	}
+	return false, errors.New("JARVICE cannot send signal " + signal + " to jobs")
+}
+
+// Parse job ID (job_id, job_id_array_id, job_id_[array_ids], job_id_* or
+// job_id+het_offset)
+// JARVICE jobs are not arrays: array tasks select the whole job
+// Returns JARVICE job numbers (all components of a heterogeneous job)
+func scancelJobIds(arg string) ([]int, error) {
+	re := regexp.MustCompile(`^([0-9]+)(\+([0-9]+))?(_([0-9]+|\[[0-9,\-%]+\]|\*))?(\.[a-z0-9]+)?$`)
+	match := re.FindStringSubmatch(arg)
+	if match == nil {
+		return nil, errors.New("Invalid job id " + arg)
+	}
+	id, err := strconv.Atoi(match[1])
+	if err != nil {
+		return nil, errors.New("Invalid job id " + arg)
+	}
+	id = jarvice.ResolveJobId(id)
+	numbers, ok := jarvice.FindHetJob(id)
+	if !ok {
+		if len(match[3]) > 0 {
+			return nil, errors.New("Invalid job id " + arg)
+		}
+		return []int{id}, nil
+	}
+	if len(match[3]) > 0 {
+		offset, err := strconv.Atoi(match[3])
+		if err != nil || offset >= len(numbers) {
+			return nil, errors.New("Invalid job id " + arg)
+		}
+		return []int{numbers[offset]}, nil
+	}
+	return numbers, nil
+}
+
+// Resolve filters against JARVICE jobs and jobs held on the client
+func (x *SCancelCommand) filterJobs(cluster jarvice.JarviceCluster,
+	ids map[int]struct{}) ([]scancelJob, error) {
+
+	jarviceJobs, _, err := jarvice.ReadJarviceJobs(cluster, false)
+	if err != nil {
+		return nil, err
+	}
+	userFilter := squeueFilter(x.User, false)
+	nameFilter := squeueFilter(x.Name, false)
+	partitionFilter := squeueFilter(x.Partition, false)
+	stateFilter := squeueFilter(x.State, true)
+	match := func(id int, user, name, partition string, state jarvice.JobState) bool {
+		if ids != nil {
+			if _, ok := ids[id]; !ok {
+				return false
+			}
+		}
+		return squeueMatch(userFilter, user) &&
+			squeueMatch(nameFilter, name) &&
+			squeueMatch(partitionFilter, partition) &&
+			squeueMatch(stateFilter, state.Slurm, state.SlurmLong)
+	}
+	jobs := []scancelJob{}
+	for number, job := range jarviceJobs {
+		state := job.State()
+		if state.Terminal || len(job.ApiSubmission.Queue) == 0 {
+			continue
+		}
+		if match(number, job.User, job.Label, job.ApiSubmission.Queue, state) {
+			jobs = append(jobs, scancelJob{
+				Id:        number,
+				Name:      job.Label,
+				Partition: job.ApiSubmission.Queue,
+			})
+		}
+	}
+	if deferredJobs, err := jarvice.ReadDeferredJobs(); err == nil {
+		pending := jarvice.JobState{Slurm: "PD", SlurmLong: "PENDING"}
+		for _, job := range deferredJobs {
+			if !job.Local() {
+				continue
+			}
+			req := job.Request
+			if match(job.Id, req.User.Username, req.JobLabel, req.Hpc.Queue, pending) {
+				jobs = append(jobs, scancelJob{
+					Id:        job.Id,
+					Name:      req.JobLabel,
+					Partition: req.Hpc.Queue,
+				})
+			}
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Id < jobs[j].Id })
+	return jobs, nil
+}
+
+// Confirm cancel of each job
+func scancelConfirm(jobs []scancelJob) []scancelJob {
+	reader := bufio.NewReader(os.Stdin)
+	confirmed := []scancelJob{}
+	for _, job := range jobs {
+		fmt.Printf("Cancel job_id=%d name=%s partition=%s [y/n]? ",
+			job.Id, job.Name, job.Partition)
+		answer, err := reader.ReadString('\n')
+		if jarvice.IsYes(strings.TrimSpace(answer)) {
+			confirmed = append(confirmed, job)
+		}
+		if err != nil {
+			fmt.Println()
+			break
+		}
+	}
+	return confirmed
+}
+
 func (x *SCancelCommand) Execute(args []string) error {
 	if x.Help {
 		return jarvice.CreateHelpErr()
 	}
+	force := x.Force
+	if len(x.Signal) > 0 {
+		val, err := scancelSignalForce(x.Signal)
+		if err != nil {
+			return &jarvice.SlurmError{
+				Command: "scancel",
+				Err:     err,
+			}
+		}
+		force = force || val
+	}
+	var ids map[int]struct{}
+	jobs := []scancelJob{}
+	for _, arg := range x.Args.JobIds {
+		numbers, err := scancelJobIds(arg)
+		if err != nil {
+			return &jarvice.SlurmError{
+				Command: "scancel",
+				Err:     err,
+			}
+		}
+		if ids == nil {
+			ids = map[int]struct{}{}
+		}
+		for _, id := range numbers {
+			if _, ok := ids[id]; !ok {
+				ids[id] = struct{}{}
+				jobs = append(jobs, scancelJob{Id: id})
+			}
+		}
+	}
+	filtered := len(x.User) > 0 || len(x.Name) > 0 ||
+		len(x.Partition) > 0 || len(x.State) > 0
+	if ids == nil && !filtered {
+		return &jarvice.SlurmError{
+			Command: "scancel",
+			Err:     errors.New("No job identification provided"),
+		}
+	}
 	cluster, err := jarvice.GetClusterConfig()
 	if err != nil {
-		return err
+		return &jarvice.SlurmError{
+			Command: "scancel",
+			Err:     err,
+		}
 	}
-	urlValues := cluster.GetUrlCreds()
-	urlValues.Add("number", x.Args.JobNumber)
-	api := "shutdown"
-	if x.Force {
-		api = "terminate"
+	// filters (and interactive mode) need job details
+	if filtered || x.Interactive {
+		if jobs, err = x.filterJobs(cluster, ids); err != nil {
+			return &jarvice.SlurmError{
+				Command: "scancel",
+				Err:     err,
+			}
+		}
 	}
-	if _, err := jarvice.ApiReq(cluster.Endpoint,
-		api,
-		cluster.Insecure,
-		urlValues); err == nil {
-
-		return nil
+	if x.Interactive {
+		jobs = scancelConfirm(jobs)
+	}
+	list := []int{}
+	for _, job := range jobs {
+		list = append(list, job.Id)
+	}
+	failed := false
+	for _, result := range jarvice.CancelJobs(cluster, list, force) {
+		if result.Err != nil {
+			fmt.Fprintf(os.Stderr, "scancel: error: Kill job error on job id %d: %v\n",
+				result.Id, result.Err)
+			failed = true
+		}
+	}
+	if failed {
+		return &jarvice.ExitError{Code: 1}
 	}
-	return errors.New("scancel: HTTP error")
+	return nil
 }
 
 func init() {
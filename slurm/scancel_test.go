@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jarvice "jarvice.io/jarvice-hpc/core"
+)
+
+// Client config with JARVICE API served by handler
+func testCluster(t *testing.T, handler http.HandlerFunc) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	config := filepath.Join(t.TempDir(), jarvice.JarviceHpcConfigFilename)
+	if err := ioutil.WriteFile(config, []byte(`{"default": {"jarvice_endpoint": "`+
+		server.URL+`", "jarvice_user": {"username": "alice", "apikey": "key"}}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(jarvice.JarviceHpcConfigEnv, config)
+	t.Setenv("JXE_CLUSTER", "")
+}
+
+// JARVICE API recording cancel requests (<api> <number>)
+func testCancelCluster(t *testing.T) func() []string {
+	var mutex sync.Mutex
+	requests := []string{}
+	testCluster(t, func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests = append(requests,
+			strings.TrimPrefix(r.URL.Path, "/jarvice/")+" "+r.URL.Query().Get("number"))
+	})
+	return func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sort.Strings(requests)
+		return requests
+	}
+}
+
+func TestScancelSignalForce(t *testing.T) {
+	for signal, want := range map[string]bool{
+		"TERM": false, "SIGTERM": false, "15": false,
+		"INT": false, "sigint": false, "2": false,
+		"KILL": true, "SIGKILL": true, "9": true,
+	} {
+		if force, err := scancelSignalForce(signal); err != nil || force != want {
+			t.Errorf("%s: got %v, %v; want %v", signal, force, err, want)
+		}
+	}
+	for _, signal := range []string{"HUP", "USR1", "STOP", "3"} {
+		if _, err := scancelSignalForce(signal); err == nil {
+			t.Errorf("%s: expected error", signal)
+		}
+	}
+}
+
+func TestScancelJobIds(t *testing.T) {
+	testCluster(t, func(w http.ResponseWriter, r *http.Request) {})
+	if err := jarvice.AddHetJob([]int{20, 21, 22}); err != nil {
+		t.Fatal(err)
+	}
+	// local job ID of job submitted to JARVICE as job 30
+	local, err := jarvice.DeferJob(jarvice.JarviceJobRequest{}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jarvice.UpdateDeferredJob(local, func(job *jarvice.DeferredJob) error {
+		job.Number = 30
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	localId := strconv.Itoa(local)
+	for arg, want := range map[string][]int{
+		"10":           {10},
+		"10_3":         {10},
+		"10_*":         {10},
+		"10_[1-4]":     {10},
+		"10_[1,3]":     {10},
+		"10.batch":     {10},
+		"20":           {20, 21, 22},
+		"20_*":         {20, 21, 22},
+		"20+1":         {21},
+		"20+2_[1]":     {22},
+		"20+1.0":       {21},
+		localId:        {30},
+		localId + "_*": {30},
+	} {
+		if numbers, err := scancelJobIds(arg); err != nil || !reflect.DeepEqual(numbers, want) {
+			t.Errorf("%s: got %v, %v; want %v", arg, numbers, err, want)
+		}
+	}
+	for _, arg := range []string{"", "abc", "10_", "10_[a]", "10+1", "20+3"} {
+		if _, err := scancelJobIds(arg); err == nil {
+			t.Errorf("%q: expected error", arg)
+		}
+	}
+}
+
+func TestScancelExecute(t *testing.T) {
+	for _, test := range []struct {
+		command SCancelCommand
+		args    []string
+		want    []string
+	}{
+		{SCancelCommand{}, []string{"10"}, []string{"shutdown 10"}},
+		{SCancelCommand{Signal: "TERM"}, []string{"10_*"}, []string{"shutdown 10"}},
+		{SCancelCommand{Signal: "SIGINT"}, []string{"10_[1-3]"}, []string{"shutdown 10"}},
+		{SCancelCommand{Signal: "KILL"}, []string{"10_2", "11"},
+			[]string{"terminate 10", "terminate 11"}},
+		{SCancelCommand{Force: true}, []string{"10", "10_1"}, []string{"terminate 10"}},
+	} {
+		requests := testCancelCluster(t)
+		command := test.command
+		command.Args.JobIds = test.args
+		if err := command.Execute(nil); err != nil {
+			t.Errorf("%+v: %v", test.command, err)
+			continue
+		}
+		if got := requests(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%+v %v: got %v, want %v", test.command, test.args, got, test.want)
+		}
+	}
+}
+
+func TestScancelExecuteSignal(t *testing.T) {
+	requests := testCancelCluster(t)
+	command := SCancelCommand{Signal: "HUP"}
+	command.Args.JobIds = []string{"10"}
+	if err := command.Execute(nil); err == nil {
+		t.Error("expected error for signal HUP")
+	}
+	if got := requests(); len(got) > 0 {
+		t.Errorf("jobs cancelled: %v", got)
+	}
+}
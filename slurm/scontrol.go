@@ -0,0 +1,670 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	jarvice "jarvice.io/jarvice-hpc/core"
+)
+
+type SControlCommand struct {
+	Help     bool `short:"h" long:"help" description:"Show this help message"`
+	OneLiner bool `short:"o" long:"oneliner" description:"Print information one line per record"`
+	Args     struct {
+		Command string   `positional-arg-name:"command" description:"show | hold | release | requeue | update"`
+		Args    []string `positional-arg-name:"args" description:"show: job [id] | partition [name] | hostnames [list] | hostlist list\nhold, release, requeue: job list\nupdate: JobId=id Specification=value..."`
+	} `positional-args:"true" required:"1"`
+}
+
+var sControlCommand SControlCommand
+
+// Print scontrol error for a job operation
+func scontrolError(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, "scontrol: error: "+format+"\n", a...)
+}
+
+// Parse job list (e.g. "123,124 125")
+func scontrolJobIds(args []string) ([]int, error) {
+	ids := []int{}
+	for _, arg := range args {
+		for _, val := range strings.Split(arg, ",") {
+			if len(val) == 0 {
+				continue
+			}
+			id, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, errors.New("Invalid job id specified: " + val)
+			}
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("No job id specified")
+	}
+	return ids, nil
+}
+
+// Print key=value record
+func (x *SControlCommand) printRecord(lines [][]string) {
+	if x.OneLiner {
+		items := []string{}
+		for _, line := range lines {
+			items = append(items, line...)
+		}
+		fmt.Println(strings.Join(items, " "))
+		return
+	}
+	for index, line := range lines {
+		indent := ""
+		if index > 0 {
+			indent = "   "
+		}
+		fmt.Println(indent + strings.Join(line, " "))
+	}
+	fmt.Println()
+}
+
+// Job record fields shown by scontrol show job
+type scontrolJob struct {
+	Id           int
+	Name         string
+	User         string
+	Account      string
+	State        string
+	Reason       string
+	ExitCode     string
+	RunTime      int64
+	TimeLimit    string
+	SubmitTime   int64
+	EligibleTime int64
+	StartTime    int64
+	EndTime      int64
+	Partition    string
+	NodeList     string
+	BatchHost    string
+	NumNodes     int
+	NumCPUs      int
+	WorkDir      string
+}
+
+func scontrolTime(t int64) string {
+	if t <= 0 {
+		return "Unknown"
+	}
+	return slurmTimestamp(t)
+}
+
+func (job scontrolJob) lines() [][]string {
+	return [][]string{
+		{"JobId=" + strconv.Itoa(job.Id), "JobName=" + job.Name},
+		{"UserId=" + job.User, "GroupId=" + job.User, "MCS_label=N/A"},
+		{"Priority=1", "Nice=0", "Account=" + job.Account, "QOS=normal"},
+		{"JobState=" + job.State, "Reason=" + job.Reason, "Dependency=(null)"},
+		{"Requeue=1", "Restarts=0", "BatchFlag=1", "Reboot=0", "ExitCode=" + job.ExitCode},
+		{"RunTime=" + sacctElapsed(job.RunTime), "TimeLimit=" + job.TimeLimit, "TimeMin=N/A"},
+		{"SubmitTime=" + scontrolTime(job.SubmitTime), "EligibleTime=" + scontrolTime(job.EligibleTime)},
+		{"StartTime=" + scontrolTime(job.StartTime), "EndTime=" + scontrolTime(job.EndTime), "Deadline=N/A"},
+		{"Partition=" + job.Partition},
+		{"NodeList=" + job.NodeList, "BatchHost=" + job.BatchHost},
+		{"NumNodes=" + strconv.Itoa(job.NumNodes), "NumCPUs=" + strconv.Itoa(job.NumCPUs)},
+		{"WorkDir=" + job.WorkDir},
+	}
+}
+
+// Job connection address (jarvice/info)
+func scontrolBatchHost(cluster jarvice.JarviceCluster, number int) string {
+	urlValues := cluster.GetUrlCreds()
+	urlValues.Add("number", strconv.Itoa(number))
+	resp, err := jarvice.ApiReq(cluster.Endpoint, "info", cluster.Insecure, urlValues)
+	if err != nil {
+		return "(null)"
+	}
+	info := map[string]interface{}{}
+	if err := json.Unmarshal(resp, &info); err != nil {
+		return "(null)"
+	}
+	if address, ok := info["address"].(string); ok && len(address) > 0 {
+		return address
+	}
+	return "(null)"
+}
+
+func scontrolTimeLimit(walltime string) string {
+	if len(walltime) == 0 {
+		return "UNLIMITED"
+	}
+	return walltime
+}
+
+func scontrolWorkDir(req jarvice.JarviceJobRequest) string {
+	if dir, ok := req.Hpc.Envs["SLURM_SUBMIT_DIR"]; ok {
+		return dir
+	}
+	return "(null)"
+}
+
+func scontrolAccount(req jarvice.JarviceJobRequest, user string) string {
+	if req.JobProject != nil && len(*req.JobProject) > 0 {
+		return *req.JobProject
+	}
+	return user
+}
+
+func (x *SControlCommand) showJobs(cluster jarvice.JarviceCluster, args []string) error {
+	ids := map[int]struct{}{}
+	if len(args) > 0 {
+		list, err := scontrolJobIds(args)
+		if err != nil {
+			return err
+		}
+		for _, id := range list {
+			ids[jarvice.ResolveJobId(id)] = struct{}{}
+		}
+	}
+	match := func(id int) bool {
+		if len(ids) == 0 {
+			return true
+		}
+		_, ok := ids[id]
+		return ok
+	}
+	var jarviceJobs jarvice.JarviceJobs
+	var requests map[int]jarvice.JarviceJobRequest
+	var err error
+	if len(ids) > 0 {
+		jarviceJobs, requests, err = jarvice.ReadAllJarviceJobs(cluster)
+	} else {
+		jarviceJobs, requests, err = jarvice.ReadJarviceJobs(cluster, false)
+	}
+	if err != nil {
+		return err
+	}
+	machines, _ := jarvice.GetJarviceMachines(cluster)
+	now := time.Now()
+	jobs := []scontrolJob{}
+	for number, job := range jarviceJobs {
+		if len(job.ApiSubmission.Queue) == 0 || !match(number) {
+			continue
+		}
+		req := requests[number]
+		state := job.State()
+		record := scontrolJob{
+			Id:           number,
+			Name:         job.Label,
+			User:         job.User,
+			Account:      scontrolAccount(req, job.User),
+			State:        state.SlurmLong,
+			Reason:       state.SlurmReason,
+			ExitCode:     "0:0",
+			RunTime:      job.Elapsed(now),
+			TimeLimit:    scontrolTimeLimit(job.ApiSubmission.Application.Walltime),
+			SubmitTime:   int64(job.SubmitTime),
+			EligibleTime: int64(job.SubmitTime),
+			StartTime:    int64(job.StartTime),
+			EndTime:      int64(job.EndTime),
+			Partition:    job.ApiSubmission.Queue,
+			NodeList:     "(null)",
+			BatchHost:    "(null)",
+			NumNodes:     job.ApiSubmission.Machine.Nodes,
+			NumCPUs:      machines[job.ApiSubmission.Machine.Type].Cores * job.ApiSubmission.Machine.Nodes,
+			WorkDir:      scontrolWorkDir(req),
+		}
+		if state.Terminal {
+			record.ExitCode = slurmExitCode(job.ExitCode)
+		}
+		if !state.Pending {
+			record.NodeList = job.ApiSubmission.Machine.Type
+			if !state.Terminal {
+				record.BatchHost = scontrolBatchHost(cluster, number)
+			}
+		}
+		jobs = append(jobs, record)
+	}
+	// jobs held on the client
+	if deferredJobs, err := jarvice.ReadDeferredJobs(); err == nil {
+		for _, job := range deferredJobs {
+			if !job.Local() || !match(job.Id) {
+				continue
+			}
+			req := job.Request
+			jobs = append(jobs, scontrolJob{
+				Id:           job.Id,
+				Name:         req.JobLabel,
+				User:         req.User.Username,
+				Account:      scontrolAccount(req, req.User.Username),
+				State:        "PENDING",
+				Reason:       job.Reason(),
+				ExitCode:     "0:0",
+				TimeLimit:    scontrolTimeLimit(req.Application.Walltime),
+				SubmitTime:   job.SubmitTime,
+				EligibleTime: job.BeginTime,
+				Partition:    req.Hpc.Queue,
+				NodeList:     "(null)",
+				BatchHost:    "(null)",
+				NumNodes:     req.Machine.Nodes,
+				NumCPUs:      machines[req.Machine.Type].Cores * req.Machine.Nodes,
+				WorkDir:      scontrolWorkDir(req),
+			})
+		}
+	}
+	if len(jobs) == 0 {
+		if len(ids) > 0 {
+			return errors.New("slurm_load_jobs error: Invalid job id specified")
+		}
+		fmt.Println("No jobs in the system")
+		return nil
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Id < jobs[j].Id })
+	for _, job := range jobs {
+		x.printRecord(job.lines())
+	}
+	return nil
+}
+
+func (x *SControlCommand) showPartitions(cluster jarvice.JarviceCluster, args []string) error {
+	urlValues := cluster.GetUrlCreds()
+	urlValues.Add("info", "true")
+	if len(args) > 0 {
+		urlValues.Add("name", args[0])
+	}
+	resp, err := jarvice.ApiReq(cluster.Endpoint, "queues", cluster.Insecure, urlValues)
+	if err != nil {
+		return err
+	}
+	jarviceQueues := jarvice.JarviceQueues{}
+	if err := json.Unmarshal(resp, &jarviceQueues); err != nil {
+		return errors.New("cannot read partitions")
+	}
+	if len(jarviceQueues) == 0 {
+		return errors.New("Partition " + strings.Join(args, " ") + " not found")
+	}
+	machines, err := jarvice.GetJarviceMachines(cluster)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for name := range jarviceQueues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		queue := jarviceQueues[name]
+		machineNames := []string{}
+		for _, machine := range jarvice.QueueMachines(queue, machines) {
+			machineNames = append(machineNames, machine.Name)
+		}
+		defaultMachine := machines[queue.DefaultMachine]
+		isDefault := "NO"
+		if queue.Name == "default" {
+			isDefault = "YES"
+		}
+		x.printRecord([][]string{
+			{"PartitionName=" + queue.Name},
+			{"AllowGroups=ALL", "AllowAccounts=ALL", "AllowQos=ALL"},
+			{"Default=" + isDefault, "Hidden=NO", "ExclusiveUser=NO"},
+			{"MaxNodes=" + strconv.Itoa(queue.MachineScale),
+				"MaxTime=" + scontrolTimeLimit(queue.Walltime), "MinNodes=1"},
+			{"Nodes=" + strings.Join(machineNames, ",")},
+			{"State=UP", "TotalCPUs=" + strconv.Itoa(defaultMachine.Cores*queue.MachineScale),
+				"TotalNodes=" + strconv.Itoa(queue.MachineScale)},
+			{"DefMemPerNode=UNLIMITED", "MaxMemPerNode=" + strconv.Itoa(defaultMachine.Ram*1024)},
+			{"Application=" + queue.App, "DefaultMachine=" + queue.DefaultMachine},
+		})
+	}
+	return nil
+}
+
+// Hold or release jobs held on the client
+func (x *SControlCommand) holdJobs(args []string, held bool) error {
+	ids, err := scontrolJobIds(args)
+	if err != nil {
+		return err
+	}
+	failed := false
+	for _, id := range ids {
+		err := jarvice.UpdateDeferredJob(id, func(job *jarvice.DeferredJob) error {
+			if !job.Pending() {
+				return errors.New("Job has already been submitted to JARVICE")
+			}
+			job.Held = held
+			return nil
+		})
+		if err != nil {
+			// JARVICE jobs are not in the client store
+			if err.Error() == "Invalid job id specified" {
+				err = errors.New("Job is not held on the client; JARVICE cannot hold or release submitted jobs")
+			}
+			scontrolError("%s for job %d", err.Error(), id)
+			failed = true
+		}
+	}
+	if failed {
+		return &jarvice.ExitError{Code: 1}
+	}
+	return nil
+}
+
+// Resubmit finished jobs with their original request
+func (x *SControlCommand) requeueJobs(cluster jarvice.JarviceCluster, args []string) error {
+	ids, err := scontrolJobIds(args)
+	if err != nil {
+		return err
+	}
+	jarviceJobs, requests, err := jarvice.ReadAllJarviceJobs(cluster)
+	if err != nil {
+		return err
+	}
+	failed := false
+	for _, id := range ids {
+		id = jarvice.ResolveJobId(id)
+		job, ok := jarviceJobs[id]
+		if !ok {
+			scontrolError("Invalid job id specified for job %d", id)
+			failed = true
+			continue
+		}
+		if !job.State().Terminal {
+			scontrolError("Only finished jobs can be requeued for job %d", id)
+			failed = true
+			continue
+		}
+		resp, err := jarvice.ResubmitJob(cluster, requests[id])
+		if err != nil {
+			scontrolError("%s for job %d", err.Error(), id)
+			failed = true
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "scontrol: warning: job %d requeued as job %d (JARVICE assigns a new job ID)\n",
+			id, resp.Number)
+		if err := jarvice.RequeueWatch(id, resp.Number); err != nil {
+			fmt.Fprintf(os.Stderr, "scontrol: warning: requeue notification for job %d: %v\n",
+				id, err)
+		}
+	}
+	if failed {
+		return &jarvice.ExitError{Code: 1}
+	}
+	return nil
+}
+
+// Apply scontrol update specifications to job request
+func scontrolUpdateRequest(cluster jarvice.JarviceCluster, req *jarvice.JarviceJobRequest,
+	beginTime *time.Time, specs map[string]string) error {
+
+	if req.Hpc.Envs == nil {
+		req.Hpc.Envs = map[string]string{}
+	}
+	if req.Hpc.Resources == nil {
+		req.Hpc.Resources = map[string]string{}
+	}
+	queueName := req.Hpc.Queue
+	if val, ok := specs["partition"]; ok {
+		queueName = val
+	}
+	for key, val := range specs {
+		switch key {
+		case "jobname", "name":
+			req.JobLabel = val
+			req.Hpc.Envs["SLURM_JOB_NAME"] = val
+		case "timelimit":
+			// time limits are not enforced (sbatch --time is ignored as well)
+			return errors.New("Update of TimeLimit is not supported: JARVICE does not enforce job time limits")
+		case "numnodes":
+			nodes, err := strconv.Atoi(strings.SplitN(val, "-", 2)[0])
+			if err != nil || nodes < 1 {
+				return errors.New("Invalid node count specification: " + val)
+			}
+			req.Machine.Nodes = nodes
+		case "account":
+			account := val
+			req.JobProject = &account
+			req.Hpc.Envs["SLURM_JOB_ACCOUNT"] = val
+		case "starttime":
+			t, err := parseSlurmTime(val, time.Now())
+			if err != nil {
+				return err
+			}
+			*beginTime = t
+		case "partition":
+		default:
+			return errors.New("Update of " + key + " is not supported")
+		}
+	}
+	// validate machine and scale against partition
+	urlValues := cluster.GetUrlCreds()
+	urlValues.Add("info", "true")
+	urlValues.Add("name", queueName)
+	resp, err := jarvice.ApiReq(cluster.Endpoint, "queues", cluster.Insecure, urlValues)
+	if err != nil {
+		return err
+	}
+	jarviceQueues := jarvice.JarviceQueues{}
+	if err := json.Unmarshal(resp, &jarviceQueues); err != nil {
+		return errors.New("cannot read partition " + queueName)
+	}
+	queue, ok := jarviceQueues[queueName]
+	if !ok {
+		return errors.New("Invalid partition name specified: " + queueName)
+	}
+	machines, err := jarvice.GetJarviceMachines(cluster)
+	if err != nil {
+		return err
+	}
+	allowed := false
+	for _, machine := range jarvice.QueueMachines(queue, machines) {
+		allowed = allowed || machine.Name == req.Machine.Type
+	}
+	if !allowed {
+		req.Machine.Type = queue.DefaultMachine
+		req.Hpc.Resources["mc_name"] = queue.DefaultMachine
+	}
+	if queue.MachineScale > 0 && req.Machine.Nodes > queue.MachineScale {
+		return errors.New("Requested node configuration is not available (partition size " +
+			strconv.Itoa(queue.MachineScale) + ")")
+	}
+	req.App = queue.App
+	req.Hpc.Queue = queue.Name
+	req.Hpc.Envs["SLURM_JOB_PARTITION"] = queue.Name
+	return nil
+}
+
+// Update pending job
+// JARVICE cannot modify a queued job: job is canceled and resubmitted
+func (x *SControlCommand) updateJob(cluster jarvice.JarviceCluster, args []string) error {
+	specs := map[string]string{}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return errors.New("Invalid input: " + arg)
+		}
+		specs[strings.ToLower(parts[0])] = parts[1]
+	}
+	val, ok := specs["jobid"]
+	if !ok {
+		return errors.New("No job id specified (JobId=id)")
+	}
+	delete(specs, "jobid")
+	id, err := strconv.Atoi(val)
+	if err != nil {
+		return errors.New("Invalid job id specified: " + val)
+	}
+	// job held on the client is updated in place
+	// (request is validated with JARVICE without holding the store lock)
+	if id >= jarvice.DeferredJobIdBase {
+		deferredJobs, err := jarvice.ReadDeferredJobs()
+		if err != nil {
+			return err
+		}
+		var deferredJob *jarvice.DeferredJob
+		for index := range deferredJobs {
+			if deferredJobs[index].Id == id {
+				deferredJob = &deferredJobs[index]
+			}
+		}
+		if deferredJob == nil {
+			return errors.New("Invalid job id specified")
+		}
+		if !deferredJob.Pending() {
+			return errors.New("Job is no longer pending execution")
+		}
+		req := deferredJob.Request
+		beginTime := time.Unix(deferredJob.BeginTime, 0)
+		if err := scontrolUpdateRequest(cluster, &req, &beginTime, specs); err != nil {
+			return err
+		}
+		return jarvice.UpdateDeferredJob(id, func(job *jarvice.DeferredJob) error {
+			if !job.Pending() {
+				return errors.New("Job is no longer pending execution")
+			}
+			job.Request = req
+			job.BeginTime = beginTime.Unix()
+			return nil
+		})
+	}
+	jarviceJobs, requests, err := jarvice.ReadJarviceJobs(cluster, false)
+	if err != nil {
+		return err
+	}
+	job, ok := jarviceJobs[id]
+	if !ok {
+		return errors.New("Invalid job id specified")
+	}
+	if !job.State().Pending {
+		return errors.New("Job is no longer pending execution for job " + val)
+	}
+	req := requests[id]
+	beginTime := time.Now()
+	if err := scontrolUpdateRequest(cluster, &req, &beginTime, specs); err != nil {
+		return err
+	}
+	// job must still be queued when canceled (a running job is not updated)
+	status, err := jarvice.GetJobStatus(cluster, id)
+	if err != nil {
+		return err
+	}
+	if !status.State().Pending {
+		return errors.New("Job is no longer pending execution for job " + val)
+	}
+	if err := jarvice.CancelJob(cluster, id, false); err != nil {
+		return errors.New("job " + val + " could not be canceled: " + err.Error())
+	}
+	// updated job is submitted once the queued job is canceled
+	newId := 0
+	if beginTime.After(time.Now()) {
+		newId, err = jarvice.DeferJob(req, beginTime)
+	} else {
+		var resp jarvice.JarviceJobResponse
+		resp, err = jarvice.ResubmitJob(cluster, req)
+		newId = resp.Number
+	}
+	if err != nil {
+		return errors.New("job " + val + " was canceled but could not be resubmitted: " +
+			err.Error())
+	}
+	// notifications follow the resubmitted job
+	if _, _, err := jarvice.MoveWatch(id, newId); err != nil {
+		fmt.Fprintf(os.Stderr, "scontrol: warning: notifications for job %d: %v\n", id, err)
+	}
+	fmt.Fprintf(os.Stderr, "scontrol: warning: JARVICE cannot modify a queued job; "+
+		"job %d was canceled and resubmitted as job %d\n", id, newId)
+	// new job ID for callers tracking the job
+	fmt.Println(newId)
+	return nil
+}
+
+// Expand (hostnames) or compress (hostlist) a Slurm host list
+// Host names default to SLURM_JOB_NODELIST
+func scontrolShowHosts(entity string, args []string) error {
+	list := strings.Join(args, ",")
+	if len(args) == 0 {
+		list = os.Getenv("SLURM_JOB_NODELIST")
+	}
+	if len(list) == 0 {
+		return errors.New("host list is empty")
+	}
+	hosts, err := jarvice.ExpandHostlist(list)
+	if err != nil {
+		return err
+	}
+	if entity == "hostnames" {
+		for _, host := range hosts {
+			fmt.Println(host)
+		}
+		return nil
+	}
+	fmt.Println(jarvice.CompressHostlist(hosts))
+	return nil
+}
+
+func (x *SControlCommand) Execute(args []string) error {
+	if x.Help {
+		return jarvice.CreateHelpErr()
+	}
+	cmdArgs := x.Args.Args
+	// host lists do not need JARVICE (e.g. in JARVICE jobs)
+	if strings.ToLower(x.Args.Command) == "show" && len(cmdArgs) > 0 {
+		switch strings.ToLower(cmdArgs[0]) {
+		case "hostnames", "hostlist", "hostlistsorted":
+			err := scontrolShowHosts(strings.ToLower(cmdArgs[0]), cmdArgs[1:])
+			if err != nil {
+				return &jarvice.SlurmError{
+					Command: "scontrol",
+					Err:     err,
+				}
+			}
+			return nil
+		}
+	}
+	cluster, err := jarvice.GetClusterConfig()
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "scontrol",
+			Err:     err,
+		}
+	}
+	switch strings.ToLower(x.Args.Command) {
+	case "show":
+		if len(cmdArgs) == 0 {
+			err = errors.New("invalid entity for keyword show")
+			break
+		}
+		switch strings.ToLower(cmdArgs[0]) {
+		case "job", "jobs":
+			err = x.showJobs(cluster, cmdArgs[1:])
+		case "partition", "partitions":
+			err = x.showPartitions(cluster, cmdArgs[1:])
+		default:
+			err = errors.New("invalid entity:" + cmdArgs[0] + " for keyword:show")
+		}
+	case "hold":
+		err = x.holdJobs(cmdArgs, true)
+	case "release":
+		err = x.holdJobs(cmdArgs, false)
+	case "requeue":
+		err = x.requeueJobs(cluster, cmdArgs)
+	case "update":
+		err = x.updateJob(cluster, cmdArgs)
+	default:
+		err = errors.New("invalid keyword: " + x.Args.Command)
+	}
+	if _, ok := err.(*jarvice.ExitError); err != nil && !ok {
+		return &jarvice.SlurmError{
+			Command: "scontrol",
+			Err:     err,
+		}
+	}
+	return err
+}
+
+func init() {
+	parser.AddCommand("scontrol",
+		"Slurm scontrol",
+		"view or modify Slurm configuration and state",
+		&sControlCommand)
+}
@@ -3,57 +3,395 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 
 	jarvice "jarvice.io/jarvice-hpc/core"
 )
 
 type SInfoCommand struct {
-	Help bool `short:"h" long:"help" description:"Show this help message"`
+	Help       bool   `long:"help" description:"Show this help message"`
+	Summarize  bool   `short:"s" long:"summarize" description:"List only a partition state summary with no node state details"`
+	Node       bool   `short:"N" long:"Node" description:"Print information in a node-oriented format"`
+	Partitions string `short:"p" long:"partition" description:"Print information only about the specified partition(s). Multiple partitions are separated by commas"`
+	NoHeader   bool   `short:"h" long:"noheader" description:"Do not print a header on the output"`
+	Format     string `short:"o" long:"format" description:"Specify the information to be displayed using an output format specification\n%[[.]size]type (e.g. \"%P %a %l %D %t %N %c %m %G\")"`
+	Json       bool   `long:"json" description:"Dump information as JSON"`
 }
 
 var sInfoCommand SInfoCommand
 
-func printPartitionInfo(queues jarvice.JarviceQueues) {
-	table := [][]string{
-		{"PARTITION", "AVAIL", "TIMELIMIT", "NODES", "STATE", "NODELIST"},
+const (
+	sinfoDefaultFormat   = "%9P %5a %.10l %.6D %.6t %N"
+	sinfoSummarizeFormat = "%9P %5a %.10l %.16F %N"
+	sinfoNodeFormat      = "%N %.6D %.9P %6t"
+)
+
+var sinfoHeaders = map[byte]string{
+	'P': "PARTITION",
+	'R': "PARTITION",
+	'a': "AVAIL",
+	'l': "TIMELIMIT",
+	'D': "NODES",
+	't': "STATE",
+	'T': "STATE",
+	'N': "NODELIST",
+	'c': "CPUS",
+	'm': "MEMORY",
+	'G': "GRES",
+	'f': "AVAIL_FEATURES",
+	'F': "NODES(A/I/O/T)",
+}
+
+// sinfo output record (partition state or node group)
+type sinfoRow struct {
+	Partition string
+	Default   bool
+	TimeLimit string
+	Nodes     int
+	Allocated int
+	Total     int
+	State     string
+	Machines  []jarvice.JarviceMachineInfo
+}
+
+// Per node value of machine types (e.g. "8" or "8+" if types differ)
+func sinfoMachineValue(machines []jarvice.JarviceMachineInfo,
+	value func(machine jarvice.JarviceMachineInfo) int) string {
+
+	if len(machines) == 0 {
+		return "0"
+	}
+	min, max := value(machines[0]), value(machines[0])
+	for _, machine := range machines {
+		if val := value(machine); val < min {
+			min = val
+		} else if val > max {
+			max = val
+		}
 	}
-	for _, queue := range queues {
-		scaleString := strconv.Itoa(queue.MachineScale)
-		table = append(table, []string{
-			queue.Name,
-			"up",
-			"infinite",
-			scaleString,
-			"idle",
-			queue.DefaultMachine + "[0-" + strconv.Itoa(queue.MachineScale-1) + "]"})
+	if min == max {
+		return strconv.Itoa(min)
 	}
-	jarvice.PrintTable(table, false)
+	return strconv.Itoa(min) + "+"
 }
 
-func (x *SInfoCommand) Execute(args []string) error {
-	if x.Help {
-		return jarvice.CreateHelpErr()
+func (row sinfoRow) nodeList() string {
+	names := []string{}
+	for _, machine := range row.Machines {
+		names = append(names, machine.Name)
 	}
-	cluster, err := jarvice.GetClusterConfig()
-	if err != nil {
-		return err
+	return strings.Join(names, ",")
+}
+
+func (row sinfoRow) gres() string {
+	gpus := sinfoMachineValue(row.Machines,
+		func(machine jarvice.JarviceMachineInfo) int { return machine.Gpus })
+	if gpus == "0" {
+		return "(null)"
+	}
+	return "gpu:" + gpus
+}
+
+func (row sinfoRow) field(t byte) string {
+	switch t {
+	case 'P':
+		if row.Default {
+			return row.Partition + "*"
+		}
+		return row.Partition
+	case 'R':
+		return row.Partition
+	case 'a':
+		return "up"
+	case 'l':
+		return row.TimeLimit
+	case 'D':
+		return strconv.Itoa(row.Nodes)
+	case 't':
+		return row.State
+	case 'T':
+		switch row.State {
+		case "alloc":
+			return "allocated"
+		case "mix":
+			return "mixed"
+		}
+		return row.State
+	case 'N':
+		return row.nodeList()
+	case 'c':
+		return sinfoMachineValue(row.Machines,
+			func(machine jarvice.JarviceMachineInfo) int { return machine.Cores })
+	case 'm':
+		return sinfoMachineValue(row.Machines,
+			func(machine jarvice.JarviceMachineInfo) int { return machine.Ram * 1024 })
+	case 'G':
+		return row.gres()
+	case 'f':
+		return row.nodeList()
+	case 'F':
+		return fmt.Sprintf("%d/%d/0/%d", row.Allocated, row.Total-row.Allocated, row.Total)
+	}
+	return ""
+}
+
+// Partition state used for sinfo output
+type sinfoPartition struct {
+	Queue    jarvice.JarviceQueue
+	Machines []jarvice.JarviceMachineInfo
+	// allocated nodes by machine type
+	Allocated map[string]int
+}
+
+func (p sinfoPartition) timeLimit() string {
+	if len(p.Queue.Walltime) > 0 {
+		return p.Queue.Walltime
+	}
+	return "infinite"
+}
+
+func (p sinfoPartition) allocated() int {
+	total := 0
+	for _, nodes := range p.Allocated {
+		total += nodes
+	}
+	if total > p.Queue.MachineScale {
+		total = p.Queue.MachineScale
+	}
+	return total
+}
+
+// Partition state rows (allocated and idle nodes)
+func (p sinfoPartition) rows(summarize bool) []sinfoRow {
+	base := sinfoRow{
+		Partition: p.Queue.Name,
+		Default:   p.Queue.Name == "default",
+		TimeLimit: p.timeLimit(),
+		Allocated: p.allocated(),
+		Total:     p.Queue.MachineScale,
+		Machines:  p.Machines,
+	}
+	if summarize {
+		return []sinfoRow{base}
+	}
+	rows := []sinfoRow{}
+	if base.Allocated > 0 {
+		row := base
+		row.Nodes = base.Allocated
+		row.State = "alloc"
+		row.Machines = []jarvice.JarviceMachineInfo{}
+		for _, machine := range p.Machines {
+			if p.Allocated[machine.Name] > 0 {
+				row.Machines = append(row.Machines, machine)
+			}
+		}
+		rows = append(rows, row)
+	}
+	if idle := base.Total - base.Allocated; idle > 0 || len(rows) == 0 {
+		row := base
+		row.Nodes = idle
+		row.State = "idle"
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// Node oriented rows (one per machine type)
+func (p sinfoPartition) nodeRows() []sinfoRow {
+	rows := []sinfoRow{}
+	for _, machine := range p.Machines {
+		total := p.Queue.MachineScale
+		if machine.ScaleMax > 0 && machine.ScaleMax < total {
+			total = machine.ScaleMax
+		}
+		allocated := p.Allocated[machine.Name]
+		if allocated > total {
+			allocated = total
+		}
+		row := sinfoRow{
+			Partition: p.Queue.Name,
+			Default:   p.Queue.Name == "default",
+			TimeLimit: p.timeLimit(),
+			Nodes:     total,
+			Allocated: allocated,
+			Total:     total,
+			State:     "idle",
+			Machines:  []jarvice.JarviceMachineInfo{machine},
+		}
+		if allocated == total {
+			row.State = "alloc"
+		} else if allocated > 0 {
+			row.State = "mix"
+		}
+		rows = append(rows, row)
 	}
+	return rows
+}
+
+// Read partitions with machine types and nodes used by running jobs
+func sinfoReadPartitions(cluster jarvice.JarviceCluster) ([]sinfoPartition, error) {
 	urlValues := cluster.GetUrlCreds()
 	urlValues.Add("info", "true")
-	if resp, err := jarvice.ApiReq(cluster.Endpoint,
+	resp, err := jarvice.ApiReq(cluster.Endpoint,
 		"queues",
 		cluster.Insecure,
-		urlValues); err == nil {
+		urlValues)
+	if err != nil {
+		return nil, err
+	}
+	jarviceQueues := jarvice.JarviceQueues{}
+	if err := json.Unmarshal(resp, &jarviceQueues); err != nil {
+		return nil, errors.New("cannot read response")
+	}
+	machines, err := jarvice.GetJarviceMachines(cluster)
+	if err != nil {
+		return nil, err
+	}
+	jobs, _, err := jarvice.ReadJarviceJobs(cluster, false)
+	if err != nil {
+		return nil, err
+	}
+	allocated := map[string]map[string]int{}
+	for _, job := range jobs {
+		state := job.State()
+		if state.Pending || state.Terminal || len(job.ApiSubmission.Queue) == 0 {
+			continue
+		}
+		queue := job.ApiSubmission.Queue
+		if _, ok := allocated[queue]; !ok {
+			allocated[queue] = map[string]int{}
+		}
+		allocated[queue][job.ApiSubmission.Machine.Type] += job.ApiSubmission.Machine.Nodes
+	}
+	names := []string{}
+	for name := range jarviceQueues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	partitions := []sinfoPartition{}
+	for _, name := range names {
+		queue := jarviceQueues[name]
+		partitions = append(partitions, sinfoPartition{
+			Queue:     queue,
+			Machines:  jarvice.QueueMachines(queue, machines),
+			Allocated: allocated[queue.Name],
+		})
+	}
+	return partitions, nil
+}
 
-		jarviceQueues := jarvice.JarviceQueues{}
-		if err := json.Unmarshal([]byte(resp), &jarviceQueues); err != nil {
-			return errors.New("sinfo: cannot read response")
+func printPartitionJson(partitions []sinfoPartition) error {
+	type jsonMachine struct {
+		Name   string `json:"name"`
+		Cpus   int    `json:"cpus"`
+		Memory int    `json:"memory"`
+		Gpus   int    `json:"gpus"`
+	}
+	type jsonPartition struct {
+		Name      string        `json:"name"`
+		Default   bool          `json:"default"`
+		State     string        `json:"state"`
+		TimeLimit string        `json:"time_limit"`
+		Total     int           `json:"total_nodes"`
+		Allocated int           `json:"allocated_nodes"`
+		Idle      int           `json:"idle_nodes"`
+		Machines  []jsonMachine `json:"machines"`
+	}
+	ret := struct {
+		Partitions []jsonPartition `json:"partitions"`
+	}{Partitions: []jsonPartition{}}
+	for _, p := range partitions {
+		entry := jsonPartition{
+			Name:      p.Queue.Name,
+			Default:   p.Queue.Name == "default",
+			State:     "UP",
+			TimeLimit: p.timeLimit(),
+			Total:     p.Queue.MachineScale,
+			Allocated: p.allocated(),
+			Idle:      p.Queue.MachineScale - p.allocated(),
+			Machines:  []jsonMachine{},
+		}
+		for _, machine := range p.Machines {
+			entry.Machines = append(entry.Machines, jsonMachine{
+				Name:   machine.Name,
+				Cpus:   machine.Cores,
+				Memory: machine.Ram * 1024,
+				Gpus:   machine.Gpus,
+			})
 		}
-		printPartitionInfo(jarviceQueues)
-		return nil
+		ret.Partitions = append(ret.Partitions, entry)
+	}
+	out, err := json.MarshalIndent(ret, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func (x *SInfoCommand) Execute(args []string) error {
+	if x.Help {
+		return jarvice.CreateHelpErr()
+	}
+	format := sinfoDefaultFormat
+	if len(x.Format) > 0 {
+		format = x.Format
+	} else if x.Summarize {
+		format = sinfoSummarizeFormat
+	} else if x.Node {
+		format = sinfoNodeFormat
+	}
+	prefix, fields, err := parseSlurmFormat(format, sinfoHeaders)
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "sinfo",
+			Err:     err,
+		}
+	}
+	cluster, err := jarvice.GetClusterConfig()
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "sinfo",
+			Err:     err,
+		}
+	}
+	partitions, err := sinfoReadPartitions(cluster)
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "sinfo",
+			Err:     err,
+		}
+	}
+	if filter := squeueFilter(x.Partitions, false); filter != nil {
+		selected := []sinfoPartition{}
+		for _, p := range partitions {
+			if squeueMatch(filter, p.Queue.Name) {
+				selected = append(selected, p)
+			}
+		}
+		partitions = selected
+	}
+	if x.Json {
+		return printPartitionJson(partitions)
+	}
+	rows := []sinfoRow{}
+	for _, p := range partitions {
+		if x.Node {
+			rows = append(rows, p.nodeRows()...)
+		} else {
+			rows = append(rows, p.rows(x.Summarize)...)
+		}
+	}
+	if !x.NoHeader {
+		printSlurmRow(prefix, fields, func(t byte) string { return sinfoHeaders[t] })
+	}
+	for _, row := range rows {
+		printSlurmRow(prefix, fields, row.field)
 	}
-	return errors.New("sinfo: HTTP error")
+	return nil
 }
 
 func init() {
@@ -1,80 +1,550 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	jarvice "jarvice.io/jarvice-hpc/core"
 )
 
 type SQueueCommand struct {
-	Help bool `short:"h" long:"help" description:"Show this help message"`
-	// user JARVICE config credentials for API requests (ignore Username option)
-	// Username string `short:"u" description:"username"`
+	Help       bool   `long:"help" description:"Show this help message"`
+	Jobs       string `short:"j" long:"jobs" description:"Specify a comma separated list of job IDs to display"`
+	Users      string `short:"u" long:"user" description:"Request jobs from a comma separated list of users"`
+	Partitions string `short:"p" long:"partition" description:"Specify the partitions of the jobs to view. Accepts a comma separated list of partition names"`
+	States     string `short:"t" long:"states" description:"Specify the states of jobs to view. Accepts a comma separated list of state names or \"all\""`
+	Names      string `short:"n" long:"name" description:"Request jobs having one of a comma separated list of names"`
+	NoHeader   bool   `short:"h" long:"noheader" description:"Do not print a header on the output"`
+	Format     string `short:"o" long:"format" description:"Specify the information to be displayed using an output format specification\n%[[.]size]type (e.g. \"%.18i %.9P %.8j %.8u %.2t %.10M %.6D %R\")"`
+	FormatLong string `short:"O" long:"Format" description:"Specify the information to be displayed\ntype[:[.][size]][,...] (e.g. \"JobID,Partition:.12,State\")"`
+	Sort       string `short:"S" long:"sort" description:"Specification of the order in which records should be reported\n[-]type[,...] (e.g. \"P,-t\")"`
+	Iterate    int    `short:"i" long:"iterate" description:"Repeatedly gather and report the requested information at the interval specified (in seconds)"`
 }
 
 var sQueueCommand SQueueCommand
 
-func (x *SQueueCommand) Execute(args []string) error {
-	if x.Help {
-		return jarvice.CreateHelpErr()
+const squeueDefaultFormat = "%.18i %.9P %.8j %.8u %.2t %.10M %.6D %R"
+
+// Job record displayed by squeue
+type squeueJob struct {
+	Number       int
+	Id           string
+	Partition    string
+	Name         string
+	User         string
+	Account      string
+	State        string
+	StateCompact string
+	Reason       string
+	Machine      string
+	Nodes        int
+	TimeUsed     int64
+	TimeLimit    string
+	StartTime    int64
+	SubmitTime   int64
+	Terminal     bool
+	// heterogeneous job leader and component offset
+	HetJobId     int
+	HetJobOffset int
+}
+
+// Sort key of job ID (heterogeneous job components follow their leader)
+func (job squeueJob) idKey() (int, int) {
+	if job.HetJobId > 0 {
+		return job.HetJobId, job.HetJobOffset
 	}
-	// use Cluster option name in query
-	cluster, err := jarvice.GetClusterConfig()
-	if err != nil {
-		return err
+	return job.Number, 0
+}
+
+// Compare job IDs
+func (job squeueJob) idLess(other squeueJob) bool {
+	id, offset := job.idKey()
+	otherId, otherOffset := other.idKey()
+	return id < otherId || (id == otherId && offset < otherOffset)
+}
+
+// Slurm output format field (squeue, sinfo)
+type slurmField struct {
+	Type  byte
+	Size  int
+	Right bool
+	// literal text printed after field
+	Suffix string
+}
+
+// -O/--Format field names
+var slurmFieldNames = map[string]byte{
+	"account":      'a',
+	"jobid":        'i',
+	"partition":    'P',
+	"name":         'j',
+	"username":     'u',
+	"user":         'u',
+	"state":        'T',
+	"statecompact": 't',
+	"timeused":     'M',
+	"timelimit":    'l',
+	"numnodes":     'D',
+	"reasonlist":   'R',
+	"reason":       'r',
+	"nodelist":     'N',
+	"starttime":    'S',
+	"submittime":   'V',
+}
+
+var squeueHeaders = map[byte]string{
+	'a': "ACCOUNT",
+	'i': "JOBID",
+	'P': "PARTITION",
+	'j': "NAME",
+	'u': "USER",
+	'T': "STATE",
+	't': "ST",
+	'M': "TIME",
+	'l': "TIME_LIMIT",
+	'D': "NODES",
+	'R': "NODELIST(REASON)",
+	'r': "REASON",
+	'N': "NODELIST",
+	'S': "START_TIME",
+	'V': "SUBMIT_TIME",
+}
+
+// Format elapsed seconds as [days-]hours:minutes:seconds
+func slurmDuration(seconds int64) string {
+	if seconds < 0 {
+		seconds = 0
+	}
+	days := seconds / 86400
+	hours := (seconds % 86400) / 3600
+	mins := (seconds % 3600) / 60
+	secs := seconds % 60
+	if days > 0 {
+		return fmt.Sprintf("%d-%02d:%02d:%02d", days, hours, mins, secs)
+	}
+	if hours > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", hours, mins, secs)
+	}
+	return fmt.Sprintf("%d:%02d", mins, secs)
+}
+
+// Format unix time as Slurm timestamp
+func slurmTimestamp(t int64) string {
+	if t <= 0 {
+		return "N/A"
+	}
+	return time.Unix(t, 0).Format("2006-01-02T15:04:05")
+}
+
+func (job squeueJob) field(t byte) string {
+	switch t {
+	case 'a':
+		return job.Account
+	case 'i':
+		return job.Id
+	case 'P':
+		return job.Partition
+	case 'j':
+		return job.Name
+	case 'u':
+		return job.User
+	case 'T':
+		return job.State
+	case 't':
+		return job.StateCompact
+	case 'M':
+		return slurmDuration(job.TimeUsed)
+	case 'l':
+		return job.TimeLimit
+	case 'D':
+		return strconv.Itoa(job.Nodes)
+	case 'R':
+		if job.StateCompact != "PD" {
+			return job.Machine
+		}
+		return "(" + job.Reason + ")"
+	case 'r':
+		return job.Reason
+	case 'N':
+		if job.StateCompact != "PD" {
+			return job.Machine
+		}
+		return ""
+	case 'S':
+		return slurmTimestamp(job.StartTime)
+	case 'V':
+		return slurmTimestamp(job.SubmitTime)
+	}
+	return ""
+}
+
+// Parse -o/--format output format specification (e.g. "%.18i %.9P")
+// Field types are validated against headers
+func parseSlurmFormat(format string, headers map[byte]string) (prefix string,
+	fields []slurmField, err error) {
+
+	text := ""
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			text += string(format[i])
+			continue
+		}
+		if i+1 < len(format) && format[i+1] == '%' {
+			text += "%"
+			i++
+			continue
+		}
+		field := slurmField{}
+		j := i + 1
+		if j < len(format) && format[j] == '.' {
+			field.Right = true
+			j++
+		}
+		start := j
+		for j < len(format) && format[j] >= '0' && format[j] <= '9' {
+			j++
+		}
+		if j > start {
+			field.Size, _ = strconv.Atoi(format[start:j])
+		}
+		if j >= len(format) {
+			return "", nil, errors.New("invalid format specification: " + format)
+		}
+		field.Type = format[j]
+		if _, ok := headers[field.Type]; !ok {
+			return "", nil, errors.New("invalid format specification: %" + string(field.Type))
+		}
+		if len(fields) == 0 {
+			prefix = text
+		} else {
+			fields[len(fields)-1].Suffix = text
+		}
+		text = ""
+		fields = append(fields, field)
+		i = j
+	}
+	if len(fields) == 0 {
+		prefix = text
+	} else {
+		fields[len(fields)-1].Suffix = text
 	}
-	if resp, err := jarvice.ApiReq(cluster.Endpoint,
-		"jobs",
-		cluster.Insecure,
-		cluster.GetUrlCreds()); err == nil {
+	return
+}
 
-		var jarviceJobs jarvice.JarviceJobs
-		if err := json.Unmarshal([]byte(resp), &jarviceJobs); err != nil {
-			return errors.New("squeue: cannot read response")
+// Parse -O/--Format output format specification
+func parseSqueueFormatLong(format string) ([]slurmField, error) {
+	fields := []slurmField{}
+	for _, item := range strings.Split(format, ",") {
+		parts := strings.SplitN(item, ":", 2)
+		t, ok := slurmFieldNames[strings.ToLower(parts[0])]
+		if !ok {
+			return nil, errors.New("invalid format specification: " + parts[0])
 		}
-		retTable := [][]string{
-			{"JOBID", "PARTITION", "NAME", "USER", "ST", "TIME", "NODES", "NODELIST(REASON)"},
+		field := slurmField{Type: t, Size: 20}
+		if len(parts) == 2 {
+			size := parts[1]
+			if strings.HasPrefix(size, ".") {
+				field.Right = true
+				size = size[1:]
+			}
+			if len(size) > 0 {
+				val, err := strconv.Atoi(size)
+				if err != nil {
+					return nil, errors.New("invalid field size: " + item)
+				}
+				field.Size = val
+			}
 		}
+		field.Suffix = " "
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// Pad and truncate value to field size
+func (field slurmField) pad(value string) string {
+	if field.Size <= 0 {
+		return value + field.Suffix
+	}
+	if len(value) > field.Size {
+		value = value[:field.Size]
+	}
+	if field.Right {
+		return fmt.Sprintf("%*s", field.Size, value) + field.Suffix
+	}
+	return fmt.Sprintf("%-*s", field.Size, value) + field.Suffix
+}
 
-		state := "PD"
-		reason := "(Resources)"
-		for index, job := range jarviceJobs {
-			if len(job.ApiSubmission.Queue) == 0 {
+// Print formatted output row
+func printSlurmRow(prefix string, fields []slurmField, value func(t byte) string) {
+	var b strings.Builder
+	b.WriteString(prefix)
+	for _, field := range fields {
+		b.WriteString(field.pad(value(field.Type)))
+	}
+	fmt.Println(strings.TrimRight(b.String(), " "))
+}
+
+// Sort jobs using squeue sort specification (e.g. "P,-t")
+func sortSqueueJobs(jobs []squeueJob, spec string) {
+	keys := strings.Split(spec, ",")
+	sort.SliceStable(jobs, func(i, j int) bool {
+		for _, key := range keys {
+			if len(key) == 0 {
 				continue
 			}
-			switch job.Status {
-			case "PROCESSING STARTING":
-				state = "R"
-				reason = job.ApiSubmission.Machine.Type
-				/*
-					case "SUBMITTED":
-					case "COMPLETED":
-					case "COMPLETED WITH ERROR":
-					case "TERMINATED":
-					case "CANCELED":
-					case "EXEMPT":
-					case "SEQUENTIALLY QUEUED":
-				*/
+			desc := false
+			if key[0] == '-' {
+				desc = true
+				key = key[1:]
+			} else if key[0] == '+' {
+				key = key[1:]
+			}
+			if len(key) == 0 {
+				continue
+			}
+			var less, greater bool
+			switch key[0] {
+			case 'i', 'A':
+				less, greater = jobs[i].idLess(jobs[j]), jobs[j].idLess(jobs[i])
+			case 'M':
+				less, greater = jobs[i].TimeUsed < jobs[j].TimeUsed, jobs[i].TimeUsed > jobs[j].TimeUsed
+			case 'D':
+				less, greater = jobs[i].Nodes < jobs[j].Nodes, jobs[i].Nodes > jobs[j].Nodes
+			case 'S':
+				less, greater = jobs[i].StartTime < jobs[j].StartTime, jobs[i].StartTime > jobs[j].StartTime
+			case 'V':
+				less, greater = jobs[i].SubmitTime < jobs[j].SubmitTime, jobs[i].SubmitTime > jobs[j].SubmitTime
 			default:
-				state = "PD"
+				a, b := jobs[i].field(key[0]), jobs[j].field(key[0])
+				less, greater = a < b, a > b
+			}
+			if desc {
+				less, greater = greater, less
+			}
+			if less {
+				return true
 			}
-			jobScale := strconv.Itoa(job.ApiSubmission.Machine.Nodes)
-			retTable = append(retTable, []string{strconv.Itoa(index),
-				job.ApiSubmission.Queue,
-				job.Label,
-				job.User,
-				state,
-				"0:00",
-				jobScale,
-				reason})
-		}
-		jarvice.PrintTable(retTable, false)
+			if greater {
+				return false
+			}
+		}
+		return jobs[i].idLess(jobs[j])
+	})
+}
+
+// Split comma separated filter into set
+func squeueFilter(list string, fold bool) map[string]struct{} {
+	if len(list) == 0 {
+		return nil
+	}
+	filter := map[string]struct{}{}
+	for _, item := range strings.Split(list, ",") {
+		if fold {
+			item = strings.ToUpper(item)
+		}
+		filter[item] = struct{}{}
+	}
+	return filter
+}
+
+func squeueMatch(filter map[string]struct{}, values ...string) bool {
+	if filter == nil {
+		return true
+	}
+	for _, value := range values {
+		if _, ok := filter[value]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Read JARVICE jobs and jobs held on the client
+// Finished JARVICE jobs are only read if completed is set
+func squeueReadJobs(cluster jarvice.JarviceCluster, completed bool) ([]squeueJob, error) {
+	var jarviceJobs jarvice.JarviceJobs
+	var err error
+	if completed {
+		jarviceJobs, _, err = jarvice.ReadAllJarviceJobs(cluster)
+	} else {
+		jarviceJobs, _, err = jarvice.ReadJarviceJobs(cluster, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	hetJobs := jarvice.ReadHetJobComponents()
+	jobs := []squeueJob{}
+	for index, job := range jarviceJobs {
+		if len(job.ApiSubmission.Queue) == 0 {
+			continue
+		}
+		state := job.State()
+		timeLimit := "UNLIMITED"
+		if val := job.ApiSubmission.Application.Walltime; len(val) > 0 {
+			timeLimit = val
+		}
+		jobs = append(jobs, squeueJob{
+			Number:       index,
+			Id:           strconv.Itoa(index),
+			Partition:    job.ApiSubmission.Queue,
+			Name:         job.Label,
+			User:         job.User,
+			Account:      job.User,
+			State:        state.SlurmLong,
+			StateCompact: state.Slurm,
+			Reason:       state.SlurmReason,
+			Terminal:     state.Terminal,
+			Machine:      job.ApiSubmission.Machine.Type,
+			Nodes:        job.ApiSubmission.Machine.Nodes,
+			TimeUsed:     job.Elapsed(now),
+			TimeLimit:    timeLimit,
+			StartTime:    int64(job.StartTime),
+			SubmitTime:   int64(job.SubmitTime),
+		})
+		if component, ok := hetJobs[index]; ok {
+			jobs[len(jobs)-1].Id = component.Id()
+			jobs[len(jobs)-1].HetJobId = component.Leader
+			jobs[len(jobs)-1].HetJobOffset = component.Offset
+		}
+	}
+	// jobs held on the client (e.g. --begin)
+	if deferredJobs, err := jarvice.ReadDeferredJobs(); err == nil {
+		for _, job := range deferredJobs {
+			if !job.Local() {
+				continue
+			}
+			timeLimit := "UNLIMITED"
+			if val := job.Request.Application.Walltime; len(val) > 0 {
+				timeLimit = val
+			}
+			account := job.Request.User.Username
+			if job.Request.JobProject != nil {
+				account = *job.Request.JobProject
+			}
+			jobs = append(jobs, squeueJob{
+				Number:       job.Id,
+				Id:           strconv.Itoa(job.Id),
+				Partition:    job.Request.Hpc.Queue,
+				Name:         job.Request.JobLabel,
+				User:         job.Request.User.Username,
+				Account:      account,
+				State:        "PENDING",
+				StateCompact: "PD",
+				Reason:       job.Reason(),
+				Machine:      job.Request.Machine.Type,
+				Nodes:        job.Request.Machine.Nodes,
+				TimeLimit:    timeLimit,
+				SubmitTime:   job.SubmitTime,
+			})
+		}
+	}
+	return jobs, nil
+}
+
+func (x *SQueueCommand) printJobs(cluster jarvice.JarviceCluster) error {
+	prefix := ""
+	var fields []slurmField
+	var err error
+	if len(x.FormatLong) > 0 {
+		fields, err = parseSqueueFormatLong(x.FormatLong)
+	} else if len(x.Format) > 0 {
+		prefix, fields, err = parseSlurmFormat(x.Format, squeueHeaders)
+	} else {
+		prefix, fields, err = parseSlurmFormat(squeueDefaultFormat, squeueHeaders)
+	}
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "squeue",
+			Err:     err,
+		}
+	}
+	jobFilter := squeueFilter(x.Jobs, false)
+	// local job IDs of submitted jobs select their JARVICE job
+	for item := range jobFilter {
+		if id, err := strconv.Atoi(item); err == nil {
+			jobFilter[strconv.Itoa(jarvice.ResolveJobId(id))] = struct{}{}
+		}
+	}
+	userFilter := squeueFilter(x.Users, false)
+	partitionFilter := squeueFilter(x.Partitions, false)
+	nameFilter := squeueFilter(x.Names, false)
+	stateFilter := squeueFilter(x.States, true)
+	// finished jobs are only shown if requested (by state or job ID)
+	showTerminal := stateFilter != nil || jobFilter != nil
+	if _, ok := stateFilter["ALL"]; ok {
+		stateFilter = nil
+	}
+	allJobs, err := squeueReadJobs(cluster, showTerminal)
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "squeue",
+			Err:     err,
+		}
+	}
+	jobs := []squeueJob{}
+	for _, job := range allJobs {
+		if job.Terminal && !showTerminal {
+			continue
+		}
+		// heterogeneous job ID selects all components
+		// (components also match their JARVICE job number)
+		hetJobId := ""
+		if job.HetJobId > 0 {
+			hetJobId = strconv.Itoa(job.HetJobId)
+		}
+		if squeueMatch(jobFilter, job.Id, hetJobId, strconv.Itoa(job.Number)) &&
+			squeueMatch(userFilter, job.User) &&
+			squeueMatch(partitionFilter, job.Partition) &&
+			squeueMatch(nameFilter, job.Name) &&
+			squeueMatch(stateFilter, job.State, job.StateCompact) {
+			jobs = append(jobs, job)
+		}
+	}
+	sortSpec := "P,t"
+	if len(x.Sort) > 0 {
+		sortSpec = x.Sort
+	}
+	sortSqueueJobs(jobs, sortSpec)
+	if !x.NoHeader {
+		printSlurmRow(prefix, fields, func(t byte) string { return squeueHeaders[t] })
+	}
+	for _, job := range jobs {
+		printSlurmRow(prefix, fields, job.field)
 	}
 	return nil
 }
 
+func (x *SQueueCommand) Execute(args []string) error {
+	if x.Help {
+		return jarvice.CreateHelpErr()
+	}
+	// use Cluster option name in query
+	cluster, err := jarvice.GetClusterConfig()
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "squeue",
+			Err:     err,
+		}
+	}
+	if x.Iterate <= 0 {
+		return x.printJobs(cluster)
+	}
+	for {
+		fmt.Println(time.Now().Format(time.ANSIC))
+		if err := x.printJobs(cluster); err != nil {
+			return err
+		}
+		fmt.Println()
+		time.Sleep(time.Duration(x.Iterate) * time.Second)
+	}
+}
+
 func init() {
 	parser.AddCommand("squeue",
 		"Slurm squeue",
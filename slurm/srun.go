@@ -0,0 +1,441 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	jarvice "jarvice.io/jarvice-hpc/core"
+)
+
+type SRunCommand struct {
+	Help         bool   `short:"h" long:"help" description:"Show this help message"`
+	Nodes        int    `short:"N" long:"nodes" description:"Number of nodes be allocated to this job"`
+	NTasks       int    `short:"n" long:"ntasks" description:"Number of tasks. Used with the queue machine types to select machine type and node count"`
+	CpusPerTask  int    `short:"c" long:"cpus-per-task" description:"Number of processors per task"`
+	Partition    string `short:"p" long:"partition" description:"Request a specific partition for the resource allocation" default:"default"`
+	Jobname      string `short:"J" long:"job-name" description:"Specify a name for the job"`
+	Time         string `short:"t" long:"time" description:"Set a limit on the total run time of the job (ignored: JARVICE does not enforce job time limits)"`
+	Account      string `short:"A" long:"account" description:"Charge resources used by this job to specified account"`
+	TasksPerNode int    `long:"ntasks-per-node" description:"Number of tasks to invoke on each node (in JARVICE jobs)"`
+	Pty          bool   `long:"pty" description:"Execute task zero in pseudo terminal mode"`
+	Args         struct {
+		Command []string `positional-arg-name:"command" description:"command to run (use -- before command options)"`
+	} `positional-args:"true" required:"1"`
+}
+
+var sRunCommand SRunCommand
+
+// Lines of job output requested from jarvice/tail
+const srunTailLines = 10000
+
+// Interval between job output requests
+const srunTailInterval = 2 * time.Second
+
+// JARVICE job user for ssh connections
+const jarviceJobUser = "nimbix"
+
+// Commands provided by the JARVICE-HPC binary in JARVICE jobs
+var slurmJobCommands = []string{"srun", "scontrol"}
+
+// Task of an srun job step in a JARVICE job
+type srunTask struct {
+	Id      int
+	LocalId int
+	NodeId  int
+	Node    string
+}
+
+// Join command arguments into a shell command line
+func srunCommandLine(command []string) string {
+	quoted := []string{}
+	for _, arg := range command {
+		quoted = append(quoted, jarvice.ShellQuote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Command run on allocation nodes through the job head node
+func srunRemoteCommand(command []string, nodes int) string {
+	cmdLine := srunCommandLine(command)
+	if nodes <= 1 {
+		return cmdLine
+	}
+	return fmt.Sprintf("for h in $(head -n %d /etc/JARVICE/nodes); do "+
+		"ssh -o StrictHostKeyChecking=no -o LogLevel=ERROR \"$h\" %s & done; wait",
+		nodes, jarvice.ShellQuote(cmdLine))
+}
+
+// Run command on JARVICE job over ssh
+// sshpass is used with the job password if installed
+// Returns the exit status of the remote command as ExitError
+func srunSsh(connect jarvice.JarviceConnect, remote string, pty bool, env []string) error {
+	args := []string{"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "LogLevel=ERROR"}
+	if pty {
+		args = append(args, "-t")
+	}
+	args = append(args, jarviceJobUser+"@"+connect.Address, remote)
+	name := "ssh"
+	if _, err := exec.LookPath("sshpass"); err == nil && len(connect.Password) > 0 {
+		args = append([]string{"-e", "ssh"}, args...)
+		env = append(env, "SSHPASS="+connect.Password)
+		name = "sshpass"
+	}
+	return slurmRunAttached("srun", name, args, env)
+}
+
+// Lines of output not printed yet
+// jarvice/tail returns a window of the last lines: once the window is full,
+// new lines follow the last printed line (best effort)
+func srunNewLines(lines []string, printed int, last string) []string {
+	if len(lines) < srunTailLines && printed <= len(lines) {
+		return lines[printed:]
+	}
+	for index := len(lines) - 1; index >= 0; index-- {
+		if lines[index] == last {
+			return lines[index+1:]
+		}
+	}
+	return lines
+}
+
+// Stream job output to terminal until job ends
+func srunStreamOutput(cluster jarvice.JarviceCluster, number int) (jarvice.JarviceJob, error) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+	printed := 0
+	last := ""
+	for {
+		job, err := jarvice.GetJobStatus(cluster, number)
+		if err != nil {
+			return job, &jarvice.SlurmError{
+				Command: "srun",
+				Err:     err,
+			}
+		}
+		done := job.State().Terminal
+		if out, err := jarvice.TailJob(cluster, number, srunTailLines); err == nil {
+			lines := strings.Split(string(out), "\n")
+			// last line is incomplete until job ends
+			if !done || len(lines[len(lines)-1]) == 0 {
+				lines = lines[:len(lines)-1]
+			}
+			for _, line := range srunNewLines(lines, printed, last) {
+				fmt.Println(line)
+				printed++
+				last = line
+			}
+		}
+		if done {
+			return job, nil
+		}
+		select {
+		case <-interrupt:
+			fmt.Fprintln(os.Stderr, "srun: forcing job termination")
+			jarvice.CancelJob(cluster, number, true)
+			return job, &jarvice.ExitError{Code: 1}
+		case <-time.After(srunTailInterval):
+		}
+	}
+}
+
+// Place job step tasks on JARVICE job nodes (block distribution)
+func srunJobTasks(nodes []string, numNodes, numTasks, tasksPerNode int) ([]srunTask, error) {
+	if numNodes <= 0 {
+		switch {
+		case numTasks > 0 && tasksPerNode > 0:
+			numNodes = (numTasks + tasksPerNode - 1) / tasksPerNode
+		case numTasks > 0 && numTasks < len(nodes):
+			numNodes = numTasks
+		default:
+			numNodes = len(nodes)
+		}
+	}
+	if numTasks <= 0 {
+		numTasks = numNodes
+		if tasksPerNode > 0 {
+			numTasks = numNodes * tasksPerNode
+		}
+	}
+	if numTasks < numNodes {
+		numNodes = numTasks
+	}
+	if numNodes > len(nodes) || (tasksPerNode > 0 && numTasks > numNodes*tasksPerNode) {
+		return nil, errors.New("Requested node configuration is not available")
+	}
+	tasks := []srunTask{}
+	for nodeId := 0; nodeId < numNodes; nodeId++ {
+		count := numTasks / numNodes
+		if nodeId < numTasks%numNodes {
+			count++
+		}
+		if tasksPerNode > 0 {
+			count = tasksPerNode
+			if left := numTasks - len(tasks); left < count {
+				count = left
+			}
+		}
+		for localId := 0; localId < count; localId++ {
+			tasks = append(tasks, srunTask{
+				Id:      len(tasks),
+				LocalId: localId,
+				NodeId:  nodeId,
+				Node:    nodes[nodeId],
+			})
+		}
+	}
+	return tasks, nil
+}
+
+// Environment of a job step task
+func (task srunTask) env(tasks []srunTask) []string {
+	nodes := []string{}
+	for _, val := range tasks {
+		if len(nodes) == 0 || nodes[len(nodes)-1] != val.Node {
+			nodes = append(nodes, val.Node)
+		}
+	}
+	return []string{
+		"SLURM_PROCID=" + strconv.Itoa(task.Id),
+		"SLURM_LOCALID=" + strconv.Itoa(task.LocalId),
+		"SLURM_NODEID=" + strconv.Itoa(task.NodeId),
+		"SLURM_NTASKS=" + strconv.Itoa(len(tasks)),
+		"SLURM_NPROCS=" + strconv.Itoa(len(tasks)),
+		"SLURM_STEP_NUM_TASKS=" + strconv.Itoa(len(tasks)),
+		"SLURM_STEP_NUM_NODES=" + strconv.Itoa(len(nodes)),
+		"SLURM_STEP_NODELIST=" + jarvice.CompressHostlist(nodes),
+		"SLURMD_NODENAME=" + task.Node,
+	}
+}
+
+// Command running job step task on its node
+// Remote tasks inherit the Slurm environment and PATH over ssh
+func (task srunTask) command(command []string, env []string, local bool) *exec.Cmd {
+	if local {
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Env = append(os.Environ(), env...)
+		return cmd
+	}
+	for _, val := range os.Environ() {
+		if strings.HasPrefix(val, "SLURM_") || strings.HasPrefix(val, "PATH=") ||
+			strings.HasPrefix(val, jarvice.JobEnvMarker+"=") {
+			env = append([]string{val}, env...)
+		}
+	}
+	remote := []string{}
+	if cwd, err := os.Getwd(); err == nil {
+		remote = append(remote, "cd", jarvice.ShellQuote(cwd), "&&")
+	}
+	remote = append(remote, "env")
+	for _, val := range env {
+		remote = append(remote, jarvice.ShellQuote(val))
+	}
+	remote = append(remote, srunCommandLine(command))
+	return exec.Command("ssh", "-o", "StrictHostKeyChecking=no", "-o", "LogLevel=ERROR",
+		task.Node, strings.Join(remote, " "))
+}
+
+// Run job step on the nodes of the JARVICE job running this command
+func (x *SRunCommand) runInJob() error {
+	nodes, err := jarvice.ReadJobNodes()
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "srun",
+			Err:     err,
+		}
+	}
+	tasks, err := srunJobTasks(nodes, x.Nodes, x.NTasks, x.TasksPerNode)
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "srun",
+			Err: fmt.Errorf("Unable to create step for job %s: %v",
+				os.Getenv("SLURM_JOB_ID"), err),
+		}
+	}
+	hostname, _ := os.Hostname()
+	signal.Ignore(os.Interrupt)
+	defer signal.Reset(os.Interrupt)
+	errs := make([]error, len(tasks))
+	var wg sync.WaitGroup
+	for index, task := range tasks {
+		local := task.Node == hostname ||
+			strings.SplitN(task.Node, ".", 2)[0] == strings.SplitN(hostname, ".", 2)[0]
+		cmd := task.command(x.Args.Command, task.env(tasks), local)
+		// standard input is forwarded to task zero only
+		if task.Id == 0 {
+			cmd.Stdin = os.Stdin
+		}
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if errs[index] = cmd.Start(); errs[index] != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(index int, cmd *exec.Cmd) {
+			defer wg.Done()
+			errs[index] = cmd.Wait()
+		}(index, cmd)
+	}
+	wg.Wait()
+	// job step exits with the highest exit status of its tasks
+	code := 0
+	for index, err := range errs {
+		if err == nil {
+			continue
+		}
+		status := 1
+		exitErr, ok := err.(*exec.ExitError)
+		if ok {
+			status = slurmExitStatus(exitErr)
+		}
+		if ok && exitErr.Exited() {
+			fmt.Fprintf(os.Stderr, "srun: error: %s: task %d: Exited with exit code %d\n",
+				tasks[index].Node, tasks[index].Id, status)
+		} else {
+			fmt.Fprintf(os.Stderr, "srun: error: %s: task %d: %v\n",
+				tasks[index].Node, tasks[index].Id, err)
+		}
+		if status > code {
+			code = status
+		}
+	}
+	if code != 0 {
+		return &jarvice.ExitError{Code: code}
+	}
+	return nil
+}
+
+// Run command in JARVICE job started by salloc
+// The job password is read from JARVICE (salloc does not export it)
+func (x *SRunCommand) runInAllocation() error {
+	cluster, err := jarvice.GetClusterConfig()
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "srun",
+			Err:     err,
+		}
+	}
+	number, err := strconv.Atoi(os.Getenv("SLURM_JOB_ID"))
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "srun",
+			Err:     errors.New("Invalid job id " + os.Getenv("SLURM_JOB_ID")),
+		}
+	}
+	connect, err := jarvice.GetJobConnect(cluster, number)
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "srun",
+			Err:     fmt.Errorf("Unable to connect to job %d: %v", number, err),
+		}
+	}
+	// address of the allocation exported by salloc
+	if address := os.Getenv("JARVICE_JOB_ADDRESS"); len(address) > 0 {
+		connect.Address = address
+	}
+	nodes := x.Nodes
+	if nodes < 1 && !x.Pty {
+		// default to all nodes of the allocation
+		nodes, _ = strconv.Atoi(os.Getenv("SLURM_JOB_NUM_NODES"))
+	}
+	return srunSsh(connect, srunRemoteCommand(x.Args.Command, nodes), x.Pty, os.Environ())
+}
+
+// Start interactive job and run command in pseudo terminal
+func (x *SRunCommand) runInteractive(cluster jarvice.JarviceCluster, opts *SBatchCommand) error {
+	req, _, err := opts.jobRequest(cluster, slurmAllocationScript, opts.Jobname, nil)
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "srun",
+			Err:     err,
+		}
+	}
+	number, connect, err := slurmAllocate(cluster, req, "srun")
+	if err != nil {
+		return err
+	}
+	defer slurmRelinquish(cluster, number, "srun")
+	return srunSsh(connect, srunCommandLine(x.Args.Command), true,
+		slurmAllocationEnv(req, number, connect))
+}
+
+// Submit command as a job and stream its output
+func (x *SRunCommand) runBatch(cluster jarvice.JarviceCluster, opts *SBatchCommand) error {
+	script := jarvice.JobScript{
+		Shell:  "/bin/sh",
+		Script: []byte(srunCommandLine(x.Args.Command) + "\n"),
+	}
+	req, _, err := opts.jobRequest(cluster, script, opts.Jobname, nil)
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "srun",
+			Err:     err,
+		}
+	}
+	number, _, err := slurmStartJob(cluster, req, "srun")
+	if err != nil {
+		return err
+	}
+	job, err := srunStreamOutput(cluster, number)
+	if err != nil {
+		return err
+	}
+	if job.ExitCode != 0 || job.Status != jarvice.JobStatusCompleted {
+		fmt.Fprintf(os.Stderr, "srun: error: job %d: %s, exit code %s\n",
+			number, job.State().SlurmLong, slurmExitCode(job.ExitCode))
+		// JARVICE exit codes of jobs killed by a signal are 128+signal
+		code := job.ExitCode
+		if code == 0 {
+			code = 1
+		}
+		return &jarvice.ExitError{Code: code}
+	}
+	return nil
+}
+
+func (x *SRunCommand) Execute(args []string) error {
+	if x.Help {
+		return jarvice.CreateHelpErr()
+	}
+	if jarvice.InJob() {
+		return x.runInJob()
+	}
+	// salloc exports the connection information of the allocation
+	if len(os.Getenv("SLURM_JOB_ID")) > 0 && len(os.Getenv("JARVICE_JOB_ADDRESS")) > 0 {
+		return x.runInAllocation()
+	}
+	cluster, err := jarvice.GetClusterConfig()
+	if err != nil {
+		return &jarvice.SlurmError{
+			Command: "srun",
+			Err:     err,
+		}
+	}
+	jobName := x.Jobname
+	if len(jobName) == 0 {
+		jobName = x.Args.Command[0]
+	}
+	opts := slurmAllocationOptions(x.Nodes, x.NTasks, x.CpusPerTask,
+		x.Partition, jobName, x.Time, x.Account)
+	if x.Pty {
+		return x.runInteractive(cluster, opts)
+	}
+	return x.runBatch(cluster, opts)
+}
+
+func init() {
+	parser.AddCommand("srun",
+		"Slurm srun",
+		"Run parallel jobs",
+		&sRunCommand)
+}